@@ -0,0 +1,98 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// How many different relays need to agree on our address before we believe them
+const ADDRESS_GUESS_MIN_REPORTS = 3
+
+// We only remember this many reports per address family
+const ADDRESS_GUESS_MAX_REPORTS = 1000
+
+// AddressGuesser figures out our public address from what the relays we connect to say in their NETINFO cells.
+// Every relay gets one vote (its latest report), and the majority wins.
+type AddressGuesser struct {
+	lock    sync.Mutex
+	reports [2]map[Fingerprint]string // IPv4, IPv6
+	guesses [2]net.IP
+}
+
+func NewAddressGuesser() *AddressGuesser {
+	return &AddressGuesser{
+		reports: [2]map[Fingerprint]string{
+			make(map[Fingerprint]string),
+			make(map[Fingerprint]string),
+		},
+	}
+}
+
+func isPublicAddress(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// Report records what a peer thinks our address is. Returns true if that changed our guess.
+func (g *AddressGuesser) Report(peer Fingerprint, ip net.IP) bool {
+	if ip == nil || !isPublicAddress(ip) {
+		return false
+	}
+
+	family := 1
+	if ip.To4() != nil {
+		family = 0
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	reports := g.reports[family]
+	if _, ok := reports[peer]; !ok && len(reports) >= ADDRESS_GUESS_MAX_REPORTS {
+		for fp := range reports { // Drop whatever comes first, the map order is random enough
+			delete(reports, fp)
+			break
+		}
+	}
+	reports[peer] = ip.String()
+
+	votes := make(map[string]int)
+	for _, addr := range reports {
+		votes[addr]++
+	}
+
+	var best string
+	bestVotes := 0
+	for addr, count := range votes {
+		if count > bestVotes {
+			best, bestVotes = addr, count
+		}
+	}
+
+	var guess net.IP
+	if bestVotes >= ADDRESS_GUESS_MIN_REPORTS && bestVotes*2 > len(reports) {
+		guess = net.ParseIP(best)
+	}
+
+	if guess.Equal(g.guesses[family]) {
+		return false
+	}
+	g.guesses[family] = guess
+	return true
+}
+
+// Our IPv4 address according to our peers, or nil if they don't agree (yet)
+func (g *AddressGuesser) Guess() net.IP {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.guesses[0]
+}
+
+func (g *AddressGuesser) GuessIPv6() net.IP {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.guesses[1]
+}
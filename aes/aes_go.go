@@ -0,0 +1,36 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !cgo
+// +build !cgo
+
+package aes
+
+import (
+	"crypto/aes"
+	gocipher "crypto/cipher"
+	"errors"
+)
+
+type cipher struct {
+	stream gocipher.Stream
+}
+
+func New(key, iv []byte) Cipher {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	return &cipher{stream: gocipher.NewCTR(block, iv)}
+}
+
+func (c *cipher) Crypt(source, target []byte) ([]byte, error) {
+	if len(source) > cap(target) {
+		return nil, errors.New("aes: target must be at least as long as the source")
+	}
+
+	target = target[:len(source)]
+	c.stream.XORKeyStream(target, source)
+	return target, nil
+}
@@ -5,13 +5,30 @@
 package aes
 
 import (
-	"github.com/tvdw/cgolock"
-	"runtime"
+	"bytes"
+	"encoding/hex"
 	"testing"
 )
 
-func init() {
-	cgolock.Init(runtime.GOMAXPROCS(0))
+// From NIST SP 800-38A, F.5.1
+func TestCTRVector(t *testing.T) {
+	key, _ := hex.DecodeString("2b7e151628aed2a6abf7158809cf4f3c")
+	iv, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff")
+	plain, _ := hex.DecodeString("6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e51")
+	expected, _ := hex.DecodeString("874d6191b620e3261bef6864990db6ce9806f66b7970fdff8617187bb9fffdff")
+
+	aes := New(key, iv)
+	out, err := aes.Crypt(plain[:5], make([]byte, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, err := aes.Crypt(plain[5:], make([]byte, len(plain)-5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out = append(out, rest...); !bytes.Equal(out, expected) {
+		t.Errorf("expected %x, got %x", expected, out)
+	}
 }
 
 func benchmarkWithSize(size int, b *testing.B) {
@@ -0,0 +1,17 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build cgo
+// +build cgo
+
+package aes
+
+import (
+	"github.com/tvdw/cgolock"
+	"runtime"
+)
+
+func init() {
+	cgolock.Init(runtime.GOMAXPROCS(0))
+}
@@ -0,0 +1,243 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+// Certificate types found in a CERTS cell
+const (
+	CERTTYPE_LINK = 1
+	CERTTYPE_ID   = 2
+	CERTTYPE_AUTH = 3
+)
+
+// Tor accepts certificates that are not valid yet or have expired, within reason. Same tolerances as C tor: a
+// certificate may have expired up to two days ago, and may become valid up to 30 days from now.
+const CERT_PAST_TOLERANCE = 48 * time.Hour
+const CERT_FUTURE_TOLERANCE = 30 * 24 * time.Hour
+
+type CertsCheck byte
+
+const (
+	_ CertsCheck = iota
+	CERTS_MALFORMED
+	CERTS_MISSING
+	CERTS_ID_KEY
+	CERTS_NOT_SELF_SIGNED
+	CERTS_NOT_SIGNED_BY_ID
+	CERTS_NOT_VALID_NOW
+	CERTS_LINK_MISMATCH
+	CERTS_BAD_CROSSCERT
+	CERTS_NOT_SIGNED_BY_SIGNING_KEY
+)
+
+func (c CertsCheck) String() string {
+	switch c {
+	case CERTS_MALFORMED:
+		return "CERTS_MALFORMED"
+	case CERTS_MISSING:
+		return "CERTS_MISSING"
+	case CERTS_ID_KEY:
+		return "CERTS_ID_KEY"
+	case CERTS_NOT_SELF_SIGNED:
+		return "CERTS_NOT_SELF_SIGNED"
+	case CERTS_NOT_SIGNED_BY_ID:
+		return "CERTS_NOT_SIGNED_BY_ID"
+	case CERTS_NOT_VALID_NOW:
+		return "CERTS_NOT_VALID_NOW"
+	case CERTS_LINK_MISMATCH:
+		return "CERTS_LINK_MISMATCH"
+	case CERTS_BAD_CROSSCERT:
+		return "CERTS_BAD_CROSSCERT"
+	case CERTS_NOT_SIGNED_BY_SIGNING_KEY:
+		return "CERTS_NOT_SIGNED_BY_SIGNING_KEY"
+	default:
+		return fmt.Sprintf("CERTS_CHECK_%d", c)
+	}
+}
+
+// CertsError says which of the CERTS checks failed, and for which certificate type (0 if not specific to one)
+type CertsError struct {
+	Check    CertsCheck
+	CertType byte
+	Reason   string
+}
+
+func (e *CertsError) Error() string {
+	if e.CertType != 0 {
+		return fmt.Sprintf("%s (certificate type %d): %s", e.Check, e.CertType, e.Reason)
+	}
+	return fmt.Sprintf("%s: %s", e.Check, e.Reason)
+}
+
+func certsError(check CertsCheck, certType byte, format string, args ...interface{}) error {
+	return &CertsError{
+		Check:    check,
+		CertType: certType,
+		Reason:   fmt.Sprintf(format, args...),
+	}
+}
+
+// Checks the RSA certificates (indexed by type) from a CERTS cell. peerCertDER is the TLS certificate of the
+// other side, and only matters when we are the initiator.
+func validateRSACerts(certs [4]*x509.Certificate, weAreInitiator bool, peerCertDER []byte, now time.Time) error {
+	required := []byte{CERTTYPE_ID, CERTTYPE_AUTH}
+	if weAreInitiator {
+		required = []byte{CERTTYPE_ID, CERTTYPE_LINK}
+	}
+	for _, cType := range required {
+		if certs[cType] == nil {
+			return certsError(CERTS_MISSING, cType, "required certificate not present")
+		}
+	}
+
+	idCert := certs[CERTTYPE_ID]
+	idKey, ok := idCert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return certsError(CERTS_ID_KEY, CERTTYPE_ID, "identity key is not RSA")
+	}
+	if idKey.N.BitLen() != 1024 {
+		return certsError(CERTS_ID_KEY, CERTTYPE_ID, "identity key has %d bits instead of 1024", idKey.N.BitLen())
+	}
+	if err := checkCertSignature(idCert, idKey); err != nil {
+		return certsError(CERTS_NOT_SELF_SIGNED, CERTTYPE_ID, "%s", err)
+	}
+
+	for cType, cert := range certs {
+		if cert == nil {
+			continue
+		}
+
+		if now.Add(CERT_FUTURE_TOLERANCE).Before(cert.NotBefore) {
+			return certsError(CERTS_NOT_VALID_NOW, byte(cType), "not valid before %s", cert.NotBefore)
+		}
+		if now.Add(-CERT_PAST_TOLERANCE).After(cert.NotAfter) {
+			return certsError(CERTS_NOT_VALID_NOW, byte(cType), "expired at %s", cert.NotAfter)
+		}
+
+		if cType != CERTTYPE_ID {
+			if err := checkCertSignature(cert, idKey); err != nil {
+				return certsError(CERTS_NOT_SIGNED_BY_ID, byte(cType), "%s", err)
+			}
+		}
+	}
+
+	if weAreInitiator && !bytes.Equal(certs[CERTTYPE_LINK].Raw, peerCertDER) {
+		return certsError(CERTS_LINK_MISMATCH, CERTTYPE_LINK, "link certificate is not the one used for TLS")
+	}
+
+	return nil
+}
+
+// Checks the ed25519 certificates (indexed by type) from a CERTS cell and returns their ed25519 identity. The
+// RSA identity must already have been validated, as it anchors the whole thing through the cross-certificate.
+func validateEd25519Certs(certs [8][]byte, rsaID *rsa.PublicKey, weAreInitiator bool, peerCertDER []byte, now time.Time) (ed25519.PublicKey, error) {
+	required := []byte{CERTTYPE_ED_ID_SIGNING, CERTTYPE_RSA_ED_CROSSCERT, CERTTYPE_ED_SIGNING_AUTH}
+	if weAreInitiator {
+		required[2] = CERTTYPE_ED_SIGNING_LINK
+	}
+	for _, cType := range required {
+		if certs[cType] == nil {
+			return nil, certsError(CERTS_MISSING, cType, "required certificate not present")
+		}
+	}
+
+	cross, err := ParseRSAEdCrossCert(certs[CERTTYPE_RSA_ED_CROSSCERT])
+	if err != nil {
+		return nil, certsError(CERTS_MALFORMED, CERTTYPE_RSA_ED_CROSSCERT, "%s", err)
+	}
+	if err := cross.CheckSignature(rsaID); err != nil {
+		return nil, certsError(CERTS_BAD_CROSSCERT, CERTTYPE_RSA_ED_CROSSCERT, "%s", err)
+	}
+	if now.After(cross.Expires) {
+		return nil, certsError(CERTS_NOT_VALID_NOW, CERTTYPE_RSA_ED_CROSSCERT, "expired at %s", cross.Expires)
+	}
+	identity := ed25519.PublicKey(cross.EdKey[:])
+
+	signing, err := parseEd25519CertOfType(certs[CERTTYPE_ED_ID_SIGNING], CERTTYPE_ED_ID_SIGNING, ED_CERT_KEYTYPE_ED25519)
+	if err != nil {
+		return nil, err
+	}
+	if signing.SignedWith == nil {
+		return nil, certsError(CERTS_NOT_SIGNED_BY_ID, CERTTYPE_ED_ID_SIGNING, "signing key certificate does not name the identity key")
+	}
+	if err := signing.CheckSignature(identity); err != nil {
+		return nil, certsError(CERTS_NOT_SIGNED_BY_ID, CERTTYPE_ED_ID_SIGNING, "%s", err)
+	}
+	if now.After(signing.Expires) {
+		return nil, certsError(CERTS_NOT_VALID_NOW, CERTTYPE_ED_ID_SIGNING, "expired at %s", signing.Expires)
+	}
+	signingKey := ed25519.PublicKey(signing.CertifiedKey[:])
+
+	leafType, leafKeyType := byte(CERTTYPE_ED_SIGNING_AUTH), byte(ED_CERT_KEYTYPE_ED25519)
+	if weAreInitiator {
+		leafType, leafKeyType = CERTTYPE_ED_SIGNING_LINK, ED_CERT_KEYTYPE_SHA256_X509
+	}
+	leaf, err := parseEd25519CertOfType(certs[leafType], leafType, leafKeyType)
+	if err != nil {
+		return nil, err
+	}
+	if err := leaf.CheckSignature(signingKey); err != nil {
+		return nil, certsError(CERTS_NOT_SIGNED_BY_SIGNING_KEY, leafType, "%s", err)
+	}
+	if now.After(leaf.Expires) {
+		return nil, certsError(CERTS_NOT_VALID_NOW, leafType, "expired at %s", leaf.Expires)
+	}
+
+	if weAreInitiator {
+		peerDigest := sha256.Sum256(peerCertDER)
+		if !bytes.Equal(leaf.CertifiedKey[:], peerDigest[:]) {
+			return nil, certsError(CERTS_LINK_MISMATCH, CERTTYPE_ED_SIGNING_LINK, "link certificate is not the one used for TLS")
+		}
+	}
+
+	return identity, nil
+}
+
+func parseEd25519CertOfType(data []byte, certType, keyType byte) (*Ed25519Cert, error) {
+	cert, err := ParseEd25519Cert(data)
+	if err != nil {
+		return nil, certsError(CERTS_MALFORMED, certType, "%s", err)
+	}
+	if cert.CertType != certType || cert.KeyType != keyType {
+		return nil, certsError(CERTS_MALFORMED, certType, "certificate claims type %d with key type %d", cert.CertType, cert.KeyType)
+	}
+	return cert, nil
+}
+
+// x509's own CheckSignatureFrom refuses SHA1, which Tor still uses for its certificates
+func checkCertSignature(cert *x509.Certificate, key *rsa.PublicKey) error {
+	var h crypto.Hash
+	var digest []byte
+	switch cert.SignatureAlgorithm {
+	case x509.SHA1WithRSA:
+		sum := sha1.Sum(cert.RawTBSCertificate)
+		h, digest = crypto.SHA1, sum[:]
+	case x509.SHA256WithRSA:
+		sum := sha256.Sum256(cert.RawTBSCertificate)
+		h, digest = crypto.SHA256, sum[:]
+	case x509.SHA384WithRSA:
+		sum := sha512.Sum384(cert.RawTBSCertificate)
+		h, digest = crypto.SHA384, sum[:]
+	case x509.SHA512WithRSA:
+		sum := sha512.Sum512(cert.RawTBSCertificate)
+		h, digest = crypto.SHA512, sum[:]
+	default:
+		return fmt.Errorf("unsupported signature algorithm %s", cert.SignatureAlgorithm)
+	}
+
+	return rsa.VerifyPKCS1v15(key, h, digest, cert.Signature)
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func makeTestCert(t *testing.T, key *rsa.PrivateKey, signer *rsa.PrivateKey, issued, expires time.Time) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "www.example.net"},
+		NotBefore:    issued,
+		NotAfter:     expires,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func expectCertsCheck(t *testing.T, err error, check CertsCheck) {
+	if check == 0 {
+		if err != nil {
+			t.Errorf("expected no error, got %s", err)
+		}
+		return
+	}
+
+	certsErr, ok := err.(*CertsError)
+	if !ok {
+		t.Errorf("expected a CertsError %s, got %v", check, err)
+		return
+	}
+	if certsErr.Check != check {
+		t.Errorf("expected %s, got %s", check, certsErr)
+	}
+}
+
+func TestValidateRSACerts(t *testing.T) {
+	idKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	linkKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	now := time.Now()
+	issued, expires := now.Add(-24*time.Hour), now.Add(24*time.Hour)
+
+	idCert := makeTestCert(t, idKey, idKey, issued, expires)
+	linkCert := makeTestCert(t, linkKey, idKey, issued, expires)
+	authCert := makeTestCert(t, linkKey, idKey, issued, expires)
+
+	var certs [4]*x509.Certificate
+	certs[CERTTYPE_LINK] = linkCert
+	certs[CERTTYPE_ID] = idCert
+	expectCertsCheck(t, validateRSACerts(certs, true, linkCert.Raw, now), 0)
+	expectCertsCheck(t, validateRSACerts(certs, true, idCert.Raw, now), CERTS_LINK_MISMATCH)
+	expectCertsCheck(t, validateRSACerts(certs, false, nil, now), CERTS_MISSING)
+
+	// Expired certificates get two days of slack, ones that aren't valid yet 30 days
+	expectCertsCheck(t, validateRSACerts(certs, true, linkCert.Raw, now.Add(60*time.Hour)), 0)
+	expectCertsCheck(t, validateRSACerts(certs, true, linkCert.Raw, now.Add(73*time.Hour)), CERTS_NOT_VALID_NOW)
+	expectCertsCheck(t, validateRSACerts(certs, true, linkCert.Raw, now.Add(40*24*time.Hour)), CERTS_NOT_VALID_NOW)
+	expectCertsCheck(t, validateRSACerts(certs, true, linkCert.Raw, now.Add(-96*time.Hour)), 0)
+	expectCertsCheck(t, validateRSACerts(certs, true, linkCert.Raw, now.Add(-29*24*time.Hour)), 0)
+	expectCertsCheck(t, validateRSACerts(certs, true, linkCert.Raw, now.Add(-32*24*time.Hour)), CERTS_NOT_VALID_NOW)
+
+	certs[CERTTYPE_LINK] = makeTestCert(t, linkKey, otherKey, issued, expires)
+	expectCertsCheck(t, validateRSACerts(certs, true, certs[CERTTYPE_LINK].Raw, now), CERTS_NOT_SIGNED_BY_ID)
+
+	certs[CERTTYPE_LINK] = nil
+	certs[CERTTYPE_AUTH] = authCert
+	expectCertsCheck(t, validateRSACerts(certs, false, nil, now), 0)
+
+	certs[CERTTYPE_ID] = makeTestCert(t, idKey, otherKey, issued, expires)
+	expectCertsCheck(t, validateRSACerts(certs, false, nil, now), CERTS_NOT_SELF_SIGNED)
+
+	bigKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	certs[CERTTYPE_ID] = makeTestCert(t, bigKey, bigKey, issued, expires)
+	expectCertsCheck(t, validateRSACerts(certs, false, nil, now), CERTS_ID_KEY)
+}
@@ -0,0 +1,18 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"github.com/tvdw/cgolock"
+	"runtime"
+)
+
+// Only the OpenSSL code paths go through cgolock, and those only exist with cgo
+func init() {
+	cgolock.Init(runtime.NumCPU())
+}
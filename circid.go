@@ -0,0 +1,140 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rsa"
+	"errors"
+	"sync/atomic"
+)
+
+// How many random picks we try before looking for a free circuit ID the slow way, same as C tor
+const CIRCID_RANDOM_ATTEMPTS = 64
+
+var ErrCircIDsExhausted = errors.New("no free circuit IDs left on this connection")
+
+// Which half of the circuit ID space we pick from on a connection
+type circIDType int
+
+const (
+	CIRCID_TYPE_LOWER   circIDType = iota // Most significant bit clear
+	CIRCID_TYPE_HIGHER                    // Most significant bit set
+	CIRCID_TYPE_NEITHER                   // We don't create circuits here, so the other side may use any ID
+)
+
+// From v4 on the initiator of a connection takes the IDs with the most significant bit set. Before that the
+// relay with the lower identity key (compared as a number) gets the ones without it, and clients that never
+// authenticated may use any ID at all.
+func circIDTypeFor(version LinkVersion, outbound bool, ours, theirs *rsa.PublicKey) circIDType {
+	if version >= 4 {
+		if outbound {
+			return CIRCID_TYPE_HIGHER
+		}
+		return CIRCID_TYPE_LOWER
+	}
+	if theirs == nil {
+		return CIRCID_TYPE_NEITHER
+	}
+	if ours != nil && ours.N.Cmp(theirs.N) < 0 {
+		return CIRCID_TYPE_LOWER
+	}
+	return CIRCID_TYPE_HIGHER
+}
+
+// The circuit IDs we may hand out. Zero is never valid, and before v4 IDs are only 16 bits.
+func circIDRange(version LinkVersion, idType circIDType) (first, count uint32) {
+	bits := uint32(32)
+	if version < 4 {
+		bits = 16
+	}
+	msb := uint32(1) << (bits - 1)
+	if idType == CIRCID_TYPE_HIGHER {
+		return msb, msb
+	}
+	return 1, msb - 1
+}
+
+func allocateCircID(version LinkVersion, idType circIDType, inUse func(CircuitID) bool) (CircuitID, error) {
+	if idType == CIRCID_TYPE_NEITHER {
+		return 0, errors.New("not creating circuits over a connection from a client")
+	}
+	first, count := circIDRange(version, idType)
+
+	var b [4]byte
+	for i := 0; i < CIRCID_RANDOM_ATTEMPTS; i++ {
+		CRandBytes(b[:])
+		cID := CircuitID(first + BigEndian.Uint32(b[:])%count)
+		if !inUse(cID) {
+			return cID, nil
+		}
+	}
+
+	// Only a nearly full 16-bit space gets here in practice, so walking it is affordable
+	if version >= 4 {
+		return 0, ErrCircIDsExhausted
+	}
+	CRandBytes(b[:])
+	start := BigEndian.Uint32(b[:]) % count
+	for i := uint32(0); i < count; i++ {
+		cID := CircuitID(first + (start+i)%count)
+		if !inUse(cID) {
+			return cID, nil
+		}
+	}
+	return 0, ErrCircIDsExhausted
+}
+
+func (c *OnionConnection) circIDType() circIDType {
+	var ours, theirs *rsa.PublicKey
+	if c.parentOR != nil && c.parentOR.identityKey != nil {
+		ours = &c.parentOR.identityKey.PublicKey
+	}
+	if c.theyAuthenticated {
+		theirs = c.theirIdentityKey
+	}
+	return circIDTypeFor(c.negotiatedVersion, c.isOutbound, ours, theirs)
+}
+
+// Whether the other side picked this ID, meaning that it's theirs to create and we're the next hop
+func (c *OnionConnection) isTheirCircID(cID CircuitID) bool {
+	switch c.circIDType() {
+	case CIRCID_TYPE_HIGHER:
+		return !cID.MSB(c.negotiatedVersion)
+	case CIRCID_TYPE_LOWER:
+		return cID.MSB(c.negotiatedVersion)
+	default:
+		return true
+	}
+}
+
+func (c *OnionConnection) circIDInUse(cID CircuitID) bool {
+	if _, ok := c.circuits[cID]; ok {
+		return true
+	}
+	if _, ok := c.proxyCircuits[cID]; ok {
+		return true
+	}
+	_, ok := c.relayCircuits[cID]
+	return ok
+}
+
+// Picks an ID for a circuit we create on this connection. Once that fails the connection is no longer
+// offered for new circuits.
+func (c *OnionConnection) NewCircID() (CircuitID, error) {
+	cID, err := allocateCircID(c.negotiatedVersion, c.circIDType(), c.circIDInUse)
+	if err != nil {
+		atomic.StoreInt32(&c.circIDsExhausted, 1)
+	}
+	return cID, err
+}
+
+// Called whenever a circuit goes away, as its ID is free again
+func (c *OnionConnection) circIDFreed() {
+	atomic.StoreInt32(&c.circIDsExhausted, 0)
+}
+
+func (c *OnionConnection) usableForNewCircuits() bool {
+	return !c.isClosing() && atomic.LoadInt32(&c.circIDsExhausted) == 0
+}
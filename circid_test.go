@@ -0,0 +1,150 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rsa"
+	"math/big"
+	"testing"
+)
+
+func TestAllocateCircIDRange(t *testing.T) {
+	none := func(CircuitID) bool { return false }
+	for i := 0; i < 1000; i++ {
+		cID, err := allocateCircID(3, CIRCID_TYPE_HIGHER, none)
+		if err != nil || cID&0x8000 == 0 || cID > 0xffff {
+			t.Fatalf("bad outbound v3 circuit ID %x (%v)", cID, err)
+		}
+		cID, _ = allocateCircID(3, CIRCID_TYPE_LOWER, none)
+		if cID == 0 || cID&0x8000 != 0 {
+			t.Fatalf("bad inbound v3 circuit ID %x", cID)
+		}
+		cID, _ = allocateCircID(4, CIRCID_TYPE_HIGHER, none)
+		if cID&0x80000000 == 0 {
+			t.Fatalf("bad outbound v4 circuit ID %x", cID)
+		}
+		cID, _ = allocateCircID(4, CIRCID_TYPE_LOWER, none)
+		if cID == 0 || cID&0x80000000 != 0 {
+			t.Fatalf("bad inbound v4 circuit ID %x", cID)
+		}
+	}
+}
+
+func TestAllocateCircIDExhaustion(t *testing.T) {
+	const free = CircuitID(0x8123)
+	cID, err := allocateCircID(3, CIRCID_TYPE_HIGHER, func(id CircuitID) bool { return id != free })
+	if err != nil || cID != free {
+		t.Errorf("expected the only free ID %x, got %x (%v)", free, cID, err)
+	}
+
+	all := func(CircuitID) bool { return true }
+	if _, err := allocateCircID(3, CIRCID_TYPE_HIGHER, all); err != ErrCircIDsExhausted {
+		t.Errorf("expected ErrCircIDsExhausted for a full v3 space, got %v", err)
+	}
+	if _, err := allocateCircID(4, CIRCID_TYPE_LOWER, all); err != ErrCircIDsExhausted {
+		t.Errorf("expected ErrCircIDsExhausted for a full v4 space, got %v", err)
+	}
+	if _, err := allocateCircID(3, CIRCID_TYPE_NEITHER, func(CircuitID) bool { return false }); err == nil {
+		t.Error("allocated a circuit ID on a connection from a client")
+	}
+}
+
+func TestNewCircIDChecksAllMaps(t *testing.T) {
+	c := &OnionConnection{
+		negotiatedVersion: 3,
+		isOutbound:        true,
+		theyAuthenticated: true,
+		theirIdentityKey:  &rsa.PublicKey{N: big.NewInt(1000), E: 65537},
+		parentOR:          &ORCtx{identityKey: &rsa.PrivateKey{PublicKey: rsa.PublicKey{N: big.NewInt(2000), E: 65537}}},
+		circQueues:        newCircuitScheduler(nil),
+		circuits:          make(map[CircuitID]*Circuit),
+		proxyCircuits:     make(map[CircuitID]*ProxyCircuit),
+		relayCircuits:     make(map[CircuitID]*RelayCircuit),
+	}
+	for id := CircuitID(0x8000); id <= 0xffff; id++ {
+		switch id % 3 {
+		case 0:
+			c.circuits[id] = nil
+		case 1:
+			c.proxyCircuits[id] = nil
+		case 2:
+			c.relayCircuits[id] = nil
+		}
+	}
+
+	if _, err := c.NewCircID(); err == nil {
+		t.Error("got a circuit ID out of a full space")
+	}
+	if c.usableForNewCircuits() {
+		t.Error("connection still offered for new circuits after running out of IDs")
+	}
+
+	// Once a circuit goes away its ID may be used again
+	circ := testHopCircuit(70)
+	delete(c.relayCircuits, 0x8000)
+	circ.id = 0x8000
+	c.circuits[circ.id] = circ
+	c.destroyCircuit(circ, false, true, DESTROY_REASON_FINISHED)
+	if !c.usableForNewCircuits() {
+		t.Error("connection not offered for new circuits after one went away")
+	}
+	if cID, err := c.NewCircID(); err != nil || cID != 0x8000 {
+		t.Errorf("expected the freed ID 8000, got %x (%v)", cID, err)
+	}
+}
+
+func TestCircIDHalfByIdentityKey(t *testing.T) {
+	low := &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 1023), E: 65537}
+	high := &rsa.PublicKey{N: new(big.Int).Add(low.N, big.NewInt(2)), E: 65537}
+
+	for _, outbound := range []bool{true, false} {
+		for _, test := range []struct {
+			ours, theirs *rsa.PublicKey
+			expected     circIDType
+		}{
+			{low, high, CIRCID_TYPE_LOWER},
+			{high, low, CIRCID_TYPE_HIGHER},
+		} {
+			c := &OnionConnection{
+				negotiatedVersion: 3,
+				isOutbound:        outbound,
+				theyAuthenticated: true,
+				theirIdentityKey:  test.theirs,
+				parentOR:          &ORCtx{identityKey: &rsa.PrivateKey{PublicKey: *test.ours}},
+				circuits:          make(map[CircuitID]*Circuit),
+			}
+			if idType := c.circIDType(); idType != test.expected {
+				t.Errorf("outbound=%t: expected circuit ID type %d, got %d", outbound, test.expected, idType)
+			}
+
+			cID, err := c.NewCircID()
+			if err != nil || cID.MSB(3) != (test.expected == CIRCID_TYPE_HIGHER) {
+				t.Errorf("outbound=%t: allocated circuit ID %x from the wrong half (%v)", outbound, cID, err)
+			}
+			if c.isTheirCircID(cID) || !c.isTheirCircID(cID^0x8000) {
+				t.Errorf("outbound=%t: circuit ID %x taken for the wrong side's", outbound, cID)
+			}
+
+			// From v4 on only the direction of the connection counts
+			c.negotiatedVersion = 4
+			if c.circIDType() != map[bool]circIDType{true: CIRCID_TYPE_HIGHER, false: CIRCID_TYPE_LOWER}[outbound] {
+				t.Errorf("outbound=%t: identity keys used to pick circuit IDs on a v4 link", outbound)
+			}
+		}
+	}
+
+	// A client that never authenticated may pick any ID, and we don't create circuits towards it
+	c := &OnionConnection{
+		negotiatedVersion: 3,
+		theirIdentityKey:  low,
+		parentOR:          &ORCtx{identityKey: &rsa.PrivateKey{PublicKey: *high}},
+	}
+	if !c.isTheirCircID(0x0001) || !c.isTheirCircID(0x8001) {
+		t.Error("refused a circuit ID picked by a client")
+	}
+	if _, err := c.NewCircID(); err == nil {
+		t.Error("allocated a circuit ID towards a client")
+	}
+}
@@ -5,10 +5,13 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"github.com/tvdw/gotor/aes"
 	"github.com/tvdw/gotor/sha1"
 	"io"
 	"sync"
+	"time"
 )
 
 type CircuitID uint32
@@ -16,19 +19,26 @@ type CircuitID uint32
 func (id CircuitID) MSB(vers LinkVersion) bool {
 	if vers < 4 {
 		if id&0x8000 == 0x8000 {
-			return true // outgoing
+			return true
 		} else {
-			return false // incoming
+			return false
 		}
 	} else {
 		if id&0x80000000 == 0x80000000 {
-			return true // outgoing
+			return true
 		} else {
-			return false // incoming
+			return false
 		}
 	}
 }
 
+// A circuit carries at most this many RELAY_EARLY cells, which caps how far it can be extended
+const MAX_RELAY_EARLY = 8
+
+// Our own cells past the first hop go as RELAY_EARLY while there's budget to spare, like C tor does, so the
+// EXTENDs don't stand out. This many are always kept back for extending the circuit further.
+const RELAY_EARLY_EXTEND_RESERVE = 4
+
 type DirectionalCircuitState struct {
 	cipher aes.Cipher
 	digest *sha1.Digest
@@ -51,6 +61,9 @@ type Circuit struct {
 
 	streams     map[StreamID]*Stream
 	extendState *CircuitHandshakeState
+
+	relayEarlyCount int // RELAY_EARLY cells received from the client, or sent by us on our own circuits
+	sendme          sendmeState
 }
 
 type ProxyCircuit struct {
@@ -76,10 +89,22 @@ type CircuitHandshakeState struct {
 	aborted     bool
 	nextHop     CircReadQueue
 	nextHopID   CircuitID
-	keys        [2][32]byte
+	handshake   HandshakeType
+	keys        [2][32]byte // ntor: our private and public key
+	secret      []byte      // TAP: our DH private value, CREATE_FAST: the X we sent
 	fingerprint [20]byte
 	onionPublic [32]byte
-	whenDone    chan CircuitID
+	whenDone    chan CircuitBuildResult
+
+	deadline *time.Timer
+	expired  bool          // The deadline passed
+	done     bool          // The outcome has been reported
+	owner    CircReadQueue // Where the circuit waiting for this handshake lives
+	ownerID  CircuitID
+
+	edIdentity      ed25519.PublicKey // ntor v3: the relay's ed25519 identity
+	messageMAC      []byte            // ntor v3: the MAC over our message, which the relay's AUTH covers
+	replyExtensions []NtorV3Extension // ntor v3: what the relay sent back
 }
 
 type CircuitRequest struct {
@@ -106,6 +131,18 @@ func (c *CircuitRequest) CircID() CircuitID {
 	return 0
 }
 
+// Tells whoever asked for the circuit that it is not going to happen
+func (c *CircuitRequest) fail(reason DestroyReason) {
+	if c.successQueue != nil {
+		c.successQueue <- &CircuitDestroyed{
+			id:       c.localID,
+			reason:   reason,
+			truncate: true,
+		}
+	}
+	c.handshakeState.finish(buildFailed(reason, "could not reach the next hop"))
+}
+
 func (c *CircuitRequest) ReleaseBuffers() {
 	ReturnCellBuf(c.handshakeData)
 	c.handshakeState = nil
@@ -159,7 +196,9 @@ func NewCircuit(id CircuitID, fSeed, bSeed, fKey, bKey []byte) *Circuit {
 func (c *OnionConnection) destroyCircuit(circ *Circuit, announce, shouldRemove bool, reason DestroyReason) {
 	if shouldRemove {
 		delete(c.circuits, circ.id)
+		c.circIDFreed()
 	}
+	c.circQueues.remove(circ.id)
 
 	circ.backwardWindow.Abort()
 	for _, stream := range circ.streams {
@@ -168,19 +207,7 @@ func (c *OnionConnection) destroyCircuit(circ *Circuit, announce, shouldRemove b
 
 	StatsDestroyCircuit()
 
-	if circ.extendState != nil {
-		circ.extendState.lock.Lock()
-		circ.extendState.aborted = true
-		if circ.extendState.nextHop != nil {
-			if circ.nextHop != nil {
-				panic("wtf-case")
-			}
-			circ.nextHop = circ.extendState.nextHop
-			circ.nextHopID = circ.extendState.nextHopID
-		}
-		circ.extendState.lock.Unlock()
-		circ.extendState = nil
-	}
+	circ.abortExtend(reason)
 
 	if announce && circ.nextHop != nil {
 		circ.nextHop <- &CircuitDestroyed{
@@ -198,38 +225,151 @@ func (c *OnionConnection) destroyCircuit(circ *Circuit, announce, shouldRemove b
 	circ.backwardWindow = nil
 }
 
-func (c *OnionConnection) destroyRelayCircuit(circ *RelayCircuit, announce, shouldRemove bool, reason DestroyReason) {
+func (c *OnionConnection) destroyProxyCircuit(pc *ProxyCircuit, announce, shouldRemove bool, reason DestroyReason) {
 	if shouldRemove {
-		delete(c.relayCircuits, circ.id)
+		delete(c.proxyCircuits, pc.id)
+		c.circIDFreed()
 	}
+	c.circQueues.remove(pc.id)
 
-	if announce && circ.previousHop != nil {
-		circ.previousHop <- &CircuitDestroyed{
-			id:       circ.theirID,
-			reason:   reason,
-			forRelay: false,
-			//truncate: true, // XXX?
+	if announce {
+		c.writeQueue <- NewCell(c.negotiatedVersion, pc.id, CMD_DESTROY, []byte{byte(reason)}).Bytes()
+	}
+
+	if pc.backwardWindow != nil {
+		pc.backwardWindow.Abort()
+	}
+	for _, stream := range pc.streams {
+		stream.Destroy()
+	}
+	for _, pending := range pc.pendingStreams {
+		if err := FailSocks(pending.socksConn); err != nil {
+			Log(LOG_INFO, "Could not tell a SOCKS client about circuit %d going away: %s", pc.id, err)
 		}
 	}
+
+	if pc.extendState != nil {
+		pc.extendState.lock.Lock()
+		pc.extendState.aborted = true
+		pc.extendState.lock.Unlock()
+		pc.extendState.finish(buildFailed(reason, "circuit was destroyed"))
+		pc.extendState = nil
+	}
+
+	// Same as destroyCircuit: nothing should hold on to this circuit anymore
+	pc.streams = nil
+	pc.pendingStreams = nil
+	pc.forwardChain = nil
+	pc.backwardChain = nil
+	pc.backwardWindow = nil
+}
+
+// The ProxyCircuit a command was routed to, or nil if circ is a regular circuit
+func (c *OnionConnection) proxyCircuitFor(circ *Circuit) *ProxyCircuit {
+	pc, ok := c.proxyCircuits[circ.id]
+	if !ok || &pc.Circuit != circ {
+		return nil
+	}
+	return pc
 }
 
-func (c *OnionConnection) NewCircID() CircuitID {
-	for {
-		var b [4]byte
-		CRandBytes(b[:])
-		if c.isOutbound {
-			b[0] |= 0x80
-		} else {
-			b[0] &= 0x7f
+// Stops a pending extend. If the next hop already picked a circuit ID, that circuit becomes our nextHop so that
+// the caller can tear it down.
+func (circ *Circuit) abortExtend(reason DestroyReason) {
+	if circ.extendState == nil {
+		return
+	}
+	circ.extendState.finish(buildFailed(reason, "extend aborted"))
+
+	circ.extendState.lock.Lock()
+	circ.extendState.aborted = true
+	if circ.extendState.nextHop != nil {
+		if circ.nextHop != nil {
+			panic("wtf-case")
 		}
-		cID := CircuitID(BigEndian.Uint32(b[:]))
-		if c.negotiatedVersion < 4 {
-			cID = (cID & 0xffff0000) >> 16 // Cut off the last 16 bits as we can't transmit them
+		circ.nextHop = circ.extendState.nextHop
+		circ.nextHopID = circ.extendState.nextHopID
+	}
+	circ.extendState.lock.Unlock()
+	circ.extendState = nil
+}
+
+// Forgets about the next hop after it went away on its own. hopID is the circuit ID it had there (0 if the
+// connection never got that far), so that news about a hop we already replaced is ignored.
+func (circ *Circuit) dropNextHop(hopID CircuitID, reason DestroyReason) bool {
+	if circ.extendState != nil {
+		circ.extendState.lock.Lock()
+		pending := circ.extendState.nextHopID == hopID
+		if pending {
+			circ.extendState.aborted = true
+		}
+		circ.extendState.lock.Unlock()
+		if !pending {
+			return false
+		}
+		circ.extendState.finish(buildFailed(reason, "next hop went away"))
+		circ.extendState = nil
+		return true
+	}
+
+	if circ.nextHop == nil || circ.nextHopID != hopID {
+		return false
+	}
+	circ.nextHop = nil
+	circ.nextHopID = 0
+	return true
+}
+
+// Checks whether a decrypted relay cell was meant for this hop. If so, the digest takes the cell into account.
+func (s *DirectionalCircuitState) recognizes(data []byte) bool {
+	rcell := RelayCell{data}
+	if !rcell.Recognized() {
+		return false
+	}
+
+	tmpCell := GetCellBuf(false)
+	defer ReturnCellBuf(tmpCell)
+	copy(tmpCell, data)
+	tmpCell = tmpCell[:len(data)]
+	tmpCell[5] = 0
+	tmpCell[6] = 0
+	tmpCell[7] = 0
+	tmpCell[8] = 0
+
+	oldDigest := s.digest.Clone()
+	s.digest.Write(tmpCell)
+	if !bytes.Equal(rcell.Digest(), s.digest.Sum(nil)[0:4]) {
+		s.digest = oldDigest
+		return false
+	}
+	return true
+}
+
+// Peels layers off a cell coming back on a proxy circuit and returns the index of the hop that sent it, or -1
+func (pc *ProxyCircuit) decryptBackward(data []byte) int {
+	for i := 0; i < len(pc.backwardChain); i++ {
+		pc.backwardChain[i].cipher.Crypt(data, data)
+		if pc.backwardChain[i].recognizes(data) {
+			return i
 		}
+	}
+	return -1
+}
 
-		_, exists := c.circuits[cID]
-		if !exists { // XXX check infinite loop // check proxycircuits
-			return cID
+func (c *OnionConnection) destroyRelayCircuit(circ *RelayCircuit, announce, shouldRemove bool, reason DestroyReason) {
+	if shouldRemove {
+		delete(c.relayCircuits, circ.id)
+		c.circIDFreed()
+	}
+	c.circQueues.remove(circ.id)
+
+	if announce && circ.previousHop != nil {
+		circ.previousHop <- &CircuitDestroyed{
+			id:       circ.theirID,
+			reason:   reason,
+			forRelay: false,
+			truncate: true,
+			hopID:    circ.id,
 		}
 	}
 }
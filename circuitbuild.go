@@ -0,0 +1,130 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// How long a CREATE or EXTEND may take before we give up on it. Same as C tor's CircuitBuildTimeout default.
+const CIRCUIT_BUILD_TIMEOUT_DEFAULT = 60 * time.Second
+
+func (c *Config) circuitBuildTimeout() time.Duration {
+	if c.CircuitBuildTimeout == 0 {
+		return CIRCUIT_BUILD_TIMEOUT_DEFAULT
+	}
+	return c.CircuitBuildTimeout
+}
+
+// CircuitBuildError says why a circuit could not be built or extended
+type CircuitBuildError struct {
+	Reason DestroyReason
+	Detail string
+}
+
+func (e *CircuitBuildError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Detail)
+}
+
+// CircuitBuildResult is what a client waiting for a circuit gets: the circuit ID, or why there isn't one
+type CircuitBuildResult struct {
+	ID  CircuitID
+	Err *CircuitBuildError
+}
+
+func buildFailed(reason DestroyReason, detail string) CircuitBuildResult {
+	return CircuitBuildResult{Err: &CircuitBuildError{Reason: reason, Detail: detail}}
+}
+
+// Arms the deadline for this handshake. Must happen before anyone else gets to see the state.
+func (s *CircuitHandshakeState) startDeadline(timeout time.Duration) {
+	s.deadline = time.AfterFunc(timeout, s.expire)
+}
+
+func (s *CircuitHandshakeState) expire() {
+	s.lock.Lock()
+	s.aborted = true
+	s.expired = true
+	owner, ownerID := s.owner, s.ownerID
+	s.lock.Unlock()
+
+	s.finish(buildFailed(DESTROY_REASON_TIMEOUT, "no answer from the next hop in time"))
+	if owner != nil {
+		s.notifyTimeout(owner, ownerID)
+	}
+}
+
+// Tells the handshake which circuit on which connection is waiting for it, so a timeout can be handled there
+func (s *CircuitHandshakeState) attach(owner CircReadQueue, ownerID CircuitID) {
+	s.lock.Lock()
+	s.owner, s.ownerID = owner, ownerID
+	expired := s.expired
+	s.lock.Unlock()
+
+	if expired {
+		s.notifyTimeout(owner, ownerID)
+	}
+}
+
+func (s *CircuitHandshakeState) notifyTimeout(owner CircReadQueue, ownerID CircuitID) {
+	select {
+	case owner <- &HandshakeTimedOut{id: ownerID, state: s}:
+	default:
+		Log(LOG_WARN, "Circuit queue full, dropping the timeout for circuit %d", ownerID)
+	}
+}
+
+// Reports the outcome to whoever is waiting, and stops the deadline. Only the first outcome counts.
+func (s *CircuitHandshakeState) finish(result CircuitBuildResult) {
+	s.lock.Lock()
+	done := s.done
+	s.done = true
+	s.lock.Unlock()
+	if done {
+		return
+	}
+
+	if s.deadline != nil {
+		s.deadline.Stop()
+	}
+	if s.whenDone != nil {
+		s.whenDone <- result // Buffered, so this never blocks
+	}
+}
+
+type HandshakeTimedOut struct {
+	NoBuffers
+	NeverForRelay
+	id    CircuitID
+	state *CircuitHandshakeState
+}
+
+func (data *HandshakeTimedOut) CircID() CircuitID {
+	return data.id
+}
+
+func (data *HandshakeTimedOut) Handle(c *OnionConnection, circ *Circuit) ActionableError {
+	if circ.extendState != data.state {
+		return nil // Finished in the meantime
+	}
+
+	pc := c.proxyCircuitFor(circ)
+	if pc == nil {
+		Log(LOG_INFO, "Extending circuit %d timed out", circ.id)
+		return c.truncateCircuit(circ, DESTROY_REASON_TIMEOUT)
+	}
+
+	if len(pc.forwardChain) == 0 {
+		Log(LOG_INFO, "Creating proxy circuit %d timed out", pc.id)
+		c.destroyProxyCircuit(pc, true, true, DESTROY_REASON_TIMEOUT)
+		return nil
+	}
+
+	// The last hop may still finish the extend, so make it drop whatever it built
+	Log(LOG_INFO, "Extending proxy circuit %d timed out", pc.id)
+	pc.extendState = nil
+	return c.sendProxyCell(pc, 0, RELAY_TRUNCATE, nil)
+}
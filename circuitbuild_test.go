@@ -0,0 +1,96 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandshakeDeadline(t *testing.T) {
+	whenDone := make(chan CircuitBuildResult, 1)
+	queue := make(CircReadQueue, 1)
+	state := &CircuitHandshakeState{whenDone: whenDone}
+	state.startDeadline(10 * time.Millisecond)
+	state.attach(queue, 7)
+
+	result := <-whenDone
+	if result.Err == nil || result.Err.Reason != DESTROY_REASON_TIMEOUT {
+		t.Errorf("expected a timeout, got %v", result)
+	}
+	cmd := (<-queue).(*HandshakeTimedOut)
+	if cmd.id != 7 || cmd.state != state {
+		t.Error("timeout delivered for the wrong circuit")
+	}
+	if !state.aborted {
+		t.Error("handshake not aborted after its deadline")
+	}
+
+	// Attaching late still gets the circuit told
+	state.attach(queue, 8)
+	if cmd := (<-queue).(*HandshakeTimedOut); cmd.id != 8 {
+		t.Error("late attach did not hear about the timeout")
+	}
+}
+
+func TestHandshakeFinishOnce(t *testing.T) {
+	whenDone := make(chan CircuitBuildResult, 1)
+	state := &CircuitHandshakeState{whenDone: whenDone}
+	state.startDeadline(time.Hour)
+
+	state.finish(CircuitBuildResult{ID: 5})
+	state.finish(buildFailed(DESTROY_REASON_INTERNAL, "too late"))
+	state.expire()
+
+	if result := <-whenDone; result.Err != nil || result.ID != 5 {
+		t.Errorf("expected circuit 5, got %v", result)
+	}
+	select {
+	case result := <-whenDone:
+		t.Errorf("got a second outcome %v", result)
+	default:
+	}
+}
+
+func TestHandshakeTimedOutHandle(t *testing.T) {
+	c := &OnionConnection{
+		negotiatedVersion: 4,
+		writeQueue:        make(chan []byte, 2),
+		circQueues:        newCircuitScheduler(nil),
+		proxyCircuits:     make(map[CircuitID]*ProxyCircuit),
+	}
+
+	// A relay circuit waiting for its next hop gets truncated
+	circ := testHopCircuit(40)
+	state := &CircuitHandshakeState{}
+	circ.extendState = state
+	if err := (&HandshakeTimedOut{id: circ.id, state: state}).Handle(c, circ); err != nil {
+		t.Fatal(err)
+	}
+	if circ.extendState != nil || !state.aborted {
+		t.Error("timed out extend still pending")
+	}
+	if cell := c.circQueues.next(); Command(cell[4]) != CMD_RELAY {
+		t.Errorf("expected a RELAY_TRUNCATED, got %s", Command(cell[4]))
+	}
+
+	// Stale timeouts are ignored
+	if err := (&HandshakeTimedOut{id: circ.id, state: state}).Handle(c, circ); err != nil || c.circQueues.next() != nil {
+		t.Error("acted on a stale timeout")
+	}
+
+	// A proxy circuit that never got its first hop goes away
+	pc := &ProxyCircuit{Circuit: Circuit{id: 0x80000001, extendState: state}}
+	c.proxyCircuits[pc.id] = pc
+	if err := (&HandshakeTimedOut{id: pc.id, state: state}).Handle(c, &pc.Circuit); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.proxyCircuits[pc.id]; ok {
+		t.Error("proxy circuit survived its CREATE timing out")
+	}
+	if cell := <-c.writeQueue; Command(cell[4]) != CMD_DESTROY || DestroyReason(cell[5]) != DESTROY_REASON_TIMEOUT {
+		t.Error("expected a DESTROY with DESTROY_REASON_TIMEOUT")
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"golang.org/x/crypto/curve25519"
+)
+
+// NtorV3ClientPayload builds the CREATE2 handshake data from the keys, relay identity and onion key in the
+// handshake state, carrying our extensions encrypted to the relay.
+func NtorV3ClientPayload(handshakeState *CircuitHandshakeState, extensions []NtorV3Extension) ([]byte, error) {
+	clientMsg, err := encodeNtorV3Extensions(extensions)
+	if err != nil {
+		return nil, err
+	}
+	return ntor3ClientRequest(handshakeState, ntor3CircVerification, clientMsg)
+}
+
+func ntor3ClientRequest(handshakeState *CircuitHandshakeState, verification, clientMsg []byte) ([]byte, error) {
+	id := handshakeState.edIdentity
+	if len(id) != 32 {
+		return nil, errors.New("ntor v3 needs the relay's ed25519 identity")
+	}
+	B := handshakeState.onionPublic[:]
+	X := handshakeState.keys[1][:]
+
+	bx, err := curve25519.X25519(handshakeState.keys[0][:], B)
+	if err != nil {
+		return nil, err
+	}
+	encKey1, macKey1 := ntor3Phase1(bx, id, B, X, verification)
+	encryptedMsg := ntor3Enc(encKey1, clientMsg)
+	msgMAC := ntor3MAC(macKey1, concat(id, B, X, encryptedMsg), ntor3TMsgMAC)
+	handshakeState.messageMAC = msgMAC
+
+	return concat(id, B, X, encryptedMsg, msgMAC), nil
+}
+
+// NtorV3ClientComplete checks the relay's reply and returns the circuit keys. Whatever extensions the relay
+// sent back end up in the handshake state.
+func NtorV3ClientComplete(handshakeState *CircuitHandshakeState, servReply []byte) ([]byte, error) {
+	serverMsg, circuitKeys, err := ntor3ClientComplete(handshakeState, ntor3CircVerification, servReply)
+	if err != nil {
+		return nil, err
+	}
+
+	exts, err := parseNtorV3Extensions(serverMsg)
+	if err != nil {
+		return nil, err
+	}
+	handshakeState.replyExtensions = exts
+
+	return circuitKeys, nil
+}
+
+// Returns the relay's message and the circuit keys
+func ntor3ClientComplete(handshakeState *CircuitHandshakeState, verification, servReply []byte) ([]byte, []byte, error) {
+	if len(servReply) < 32+NTOR3_DIGEST_LEN {
+		return nil, nil, errors.New("ntor v3 reply too short")
+	}
+	Y := servReply[0:32]
+	auth := servReply[32 : 32+NTOR3_DIGEST_LEN]
+	encryptedMsg := servReply[32+NTOR3_DIGEST_LEN:]
+
+	id := []byte(handshakeState.edIdentity)
+	B := handshakeState.onionPublic[:]
+	X := handshakeState.keys[1][:]
+
+	xy, err := curve25519.X25519(handshakeState.keys[0][:], Y)
+	if err != nil {
+		return nil, nil, err
+	}
+	xb, err := curve25519.X25519(handshakeState.keys[0][:], B)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	verify, encKey, circuitKeys := ntor3Final(xy, xb, id, B, X, Y, verification)
+	if subtle.ConstantTimeCompare(ntor3Auth(verify, id, B, Y, X, handshakeState.messageMAC, encryptedMsg), auth) != 1 {
+		return nil, nil, errors.New("auth didn't match server response")
+	}
+
+	return ntor3Enc(encKey, encryptedMsg), circuitKeys, nil
+}
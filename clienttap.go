@@ -0,0 +1,83 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rsa"
+	"errors"
+	"math/big"
+)
+
+// TAP_KEY_LEN covers KH, the two digest seeds and the two AES keys
+const TAP_KEY_LEN = 20 + 20 + 20 + 16 + 16
+
+// TAPClientPayload generates our half of the DH exchange and returns the onionskin for the CREATE cell, along
+// with the private value that TAPClientComplete needs later.
+func TAPClientPayload(onionKey *rsa.PublicKey) ([]byte, []byte, error) {
+	p, g := tapDHGroup()
+
+	private := make([]byte, DH_PRIVATE_KEY_BITS/8)
+	if err := CRandBytes(private); err != nil {
+		return nil, nil, err
+	}
+	x := new(big.Int).SetBytes(private)
+	gx := new(big.Int).Exp(g, x, p)
+
+	onionSkin, err := HybridEncrypt(onionKey, dhBytes(gx))
+	if err != nil {
+		return nil, nil, err
+	}
+	return onionSkin, private, nil
+}
+
+// TAPClientComplete checks the relay's reply (g^y followed by KH) and returns the circuit keys, in the same
+// layout NtorClientComplete uses.
+func TAPClientComplete(handshakeState *CircuitHandshakeState, servReply []byte) ([]byte, error) {
+	if len(servReply) < DH_LEN+20 {
+		return nil, errors.New("TAP reply too short")
+	}
+
+	p, _ := tapDHGroup()
+	gy := new(big.Int).SetBytes(servReply[0:DH_LEN])
+	pMinusOne := new(big.Int).Sub(p, big.NewInt(1))
+	if gy.Cmp(big.NewInt(1)) <= 0 || gy.Cmp(pMinusOne) >= 0 {
+		return nil, errors.New("relay sent a bad DH public value")
+	}
+
+	x := new(big.Int).SetBytes(handshakeState.secret)
+	keyData := KDFTOR(TAP_KEY_LEN, dhBytes(new(big.Int).Exp(gy, x, p)))
+
+	if !hmac.Equal(keyData[0:20], servReply[DH_LEN:DH_LEN+20]) {
+		return nil, errors.New("KH didn't match server response")
+	}
+	return keyData[20:], nil
+}
+
+// FastClientPayload is the X we send in a CREATE_FAST cell. It doubles as the secret for FastClientComplete.
+func FastClientPayload() ([]byte, error) {
+	x := make([]byte, 20)
+	if err := CRandBytes(x); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// FastClientComplete checks a CREATED_FAST (Y followed by KH) and returns the circuit keys
+func FastClientComplete(handshakeState *CircuitHandshakeState, servReply []byte) ([]byte, error) {
+	if len(servReply) < 40 {
+		return nil, errors.New("CREATED_FAST reply too short")
+	}
+
+	tmp := make([]byte, 40)
+	copy(tmp[0:20], handshakeState.secret)
+	copy(tmp[20:40], servReply[0:20])
+	keyData := KDFTOR(TAP_KEY_LEN, tmp)
+
+	if !hmac.Equal(keyData[0:20], servReply[20:40]) {
+		return nil, errors.New("KH didn't match server response")
+	}
+	return keyData[20:], nil
+}
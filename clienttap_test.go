@@ -0,0 +1,149 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"github.com/tvdw/gotor/aes"
+	"math/big"
+	"testing"
+)
+
+// What HybridDecrypt does, written out separately to check HybridEncrypt against
+func testHybridDecrypt(t *testing.T, key *rsa.PrivateKey, d []byte) []byte {
+	block, err := rsa.DecryptOAEP(sha1.New(), nil, key, d[0:PK_ENC_LEN], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d) == PK_ENC_LEN {
+		return block
+	}
+
+	rest, err := aes.New(block[0:HYBRID_KEY_LEN], make([]byte, 16)).Crypt(d[PK_ENC_LEN:], make([]byte, len(d)-PK_ENC_LEN))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(block[HYBRID_KEY_LEN:], rest...)
+}
+
+func TestHybridEncrypt(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	for _, size := range []int{20, PK_ENC_LEN - PK_PAD_LEN, DH_LEN} {
+		m := make([]byte, size)
+		CRandBytes(m)
+		enc, err := HybridEncrypt(&key.PublicKey, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dec := testHybridDecrypt(t, key, enc); !bytes.Equal(dec, m) {
+			t.Errorf("%d bytes did not survive hybrid encryption", size)
+		}
+	}
+}
+
+func TestTAPClientHandshake(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	onionSkin, private, err := TAPClientPayload(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(onionSkin) != 186 {
+		t.Fatalf("TAP onionskin is %d bytes instead of 186", len(onionSkin))
+	}
+
+	// Play the relay
+	p, g := tapDHGroup()
+	gx := new(big.Int).SetBytes(testHybridDecrypt(t, key, onionSkin))
+	y, _ := rand.Int(rand.Reader, p)
+	keyData := KDFTOR(TAP_KEY_LEN, dhBytes(new(big.Int).Exp(gx, y, p)))
+	reply := append(dhBytes(new(big.Int).Exp(g, y, p)), keyData[0:20]...)
+
+	state := &CircuitHandshakeState{handshake: HANDSHAKE_TAP, secret: private}
+	keys, err := clientCompleteHandshake(state, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keys, keyData[20:]) {
+		t.Error("client and relay disagree on the TAP keys")
+	}
+
+	reply[DH_LEN] ^= 1
+	if _, err := TAPClientComplete(state, reply); err == nil {
+		t.Error("accepted a TAP reply with a bad KH")
+	}
+
+	badReply := make([]byte, DH_LEN+20)
+	badReply[DH_LEN-1] = 1
+	if _, err := TAPClientComplete(state, badReply); err == nil {
+		t.Error("accepted g^y = 1")
+	}
+}
+
+func TestFastClientHandshake(t *testing.T) {
+	x, err := FastClientPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same as handleCreateFast
+	y := make([]byte, 20)
+	CRandBytes(y)
+	keyData := KDFTOR(TAP_KEY_LEN, append(append([]byte{}, x...), y...))
+	reply := append(y, keyData[0:20]...)
+
+	state := &CircuitHandshakeState{handshake: HANDSHAKE_FAST, secret: x}
+	keys, err := clientCompleteHandshake(state, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keys, keyData[20:]) {
+		t.Error("client and relay disagree on the CREATE_FAST keys")
+	}
+
+	reply[39] ^= 1
+	if _, err := FastClientComplete(state, reply); err == nil {
+		t.Error("accepted a CREATED_FAST with a bad KH")
+	}
+}
+
+func TestTAPServerHandshake(t *testing.T) {
+	c := testOnionSkinConn(t)
+	c.parentOR.onionKey, _ = rsa.GenerateKey(rand.Reader, 1024)
+
+	onionSkin, private, err := TAPClientPayload(&c.parentOR.onionKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cell, keys, aerr := c.handleCreateTAP(5, onionSkin, false)
+	if aerr != nil {
+		t.Fatal(aerr)
+	}
+	if cell.Command() != CMD_CREATED {
+		t.Errorf("expected a CREATED cell, got command %d", cell.Command())
+	}
+
+	state := &CircuitHandshakeState{handshake: HANDSHAKE_TAP, secret: private}
+	clientKeys, err := TAPClientComplete(state, cell.Data()[0:DH_LEN+20])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keys, clientKeys) {
+		t.Error("client and relay disagree on the TAP keys")
+	}
+
+	badX := make([]byte, DH_LEN)
+	badX[DH_LEN-1] = 1
+	badSkin, err := HybridEncrypt(&c.parentOR.onionKey.PublicKey, badX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, aerr := c.handleCreateTAP(5, badSkin, false); aerr == nil {
+		t.Error("accepted g^x = 1")
+	}
+}
@@ -37,6 +37,7 @@ func (c *NeverForRelay) HandleRelay(*OnionConnection, *RelayCircuit) ActionableE
 func (c *OnionConnection) routeCellToFunction(cell Cell) ActionableError {
 	switch cell.Command() {
 	case CMD_CREATE_FAST:
+		c.padding.noteCircuit()
 		return c.handleCreateFast(cell)
 
 	case CMD_RELAY, CMD_RELAY_EARLY:
@@ -67,18 +68,26 @@ func (c *OnionConnection) routeCellToFunction(cell Cell) ActionableError {
 		Log(LOG_INFO, "Received a %s cell for an unknown circuit - dropping", cell.Command())
 
 	case CMD_CREATE, CMD_CREATE2:
+		c.padding.noteCircuit()
 		newHandshake := cell.Command() == CMD_CREATE2
 		return c.handleCreate(cell, newHandshake)
 
 	case CMD_DESTROY:
 		return c.handleDestroy(cell)
 
-	case CMD_CREATED, CMD_CREATED2:
+	case CMD_CREATED, CMD_CREATED2, CMD_CREATED_FAST:
 		return c.handleCreated(cell, cell.Command() == CMD_CREATED2)
 
 	case CMD_PADDING, CMD_VPADDING:
 		// Can be ignored
 
+	case CMD_PADDING_NEGOTIATE:
+		if !c.negotiatedVersion.SupportsPaddingNegotiate() {
+			Log(LOG_INFO, "Got a %s on a version %d link - dropping", cell.Command(), c.negotiatedVersion)
+			break
+		}
+		return c.handlePaddingNegotiate(cell)
+
 	case CMD_CERTS, CMD_NETINFO, CMD_AUTH_CHALLENGE, CMD_AUTHORIZE, CMD_AUTHENTICATE:
 		return CloseConnection(errors.New(fmt.Sprintf("Command %s not allowed at this point. Disconnecting", cell.Command())))
 
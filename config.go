@@ -13,6 +13,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
@@ -24,9 +25,43 @@ type Config struct {
 	// Descriptor related only
 	Contact, Nickname, Platform, Address            string
 	BandwidthAvg, BandwidthBurst, BandwidthObserved int
+	RelayBandwidthAvg, RelayBandwidthBurst          int // Only for relayed traffic, on top of the above
 	Family                                          []string
 
 	ExitPolicy ExitPolicy
+
+	// Pad client connections less, at the cost of some netflow resistance
+	ReducedConnectionPadding bool
+
+	// Which TLS library to use for links: "openssl" or "go". Defaults to openssl when built with cgo
+	TLSBackend string
+
+	// Connection housekeeping. Zero means the default
+	ConnectionIdleTimeout time.Duration // Connections without circuits get closed after this
+	KeepalivePeriod       time.Duration // Quiet connections get a PADDING cell this often
+	MaxORConnections      int           // Beyond this the least recently used connection goes away
+
+	// How long creating or extending a circuit may take. Zero means the default
+	CircuitBuildTimeout time.Duration
+
+	// Workers doing CREATE handshakes. Zero means one per CPU
+	NumCPUs int
+
+	// DoS mitigation for clients, see dos.go. Zero means the default
+	DoSCircuitCreationDisabled          bool
+	DoSCircuitCreationMinConnections    int // Clients with fewer connections open never get marked
+	DoSCircuitCreationRate              int // Circuits per second
+	DoSCircuitCreationBurst             int
+	DoSCircuitCreationDefenseTimePeriod time.Duration // How long a marked address gets its CREATEs refused
+	DoSConnectionDisabled               bool
+	DoSConnectionMaxConcurrentCount     int
+	DoSMaxStreamsPerCircuit             int
+
+	// Once the cells in our queues take more than this many bytes, the OOM handler starts killing circuits
+	MaxMemInQueues int64
+
+	// Where the exit resolver finds its DNS servers. Empty means /etc/resolv.conf
+	ServerDNSResolvConfFile string
 }
 
 func (c *Config) ReadFile(filename string) error {
@@ -39,6 +74,7 @@ func (c *Config) ReadFile(filename string) error {
 	policyRe := regexp.MustCompile(`^((?:accept|reject)(?:6?))\s+(\*|(?:[0-9]{1,3}\.){3}[0-9]{1,3}):(\*|[1-9][0-9]{0,4})$`)
 	familyRe := regexp.MustCompile(`^(?:(?:\$[a-fA-F0-9]{40})[ ,]?)+$`)
 	familySplit := regexp.MustCompile(`[, ]+`)
+	memoryRe := regexp.MustCompile(`^(?i)([0-9]+)\s*(bytes?|kb|kbytes?|mb|mbytes?|gb|gbytes?)$`)
 	bandwidthRe := regexp.MustCompile(`^(?i)([0-9]+)\s*(bytes?|kbytes?|mbytes?|gbytes?|kbits?|mbits?|gbits?)$`)
 
 	sc := bufio.NewScanner(file)
@@ -63,7 +99,7 @@ func (c *Config) ReadFile(filename string) error {
 			}
 			c.ORPort = uint16(port)
 
-		case "bandwidthrate", "bandwidthburst", "maxadvertisedbandwidth":
+		case "bandwidthrate", "bandwidthburst", "maxadvertisedbandwidth", "relaybandwidthrate", "relaybandwidthburst":
 			bw := bandwidthRe.FindStringSubmatch(matches[2])
 			if bw == nil {
 				return fmt.Errorf("Could not parse %s %q", matches[1], matches[2])
@@ -99,11 +135,18 @@ func (c *Config) ReadFile(filename string) error {
 				c.BandwidthBurst = val
 			} else if lower == "maxadvertisedbandwidth" {
 				c.BandwidthObserved = val
+			} else if lower == "relaybandwidthrate" {
+				c.RelayBandwidthAvg = val
+			} else if lower == "relaybandwidthburst" {
+				c.RelayBandwidthBurst = val
 			}
 
 		case "datadirectory":
 			c.DataDirectory = matches[2]
 
+		case "serverdnsresolvconffile":
+			c.ServerDNSResolvConfFile = matches[2]
+
 		case "nickname":
 			c.Nickname = matches[2]
 
@@ -146,6 +189,117 @@ func (c *Config) ReadFile(filename string) error {
 		case "address":
 			c.Address = matches[2]
 
+		case "connectionidletimeout", "keepaliveperiod":
+			seconds, err := strconv.ParseUint(matches[2], 0, 31)
+			if err != nil {
+				return fmt.Errorf("Could not parse %s %q", matches[1], matches[2])
+			}
+			if lower == "connectionidletimeout" {
+				c.ConnectionIdleTimeout = time.Duration(seconds) * time.Second
+			} else {
+				c.KeepalivePeriod = time.Duration(seconds) * time.Second
+			}
+
+		case "circuitbuildtimeout":
+			seconds, err := strconv.ParseUint(matches[2], 0, 31)
+			if err != nil {
+				return fmt.Errorf("Could not parse %s %q", matches[1], matches[2])
+			}
+			c.CircuitBuildTimeout = time.Duration(seconds) * time.Second
+
+		case "numcpus":
+			num, err := strconv.ParseUint(matches[2], 0, 31)
+			if err != nil {
+				return fmt.Errorf("Could not parse %s %q", matches[1], matches[2])
+			}
+			c.NumCPUs = int(num)
+
+		case "doscircuitcreationenabled", "dosconnectionenabled":
+			var disabled bool
+			switch matches[2] {
+			case "0":
+				disabled = true
+			case "1":
+				disabled = false
+			default:
+				return fmt.Errorf("Could not parse %s %q", matches[1], matches[2])
+			}
+
+			if lower == "doscircuitcreationenabled" {
+				c.DoSCircuitCreationDisabled = disabled
+			} else {
+				c.DoSConnectionDisabled = disabled
+			}
+
+		case "doscircuitcreationminconnections", "doscircuitcreationrate", "doscircuitcreationburst",
+			"doscircuitcreationdefensetimeperiod", "dosconnectionmaxconcurrentcount", "dosmaxstreamspercircuit":
+			val_, err := strconv.ParseUint(matches[2], 0, 31)
+			if err != nil {
+				return fmt.Errorf("Could not parse %s %q", matches[1], matches[2])
+			}
+
+			val := int(val_)
+
+			switch lower {
+			case "doscircuitcreationminconnections":
+				c.DoSCircuitCreationMinConnections = val
+			case "doscircuitcreationrate":
+				c.DoSCircuitCreationRate = val
+			case "doscircuitcreationburst":
+				c.DoSCircuitCreationBurst = val
+			case "doscircuitcreationdefensetimeperiod":
+				c.DoSCircuitCreationDefenseTimePeriod = time.Duration(val) * time.Second
+			case "dosconnectionmaxconcurrentcount":
+				c.DoSConnectionMaxConcurrentCount = val
+			case "dosmaxstreamspercircuit":
+				c.DoSMaxStreamsPerCircuit = val
+			}
+
+		case "maxmeminqueues":
+			mem := memoryRe.FindStringSubmatch(matches[2])
+			if mem == nil {
+				return fmt.Errorf("Could not parse %s %q", matches[1], matches[2])
+			}
+
+			val, err := strconv.ParseInt(mem[1], 0, 64)
+			if err != nil {
+				return fmt.Errorf("Could not parse %s %q", matches[1], matches[2])
+			}
+
+			switch strings.ToLower(mem[2]) {
+			case "kb", "kbyte", "kbytes":
+				val <<= 10
+			case "mb", "mbyte", "mbytes":
+				val <<= 20
+			case "gb", "gbyte", "gbytes":
+				val <<= 30
+			}
+			c.MaxMemInQueues = val
+
+		case "maxorconnections":
+			max, err := strconv.ParseUint(matches[2], 0, 31)
+			if err != nil {
+				return fmt.Errorf("Could not parse %s %q", matches[1], matches[2])
+			}
+			c.MaxORConnections = int(max)
+
+		case "tlsbackend":
+			backend := strings.ToLower(matches[2])
+			if backend != TLS_BACKEND_OPENSSL && backend != TLS_BACKEND_GO {
+				return fmt.Errorf("Unknown %s %q", matches[1], matches[2])
+			}
+			c.TLSBackend = backend
+
+		case "reducedconnectionpadding":
+			switch matches[2] {
+			case "0":
+				c.ReducedConnectionPadding = false
+			case "1":
+				c.ReducedConnectionPadding = true
+			default:
+				return fmt.Errorf("Could not parse %s %q", matches[1], matches[2])
+			}
+
 		default:
 			log.Printf("Configuration option %q not recognized. Ignoring its value\n", matches[1])
 		}
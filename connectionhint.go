@@ -7,6 +7,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net"
 )
 
 type ConnectionHint struct {
@@ -70,3 +71,14 @@ func (c *ConnectionHint) GetAddresses() []string {
 
 	return addrs
 }
+
+// The IP addresses from the hint, without the ports
+func (c *ConnectionHint) GetIPs() []net.IP {
+	ips := make([]net.IP, 0, len(c.address))
+	for _, addr := range c.address {
+		ip := make(net.IP, len(addr)-2)
+		copy(ip, addr[:len(addr)-2])
+		ips = append(ips, ip)
+	}
+	return ips
+}
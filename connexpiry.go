@@ -0,0 +1,112 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const CONN_IDLE_TIMEOUT_DEFAULT = 3 * time.Minute
+const KEEPALIVE_PERIOD_DEFAULT = 5 * time.Minute
+const MAX_OR_CONNECTIONS_DEFAULT = 4096
+
+// How often the runloop checks whether the connection is idle or needs a keepalive
+const CONN_HOUSEKEEPING_INTERVAL = 10 * time.Second
+
+func (c *Config) connIdleTimeout() time.Duration {
+	if c.ConnectionIdleTimeout == 0 {
+		return CONN_IDLE_TIMEOUT_DEFAULT
+	}
+	return c.ConnectionIdleTimeout
+}
+
+func (c *Config) keepalivePeriod() time.Duration {
+	if c.KeepalivePeriod == 0 {
+		return KEEPALIVE_PERIOD_DEFAULT
+	}
+	return c.KeepalivePeriod
+}
+
+func (c *Config) maxORConnections() int {
+	if c.MaxORConnections == 0 {
+		return MAX_OR_CONNECTIONS_DEFAULT
+	}
+	return c.MaxORConnections
+}
+
+// Something happened on the connection that wasn't padding
+func (c *OnionConnection) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+func (c *OnionConnection) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastActivity))
+}
+
+func (c *OnionConnection) noteWrite() {
+	atomic.StoreInt64(&c.lastWrite, time.Now().UnixNano())
+}
+
+func (c *OnionConnection) lastWritten() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastWrite))
+}
+
+// Closes the underlying connection, which makes the reader stop and the runloop exit
+func (c *OnionConnection) close() {
+	c.markClosing()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// Called from the runloop. Returns true if the connection has been idle for too long and should go away
+func (c *OnionConnection) housekeeping(now time.Time) bool {
+	config := c.parentOR.config
+
+	circuits := len(c.circuits) + len(c.relayCircuits) + len(c.proxyCircuits)
+	if circuits == 0 && now.Sub(c.lastActive()) > config.connIdleTimeout() {
+		return true
+	}
+
+	if now.Sub(c.lastWritten()) > config.keepalivePeriod() {
+		c.writeQueue <- NewCell(c.negotiatedVersion, 0, CMD_PADDING, nil).Bytes()
+	}
+
+	return false
+}
+
+func (or *ORCtx) trackConnection(conn *OnionConnection) {
+	or.openConnLock.Lock()
+	defer or.openConnLock.Unlock()
+
+	or.openConnections[conn] = struct{}{}
+
+	if len(or.openConnections) <= or.config.maxORConnections() {
+		return
+	}
+
+	// Too many: get rid of whatever was least recently used
+	var victim *OnionConnection
+	for candidate := range or.openConnections {
+		if candidate == conn || candidate.isClosing() {
+			continue
+		}
+		if victim == nil || candidate.lastActive().Before(victim.lastActive()) {
+			victim = candidate
+		}
+	}
+	if victim != nil {
+		Log(LOG_NOTICE, "Too many OR connections, closing the least recently used one")
+		victim.close()
+	}
+}
+
+func (or *ORCtx) untrackConnection(conn *OnionConnection) {
+	or.openConnLock.Lock()
+	defer or.openConnLock.Unlock()
+
+	delete(or.openConnections, conn)
+}
@@ -0,0 +1,71 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnectionLimit(t *testing.T) {
+	or := &ORCtx{
+		config:          &Config{MaxORConnections: 2},
+		openConnections: make(map[*OnionConnection]struct{}),
+	}
+
+	var conns []*OnionConnection
+	for i := 0; i < 2; i++ {
+		ours, _ := net.Pipe()
+		conns = append(conns, newOnionConnection(ours, nil, or))
+	}
+	conns[0].touch() // conns[1] is now the least recently used
+
+	ours, _ := net.Pipe()
+	newest := newOnionConnection(ours, nil, or)
+
+	if conns[0].isClosing() || newest.isClosing() {
+		t.Error("closed the wrong connection")
+	}
+	if !conns[1].isClosing() {
+		t.Error("expected the least recently used connection to be closed")
+	}
+	if _, err := conns[1].conn.Write([]byte{0}); err == nil {
+		t.Error("the evicted connection is still open")
+	}
+
+	conns[1].cleanup()
+	if len(or.openConnections) != 2 {
+		t.Errorf("expected 2 open connections, have %d", len(or.openConnections))
+	}
+}
+
+func TestHousekeeping(t *testing.T) {
+	or := &ORCtx{
+		config:          &Config{ConnectionIdleTimeout: time.Minute, KeepalivePeriod: 30 * time.Second},
+		openConnections: make(map[*OnionConnection]struct{}),
+	}
+	ours, _ := net.Pipe()
+	conn := newOnionConnection(ours, nil, or)
+	conn.negotiatedVersion = 4
+
+	now := time.Now()
+	if conn.housekeeping(now) || len(conn.writeQueue) != 0 {
+		t.Error("a fresh connection needs nothing")
+	}
+
+	if conn.housekeeping(now.Add(45*time.Second)) || len(conn.writeQueue) != 1 {
+		t.Error("expected a keepalive")
+	}
+
+	conn.circuits[1] = &Circuit{}
+	if conn.housekeeping(now.Add(2 * time.Minute)) {
+		t.Error("closed a connection with circuits")
+	}
+	delete(conn.circuits, 1)
+	if !conn.housekeeping(now.Add(2 * time.Minute)) {
+		t.Error("expected an idle connection to be closed")
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// Connections this old only get new circuits if there's nothing better, same as C tor
+const CONN_TOO_OLD_FOR_NEW_CIRCUITS = 7 * 24 * time.Hour
+
+// A connection is canonical if it goes to (or comes from) an address the relay is known by: either one of the
+// addresses we were asked to extend to, or when we have none, one the relay claimed in its NETINFO.
+func (c *OnionConnection) isCanonicalFor(addresses []net.IP) bool {
+	if c.theirAddress == nil {
+		return false
+	}
+	if len(addresses) == 0 {
+		addresses = c.theirAddresses
+	}
+	for _, addr := range addresses {
+		if addr.Equal(c.theirAddress) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a is a better pick for a new circuit than b
+func connectionIsBetter(a, b *OnionConnection, now time.Time) bool {
+	aOld := now.Sub(a.established) > CONN_TOO_OLD_FOR_NEW_CIRCUITS
+	bOld := now.Sub(b.established) > CONN_TOO_OLD_FOR_NEW_CIRCUITS
+	if aOld != bOld {
+		return !aOld
+	}
+
+	aLoad, bLoad := a.circuitLoad(), b.circuitLoad()
+	if aLoad != bLoad {
+		return aLoad < bLoad
+	}
+
+	return a.established.After(b.established)
+}
+
+// Picks the connection a circuit should be extended over, or nil if we should open a new one
+func selectConnectionForExtend(conns []*OnionConnection, addresses []net.IP, now time.Time) *OnionConnection {
+	var best *OnionConnection
+	for _, conn := range conns {
+		if !conn.usableForNewCircuits() || !conn.isCanonicalFor(addresses) {
+			continue
+		}
+		if best == nil || connectionIsBetter(conn, best, now) {
+			best = conn
+		}
+	}
+	return best
+}
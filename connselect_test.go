@@ -0,0 +1,110 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSelectConnectionForExtend(t *testing.T) {
+	now := time.Now()
+	addr := net.ParseIP("192.0.2.1")
+	otherAddr := net.ParseIP("192.0.2.2")
+	addresses := []net.IP{addr}
+
+	older := &OnionConnection{theirAddress: addr, established: now.Add(-time.Hour)}
+	newer := &OnionConnection{theirAddress: addr, established: now.Add(-time.Minute)}
+	elsewhere := &OnionConnection{theirAddress: otherAddr, established: now}
+
+	if selectConnectionForExtend(nil, addresses, now) != nil {
+		t.Error("picked a connection out of nothing")
+	}
+	if selectConnectionForExtend([]*OnionConnection{elsewhere}, addresses, now) != nil {
+		t.Error("picked a non-canonical connection")
+	}
+	if selectConnectionForExtend([]*OnionConnection{older, newer, elsewhere}, addresses, now) != newer {
+		t.Error("expected the newer connection")
+	}
+
+	newer.load = 10
+	older.load = 2
+	if selectConnectionForExtend([]*OnionConnection{older, newer}, addresses, now) != older {
+		t.Error("expected the less loaded connection")
+	}
+
+	older.established = now.Add(-2 * CONN_TOO_OLD_FOR_NEW_CIRCUITS)
+	if selectConnectionForExtend([]*OnionConnection{older, newer}, addresses, now) != newer {
+		t.Error("expected the connection that isn't too old")
+	}
+
+	newer.markClosing()
+	if selectConnectionForExtend([]*OnionConnection{older, newer}, addresses, now) != older {
+		t.Error("picked a closing connection")
+	}
+
+	// Without addresses to go by, what they told us in NETINFO decides
+	elsewhere.theirAddresses = []net.IP{otherAddr}
+	if selectConnectionForExtend([]*OnionConnection{elsewhere}, nil, now) != elsewhere {
+		t.Error("expected the connection matching NETINFO")
+	}
+}
+
+func TestConnectionHintIPs(t *testing.T) {
+	var hint ConnectionHint
+	hint.AddAddress([]byte{192, 0, 2, 1, 0, 80})
+	v6 := net.ParseIP("2001:db8::1")
+	hint.AddAddress(append(append([]byte{}, v6...), 1, 187))
+
+	ips := hint.GetIPs()
+	if len(ips) != 2 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) || !ips[1].Equal(v6) {
+		t.Errorf("unexpected %v", ips)
+	}
+}
+
+func TestRequestCircuitJoinsPendingDial(t *testing.T) {
+	or := &ORCtx{
+		authenticatedConnections: make(map[Fingerprint][]*OnionConnection),
+		pendingDials:             make(map[Fingerprint][]*CircuitRequest),
+	}
+	fp := Fingerprint{1, 2, 3}
+	newRequest := func() *CircuitRequest {
+		req := &CircuitRequest{successQueue: make(CircReadQueue, 1), handshakeState: &CircuitHandshakeState{}}
+		req.connHint.AddFingerprint(fp[:])
+		return req
+	}
+
+	// A connection to the relay is on its way, so nobody opens another one
+	or.pendingDials[fp] = nil
+	for i := 0; i < 2; i++ {
+		if err := or.RequestCircuit(newRequest()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(or.pendingDials[fp]) != 2 {
+		t.Fatalf("expected 2 requests waiting for the connection, got %d", len(or.pendingDials[fp]))
+	}
+
+	conn := &OnionConnection{circuitReadQueue: make(CircReadQueue, 2)}
+	or.finishDial(fp, conn)
+	if len(conn.circuitReadQueue) != 2 {
+		t.Errorf("expected both requests on the new connection, got %d", len(conn.circuitReadQueue))
+	}
+	if _, dialing := or.pendingDials[fp]; dialing {
+		t.Error("dial still pending after it finished")
+	}
+
+	// If the connection never comes, neither do the circuits
+	or.pendingDials[fp] = nil
+	req := newRequest()
+	if err := or.RequestCircuit(req); err != nil {
+		t.Fatal(err)
+	}
+	or.finishDial(fp, nil)
+	if destroyed, ok := (<-req.successQueue).(*CircuitDestroyed); !ok || destroyed.reason != DESTROY_REASON_CONNECTFAILED {
+		t.Error("expected the waiting request to fail with DESTROY_REASON_CONNECTFAILED")
+	}
+}
@@ -141,17 +141,20 @@ func reqAStream(or *ORCtx, addrPort string) (*ProxyCircuit, StreamID, error) {
 }
 
 func handleBegin(or *ORCtx, cmd *beginCmd) error {
-	conn, ok := or.authenticatedConnections[cmd.fp]
+	conns, ok := or.authenticatedConnections[cmd.fp]
 	if !ok {
 		return errors.New("couldn't find that connection")
 	}
-	pc, ok := conn.proxyCircuits[cmd.circId]
-	if !ok {
-		return errors.New("couldn't find that proxy circuit")
+	for _, conn := range conns {
+		pc, ok := conn.proxyCircuits[cmd.circId]
+		if !ok {
+			continue
+		}
+		data := []byte("joelanders.net:80")
+		data = append(data, []byte{1, 0, 0, 0}...)
+		return conn.sendProxyCell(pc, cmd.strId, RELAY_BEGIN, data)
 	}
-	data := []byte("joelanders.net:80")
-	data = append(data, []byte{1, 0, 0, 0}...)
-	return conn.sendProxyCell(pc, cmd.strId, RELAY_BEGIN, data)
+	return errors.New("couldn't find that proxy circuit")
 }
 
 func handleKill(or *ORCtx) error {
@@ -161,9 +164,11 @@ func handleKill(or *ORCtx) error {
 }
 
 func handleListCons(or *ORCtx) error {
-	for fp, conn := range or.authenticatedConnections {
-		for pc, _ := range conn.proxyCircuits {
-			fmt.Printf("conn %s has pc %d\n", fp.String(), pc)
+	for fp, conns := range or.authenticatedConnections {
+		for _, conn := range conns {
+			for pc, _ := range conn.proxyCircuits {
+				fmt.Printf("conn %s has pc %d\n", fp.String(), pc)
+			}
 		}
 	}
 	return nil
@@ -217,7 +222,11 @@ func handleExtend(or *ORCtx, cmd *extCmd, consensus *zoossh.Consensus) error {
 			return errors.New("reqproxycirc failed")
 		}
 		fmt.Println("sending...")
-		newCircId := <-doneChan
+		result := <-doneChan
+		if result.Err != nil {
+			return result.Err
+		}
+		newCircId := result.ID
 		if newCircId != circId {
 			fmt.Println("...created circuit id", newCircId)
 		} else {
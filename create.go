@@ -6,26 +6,74 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"github.com/tvdw/openssl"
 	"golang.org/x/crypto/curve25519"
+	"math/big"
+	"sync"
+	"time"
 )
 
 type HandshakeType uint16
 
 const (
-	HANDSHAKE_TAP  HandshakeType = 0x00
-	HANDSHAKE_NTOR HandshakeType = 0x02
+	HANDSHAKE_TAP     HandshakeType = 0x00
+	HANDSHAKE_FAST    HandshakeType = 0x01 // Never inside a CREATE2, only sent as CREATE_FAST
+	HANDSHAKE_NTOR    HandshakeType = 0x02
+	HANDSHAKE_NTOR_V3 HandshakeType = 0x03
 )
 
+func (h HandshakeType) String() string {
+	switch h {
+	case HANDSHAKE_TAP:
+		return "HANDSHAKE_TAP"
+	case HANDSHAKE_FAST:
+		return "HANDSHAKE_FAST"
+	case HANDSHAKE_NTOR:
+		return "HANDSHAKE_NTOR"
+	case HANDSHAKE_NTOR_V3:
+		return "HANDSHAKE_NTOR_V3"
+	default:
+		return fmt.Sprintf("HANDSHAKE_%d", uint16(h))
+	}
+}
+
+// The TAP handshake uses the 1024-bit MODP group from RFC 2409 with generator 2
+const DH_LEN = 128
+const DH_PRIVATE_KEY_BITS = 320
+
 var dhKeyStr = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381FFFFFFFFFFFFFFFF"
 var dhKey []byte
+var dhKeyOnce sync.Once
 var funnyNtorHandshake = []byte("ntorNTORntorNTOR")
 
+func loadDHKey() []byte {
+	dhKeyOnce.Do(func() {
+		key, err := hex.DecodeString(dhKeyStr)
+		if err != nil || key[0] != 255 || key[8] != 0xc9 {
+			panic(err)
+		}
+		dhKey = key
+	})
+	return dhKey
+}
+
+func tapDHGroup() (p, g *big.Int) {
+	return new(big.Int).SetBytes(loadDHKey()), big.NewInt(2)
+}
+
+// Left-pads a DH value to the length of the modulus, like tor does
+func dhBytes(v *big.Int) []byte {
+	out := make([]byte, DH_LEN)
+	b := v.Bytes()
+	copy(out[DH_LEN-len(b):], b)
+	return out
+}
+
 func (c *OnionConnection) handleCreateFast(cell Cell) ActionableError {
 	// XXX check for weAuthenticated (why?)
 
@@ -36,15 +84,20 @@ func (c *OnionConnection) handleCreateFast(cell Cell) ActionableError {
 		return CloseConnection(errors.New("refusing to create CircID=0"))
 	}
 
-	if circID.MSB(c.negotiatedVersion) == c.isOutbound {
+	if !c.isTheirCircID(circID) {
 		return CloseConnection(fmt.Errorf("refusing an invalid CircID %d %t", circID, c.isOutbound))
 	}
 
-	_, alreadyExists := c.circuits[cell.CircID()]
-	if alreadyExists {
+	_, alreadyExists := c.circuits[circID]
+	_, pending := c.pendingCreates[circID]
+	if alreadyExists || pending {
 		return CloseConnection(errors.New("Circuit already exists"))
 	}
 
+	if !c.circuitCreationAllowed() {
+		return RefuseCircuit(errors.New("client is creating too many circuits"), DESTROY_REASON_RESOURCELIMIT)
+	}
+
 	writeCell := NewCell(c.negotiatedVersion, circID, CMD_CREATED_FAST, nil)
 	writeCellData := writeCell.Data()
 
@@ -73,7 +126,7 @@ func (c *OnionConnection) handleCreate(cell Cell, newHandshake bool) ActionableE
 	Log(LOG_CIRC, "Got a CREATE")
 
 	circID := cell.CircID()
-	if circID.MSB(c.negotiatedVersion) == c.isOutbound {
+	if !c.isTheirCircID(circID) {
 		return CloseConnection(fmt.Errorf("refusing an invalid CircID %d %t", circID, c.isOutbound))
 	}
 
@@ -107,48 +160,67 @@ func (c *OnionConnection) handleCreate(cell Cell, newHandshake bool) ActionableE
 		}
 	}
 
-	if handshake == HANDSHAKE_TAP {
-		return c.handleCreateTAP(cell.CircID(), handshakeData, newHandshake)
-	} else if handshake == HANDSHAKE_NTOR {
-		return c.handleCreateNTOR(cell.CircID(), handshakeData, newHandshake)
+	if handshake != HANDSHAKE_TAP && handshake != HANDSHAKE_NTOR && !(handshake == HANDSHAKE_NTOR_V3 && newHandshake) {
+		return RefuseCircuit(errors.New("unknown handshake"), DESTROY_REASON_PROTOCOL)
 	}
 
-	return RefuseCircuit(errors.New("unknown handshake"), DESTROY_REASON_PROTOCOL)
-}
+	_, alreadyThere := c.circuits[circID]
+	_, pending := c.pendingCreates[circID]
+	if alreadyThere || pending {
+		return CloseConnection(errors.New("Circuit already exists"))
+	}
 
-func (c *OnionConnection) handleCreateTAP(id CircuitID, data []byte, newHandshake bool) ActionableError {
-	theirData, err := HybridDecrypt(c.parentOR.onionKey, data[0:186])
-	if err != nil {
-		return RefuseCircuit(err, DESTROY_REASON_INTERNAL)
+	if !c.circuitCreationAllowed() {
+		return RefuseCircuit(errors.New("client is creating too many circuits"), DESTROY_REASON_RESOURCELIMIT)
 	}
 
-	if len(theirData) != 128 {
-		return RefuseCircuit(errors.New("invalid TAP handshake found"), DESTROY_REASON_INTERNAL)
+	// The actual handshake happens on one of the onion-skin workers, which hands us a CreateAnswered
+	job := &onionSkinJob{
+		conn:         c,
+		id:           circID,
+		handshake:    handshake,
+		data:         append([]byte(nil), handshakeData...),
+		newHandshake: newHandshake,
+		queued:       time.Now(),
 	}
+	if !c.parentOR.onionSkins.submit(job) {
+		return RefuseCircuit(fmt.Errorf("too many %s onion skins queued", handshake), DESTROY_REASON_RESOURCELIMIT)
+	}
+	c.pendingCreates[circID] = struct{}{}
 
-	if dhKey == nil {
-		key, err := hex.DecodeString(dhKeyStr)
-		if err != nil || key[0] != 255 || key[8] != 0xc9 {
-			panic(err)
-		}
-		dhKey = key
+	return nil
+}
+
+// Runs on an onion-skin worker. Returns the CREATED cell and the key material for the circuit
+func (c *OnionConnection) handleCreateTAP(id CircuitID, data []byte, newHandshake bool) (Cell, []byte, ActionableError) {
+	if len(data) < 186 {
+		return nil, nil, RefuseCircuit(errors.New("TAP handshake too short"), DESTROY_REASON_PROTOCOL)
 	}
 
-	dh, err := openssl.LoadDHFromBignumWithGenerator(dhKey, 2)
+	theirData, err := HybridDecrypt(c.parentOR.onionKey, data[0:186])
 	if err != nil {
-		return RefuseCircuit(err, DESTROY_REASON_INTERNAL)
+		return nil, nil, RefuseCircuit(err, DESTROY_REASON_INTERNAL)
 	}
 
-	pub, err := dh.GetPublicKey()
-	if err != nil {
-		return RefuseCircuit(err, DESTROY_REASON_INTERNAL)
+	if len(theirData) != 128 {
+		return nil, nil, RefuseCircuit(errors.New("invalid TAP handshake found"), DESTROY_REASON_INTERNAL)
 	}
 
-	secr, err := dh.GetSharedKey(theirData)
-	if err != nil {
-		return RefuseCircuit(err, DESTROY_REASON_INTERNAL)
+	p, g := tapDHGroup()
+	gx := new(big.Int).SetBytes(theirData)
+	pMinusOne := new(big.Int).Sub(p, big.NewInt(1))
+	if gx.Cmp(big.NewInt(1)) <= 0 || gx.Cmp(pMinusOne) >= 0 {
+		return nil, nil, RefuseCircuit(errors.New("client sent a bad DH public value"), DESTROY_REASON_PROTOCOL)
 	}
 
+	private := make([]byte, DH_PRIVATE_KEY_BITS/8)
+	if err := CRandBytes(private); err != nil {
+		return nil, nil, RefuseCircuit(err, DESTROY_REASON_INTERNAL)
+	}
+	y := new(big.Int).SetBytes(private)
+	pub := dhBytes(new(big.Int).Exp(g, y, p))
+	secr := dhBytes(new(big.Int).Exp(gx, y, p))
+
 	keyData := KDFTOR(92, secr)
 
 	cmd := CMD_CREATED2
@@ -168,21 +240,13 @@ func (c *OnionConnection) handleCreateTAP(id CircuitID, data []byte, newHandshak
 		copy(buf[130:150], keyData[0:20])
 	}
 
-	circ := NewCircuit(id, keyData[20:40], keyData[40:60], keyData[60:76], keyData[76:92])
-	c.circuits[id] = circ
-
-	c.writeQueue <- writeCell.Bytes()
-	return nil
+	return writeCell, keyData[20:92], nil
 }
 
-func (c *OnionConnection) handleCreateNTOR(circID CircuitID, data []byte, newHandshake bool) ActionableError {
+// Runs on an onion-skin worker, like handleCreateTAP
+func (c *OnionConnection) handleCreateNTOR(circID CircuitID, data []byte, newHandshake bool) (Cell, []byte, ActionableError) {
 	if len(data) < 84 {
-		return RefuseCircuit(errors.New("didn't get enough data"), DESTROY_REASON_PROTOCOL)
-	}
-
-	_, alreadyThere := c.circuits[circID]
-	if alreadyThere {
-		return CloseConnection(errors.New("nope"))
+		return nil, nil, RefuseCircuit(errors.New("didn't get enough data"), DESTROY_REASON_PROTOCOL)
 	}
 
 	var fingerprint [20]byte
@@ -191,7 +255,7 @@ func (c *OnionConnection) handleCreateNTOR(circID CircuitID, data []byte, newHan
 	for i, v := range fingerprint {
 		if v != myFingerprint[i] {
 			Log(LOG_INFO, "FP mismatch %s != %s", myFingerprint, Fingerprint(fingerprint))
-			return RefuseCircuit(errors.New("that's not me"), DESTROY_REASON_PROTOCOL)
+			return nil, nil, RefuseCircuit(errors.New("that's not me"), DESTROY_REASON_PROTOCOL)
 		}
 	}
 
@@ -264,10 +328,25 @@ func (c *OnionConnection) handleCreateNTOR(circID CircuitID, data []byte, newHan
 		copy(writeCellBuf[32:], auth)
 	}
 
-	circ := NewCircuit(circID, kdf[0:20], kdf[20:40], kdf[40:56], kdf[56:72])
-	c.circuits[circID] = circ
+	return writeCell, kdf, nil
+}
 
-	c.writeQueue <- writeCell.Bytes()
+// Runs on an onion-skin worker, like handleCreateTAP
+func (c *OnionConnection) handleCreateNTORv3(circID CircuitID, data []byte) (Cell, []byte, ActionableError) {
+	or := c.parentOR
+	reply, keys, err := NtorV3ServerHandshake(or.edIdentityKey.Public().(ed25519.PublicKey), or.ntorPrivate, or.ntorPublic, data, ntorV3ServerExtensions)
+	if err != nil {
+		Log(LOG_INFO, "Refusing an ntor v3 CREATE2: %s", err)
+		return nil, nil, RefuseCircuit(err, DESTROY_REASON_PROTOCOL)
+	}
+	if len(reply)+2 > MAX_CELL_SIZE-5 {
+		return nil, nil, RefuseCircuit(errors.New("ntor v3 reply does not fit in a cell"), DESTROY_REASON_INTERNAL)
+	}
 
-	return nil
+	writeCell := NewCell(c.negotiatedVersion, circID, CMD_CREATED2, nil)
+	writeCellBuf := writeCell.Data()
+	BigEndian.PutUint16(writeCellBuf[0:2], uint16(len(reply)))
+	copy(writeCellBuf[2:], reply)
+
+	return writeCell, keys, nil
 }
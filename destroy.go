@@ -10,6 +10,7 @@ type CircuitDestroyed struct {
 	reason   DestroyReason
 	forRelay bool
 	truncate bool
+	hopID    CircuitID // With truncate: the circuit ID the next hop used, 0 if it never got one
 }
 
 func (c *CircuitDestroyed) CircID() CircuitID {
@@ -23,8 +24,18 @@ func (data *CircuitDestroyed) ForRelay() bool {
 func (data *CircuitDestroyed) Handle(c *OnionConnection, circ *Circuit) ActionableError {
 	Log(LOG_CIRC, "CircuitDestroy (front)")
 
+	if pc := c.proxyCircuitFor(circ); pc != nil {
+		if !data.truncate {
+			c.destroyProxyCircuit(pc, true, true, data.reason)
+		}
+		return nil
+	}
+
 	if data.truncate {
-		panic("not implemented properly") // XXX needs cleanup of fields like nextHop/nextHopID
+		if !circ.dropNextHop(data.hopID, data.reason) {
+			Log(LOG_CIRC, "Ignoring a truncate for a hop we no longer use")
+			return nil
+		}
 		return c.sendRelayCell(circ, 0, BackwardDirection, RELAY_TRUNCATED, []byte{byte(data.reason)})
 	} else {
 		c.destroyCircuit(circ, false, true, data.reason)
@@ -41,11 +52,60 @@ func (data *CircuitDestroyed) HandleRelay(c *OnionConnection, circ *RelayCircuit
 	return nil
 }
 
+func (c *OnionConnection) handleRelayTruncate(circ *Circuit, cell *RelayCell) ActionableError {
+	Log(LOG_CIRC, "Truncating circuit %d", circ.id)
+	return c.truncateCircuit(circ, DESTROY_REASON_REQUESTED)
+}
+
+// Tears down everything past us on the circuit and tells the client, who can then extend it again
+func (c *OnionConnection) truncateCircuit(circ *Circuit, reason DestroyReason) ActionableError {
+	circ.abortExtend(reason)
+	if circ.nextHop != nil {
+		circ.nextHop <- &CircuitDestroyed{
+			id:       circ.nextHopID,
+			reason:   reason,
+			forRelay: true,
+		}
+		circ.nextHop = nil
+		circ.nextHopID = 0
+	}
+
+	return c.sendRelayCell(circ, 0, BackwardDirection, RELAY_TRUNCATED, []byte{byte(reason)})
+}
+
+// The client side of a truncate: everything past the hop that sent the TRUNCATED is gone
+func (c *OnionConnection) handleRelayTruncatedProxy(pc *ProxyCircuit, hop int, cell *RelayCell) ActionableError {
+	reason := DESTROY_REASON_NONE
+	if cell.Length() > 0 {
+		reason = DestroyReason(cell.Data()[0])
+	}
+	Log(LOG_CIRC, "Proxy circuit %d was truncated after hop %d: %s", pc.id, hop, reason)
+
+	pc.forwardChain = pc.forwardChain[:hop+1]
+	pc.backwardChain = pc.backwardChain[:hop+1]
+
+	if pc.extendState != nil {
+		pc.extendState.lock.Lock()
+		pc.extendState.aborted = true
+		pc.extendState.lock.Unlock()
+		pc.extendState.finish(buildFailed(reason, "circuit was truncated"))
+		pc.extendState = nil
+	}
+
+	return nil
+}
+
 func (c *OnionConnection) handleDestroy(cell Cell) ActionableError {
 	Log(LOG_CIRC, "Got a destroy for circ %d with reason %s", cell.CircID(), DestroyReason(cell.Data()[0]))
 
 	circID := cell.CircID()
-	if circID.MSB(c.negotiatedVersion) != c.isOutbound {
+	if c.isTheirCircID(circID) {
+		if _, pending := c.pendingCreates[circID]; pending {
+			// Whatever the onion-skin worker comes up with gets ignored
+			delete(c.pendingCreates, circID)
+			return nil
+		}
+
 		circ, ok := c.circuits[circID]
 		if !ok {
 			Log(LOG_INFO, "Got a DESTROY but we don't know the circuit they're talking about. Ignoring")
@@ -61,12 +121,30 @@ func (c *OnionConnection) handleDestroy(cell Cell) ActionableError {
 		return nil
 	}
 
-	_, ok = c.proxyCircuits[circID]
+	pc, ok := c.proxyCircuits[circID]
 	if ok {
-		Log(LOG_INFO, "figure out how to destroy a proxy circuit sometime")
+		c.destroyProxyCircuit(pc, false, true, DestroyReason(cell.Data()[0]))
 		return nil
 	}
 
 	Log(LOG_INFO, "Got a DESTROY but we don't know the circuit they're talking about. Ignoring")
 	return nil
 }
+
+// Control command that tears down all our own circuits on a connection
+type DestroyProxyCircuits struct {
+	NoBuffers
+	NeverForRelay
+	reason DestroyReason
+}
+
+func (data *DestroyProxyCircuits) CircID() CircuitID {
+	return 0
+}
+
+func (data *DestroyProxyCircuits) Handle(c *OnionConnection, circ *Circuit) ActionableError {
+	for _, pc := range c.proxyCircuits {
+		c.destroyProxyCircuit(pc, true, true, data.reason)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDropNextHop(t *testing.T) {
+	circ := &Circuit{
+		nextHop:   make(CircReadQueue, 1),
+		nextHopID: 5,
+	}
+	if circ.dropNextHop(4, DESTROY_REASON_CONNECTFAILED) {
+		t.Error("dropped the next hop for a stale circuit ID")
+	}
+	if !circ.dropNextHop(5, DESTROY_REASON_CONNECTFAILED) {
+		t.Error("did not drop the next hop")
+	}
+	if circ.nextHop != nil || circ.nextHopID != 0 {
+		t.Error("next hop still set after dropping it")
+	}
+	if circ.dropNextHop(5, DESTROY_REASON_CONNECTFAILED) {
+		t.Error("dropped a next hop twice")
+	}
+
+	state := &CircuitHandshakeState{}
+	circ.extendState = state
+	if !circ.dropNextHop(0, DESTROY_REASON_CONNECTFAILED) {
+		t.Error("did not drop a pending extend that never connected")
+	}
+	if !state.aborted || circ.extendState != nil {
+		t.Error("pending extend not aborted")
+	}
+}
+
+func testHopCircuit(seed byte) *Circuit {
+	var fSeed, bSeed [20]byte
+	var fKey, bKey [16]byte
+	for i := range fSeed {
+		fSeed[i], bSeed[i] = seed, seed+1
+	}
+	for i := range fKey {
+		fKey[i], bKey[i] = seed+2, seed+3
+	}
+	return NewCircuit(CircuitID(seed), fSeed[:], bSeed[:], fKey[:], bKey[:])
+}
+
+// Builds a relay cell like sendRelayCell does, coming back from the given hop
+func testBackwardCell(hops []*Circuit, from int, command RelayCommand, data []byte) []byte {
+	buf := make([]byte, 509)
+	buf[0] = byte(command)
+	BigEndian.PutUint16(buf[9:11], uint16(len(data)))
+	copy(buf[11:], data)
+
+	hops[from].backward.digest.Write(buf)
+	copy(buf[5:9], hops[from].backward.digest.Sum(nil))
+	for i := from; i >= 0; i-- {
+		hops[i].backward.cipher.Crypt(buf, buf)
+	}
+	return buf
+}
+
+func TestProxyCircuitTruncated(t *testing.T) {
+	relays := []*Circuit{testHopCircuit(10), testHopCircuit(20), testHopCircuit(30)}
+	pc := &ProxyCircuit{}
+	for i := range relays {
+		ours := testHopCircuit(byte(10 * (i + 1)))
+		pc.forwardChain = append(pc.forwardChain, ours.forward)
+		pc.backwardChain = append(pc.backwardChain, ours.backward)
+	}
+
+	cell := testBackwardCell(relays, 2, RELAY_DATA, []byte("hello"))
+	if hop := pc.decryptBackward(cell); hop != 2 {
+		t.Errorf("cell from the last hop recognized as coming from hop %d", hop)
+	}
+
+	cell = testBackwardCell(relays, 1, RELAY_TRUNCATED, []byte{byte(DESTROY_REASON_CONNECTFAILED)})
+	hop := pc.decryptBackward(cell)
+	if hop != 1 {
+		t.Fatalf("TRUNCATED from the middle hop recognized as coming from hop %d", hop)
+	}
+
+	whenDone := make(chan CircuitBuildResult, 1)
+	pc.extendState = &CircuitHandshakeState{whenDone: whenDone}
+	c := &OnionConnection{}
+	c.handleRelayTruncatedProxy(pc, hop, &RelayCell{cell})
+	if len(pc.forwardChain) != 2 || len(pc.backwardChain) != 2 {
+		t.Errorf("expected 2 hops left, got %d and %d", len(pc.forwardChain), len(pc.backwardChain))
+	}
+	if pc.extendState != nil {
+		t.Error("pending extend survived the truncate")
+	}
+	if result := <-whenDone; result.Err == nil || result.Err.Reason != DESTROY_REASON_CONNECTFAILED {
+		t.Errorf("waiter for the pending extend got %v", result)
+	}
+
+	cell = testBackwardCell(relays, 0, RELAY_DATA, nil)
+	if hop := pc.decryptBackward(cell); hop != 0 {
+		t.Errorf("cell from the first hop recognized as coming from hop %d", hop)
+	}
+}
+
+type testSocksConn struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *testSocksConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestProxyCircuitDestroyed(t *testing.T) {
+	c := &OnionConnection{
+		negotiatedVersion: 4,
+		isOutbound:        true,
+		writeQueue:        make(chan []byte, 2),
+		circQueues:        newCircuitScheduler(nil),
+		proxyCircuits:     make(map[CircuitID]*ProxyCircuit),
+	}
+
+	stream, _ := NewStream(1)
+	socks := &testSocksConn{}
+	whenDone := make(chan CircuitBuildResult, 1)
+	pc := &ProxyCircuit{
+		Circuit: Circuit{
+			id:             0x80000003,
+			backwardWindow: NewWindow(1000),
+			streams:        map[StreamID]*Stream{1: stream},
+			extendState:    &CircuitHandshakeState{whenDone: whenDone},
+		},
+		pendingStreams: map[StreamID]*PendingStream{2: {2, socks}},
+	}
+	c.proxyCircuits[pc.id] = pc
+
+	if err := c.handleDestroy(NewCell(4, pc.id, CMD_DESTROY, []byte{byte(DESTROY_REASON_FINISHED)})); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := c.proxyCircuits[pc.id]; ok {
+		t.Error("proxy circuit still registered")
+	}
+	if _, ok := <-stream.writeChan; ok {
+		t.Error("stream not closed")
+	}
+	if !socks.closed || !bytes.Equal(socks.Bytes(), []byte{0, 0x5b, 0, 0, 0, 0, 0, 0}) {
+		t.Error("pending SOCKS client did not get a failure reply")
+	}
+	if result := <-whenDone; result.Err == nil || result.Err.Reason != DESTROY_REASON_FINISHED {
+		t.Errorf("waiter got %v", result)
+	}
+	if len(c.writeQueue) != 0 {
+		t.Error("answered a DESTROY with a DESTROY")
+	}
+
+	// DestroyAllProxyCircuits goes through the same path, but does tell the other side
+	c.proxyCircuits[5] = &ProxyCircuit{Circuit: Circuit{id: 5}}
+	(&DestroyProxyCircuits{reason: DESTROY_REASON_NONE}).Handle(c, nil)
+	if len(c.proxyCircuits) != 0 {
+		t.Error("proxy circuits left after DestroyProxyCircuits")
+	}
+	if cell := <-c.writeQueue; Command(cell[4]) != CMD_DESTROY {
+		t.Errorf("expected a DESTROY, got %s", Command(cell[4]))
+	}
+}
@@ -7,8 +7,39 @@ package main
 import (
 	"github.com/miekg/dns"
 	"net"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Address types as RELAY_RESOLVED knows them, besides 4 and 6
+const (
+	DNS_TYPE_HOSTNAME      = 0x00
+	DNS_ERROR_TRANSIENT    = 0xF0
+	DNS_ERROR_NONTRANSIENT = 0xF1
+)
+
+// Lookups for exit streams and RELAY_RESOLVE get queued here and done by a fixed set of workers shared by all
+// connections, instead of a goroutine each
+const (
+	DNS_WORKERS       = 16
+	DNS_QUEUE_LENGTH  = 1024
+	DNS_CACHE_SIZE    = 16384
+	DNS_QUERY_TIMEOUT = 5 * time.Second
+)
+
+// How many seconds we remember that a name doesn't exist, if the server didn't tell us
+const DNS_NEGATIVE_TTL = 60
+
+const DNS_RESOLV_CONF_DEFAULT = "/etc/resolv.conf"
+
+func (c *Config) serverDNSResolvConfFile() string {
+	if c.ServerDNSResolvConfFile == "" {
+		return DNS_RESOLV_CONF_DEFAULT
+	}
+	return c.ServerDNSResolvConfFile
+}
+
 type DNSAddress struct {
 	Type  byte
 	TTL   int
@@ -33,71 +64,396 @@ func (da DNSAddress) String() string {
 		return net.IPv4(da.Value[0], da.Value[1], da.Value[2], da.Value[3]).String()
 	} else if da.Type == 6 {
 		return "[" + net.IP(da.Value).String() + "]"
+	} else if da.Type == DNS_TYPE_HOSTNAME {
+		return string(da.Value)
 	} else {
 		return "error"
 	}
 }
 
-var dnsClient = new(dns.Client)
-var config, _ = dns.ClientConfigFromFile("/etc/resolv.conf")
+// What the resolver did since we started, and what it's doing right now
+type DNSStats struct {
+	Workers   int
+	Busy      int // Workers in the middle of a lookup
+	Queued    int // Lookups waiting for a worker
+	Cached    int // Answers in the cache, including ones that may have expired
+	CacheHits uint64
+	Queries   uint64 // Sent to a server, retries included
+	Failures  uint64 // Queries none of the servers answered
+	Dropped   uint64 // Lookups refused because the queue was full
+}
+
+type dnsCacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type dnsCacheEntry struct {
+	results []DNSAddress // A single DNS_ERROR_NONTRANSIENT if the name has no such records
+	expires time.Time
+}
+
+type dnsJob struct {
+	name    string
+	qtypes  []uint16
+	deliver func([]DNSAddress) // Called on the worker, so it shouldn't block
+}
+
+type DNSResolver struct {
+	servers  []string // host:port, tried in order
+	udp, tcp *dns.Client
+	jobs     chan *dnsJob
+
+	lock  sync.Mutex
+	cache map[dnsCacheKey]dnsCacheEntry
+	stats DNSStats
+}
+
+func DNSServersFromResolvConf(filename string) ([]string, error) {
+	conf, err := dns.ClientConfigFromFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	servers := make([]string, 0, len(conf.Servers))
+	for _, server := range conf.Servers {
+		servers = append(servers, net.JoinHostPort(server, conf.Port))
+	}
+	return servers, nil
+}
+
+func NewDNSResolver(servers []string, workers int) *DNSResolver {
+	r := &DNSResolver{
+		servers: servers,
+		udp:     &dns.Client{Net: "udp", Timeout: DNS_QUERY_TIMEOUT},
+		tcp:     &dns.Client{Net: "tcp", Timeout: DNS_QUERY_TIMEOUT},
+		jobs:    make(chan *dnsJob, DNS_QUEUE_LENGTH),
+		cache:   make(map[dnsCacheKey]dnsCacheEntry),
+	}
+	r.stats.Workers = workers
+	for i := 0; i < workers; i++ {
+		go r.worker()
+	}
+	return r
+}
+
+func (r *DNSResolver) Stats() DNSStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	stats := r.stats
+	stats.Queued = len(r.jobs)
+	stats.Cached = len(r.cache)
+	return stats
+}
+
+// IP addresses don't need resolving
+func literalAddress(host string) (DNSAddress, bool) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return DNSAddress{}, false
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return DNSAddress{Type: 4, TTL: DNS_MAX_TTL, Value: []byte(v4)}, true
+	}
+	return DNSAddress{Type: 6, TTL: DNS_MAX_TTL, Value: []byte(ip.To16())}, true
+}
 
-func ResolveDNS(host string) []DNSAddress {
-	parsedIP := net.ParseIP(host)
-	if parsedIP != nil {
-		v := parsedIP.To16()
-		t := byte(6)
-		if parsedIP.To4() != nil {
-			v = parsedIP.To4()
-			t = 4
+func dnsError(errType byte) []DNSAddress {
+	return []DNSAddress{DNSAddress{Type: errType}}
+}
+
+// Resolves host to records of the given types (dns.TypeA, dns.TypeAAAA or dns.TypePTR), all looked up at once,
+// and waits for the answer
+func (r *DNSResolver) Resolve(host string, qtypes ...uint16) []DNSAddress {
+	if addr, ok := literalAddress(host); ok {
+		return []DNSAddress{addr}
+	}
+
+	done := make(chan []DNSAddress, 1)
+	job := &dnsJob{
+		name:   host,
+		qtypes: qtypes,
+		deliver: func(results []DNSAddress) {
+			done <- results
+		},
+	}
+	if !r.submit(job) {
+		return dnsError(DNS_ERROR_TRANSIENT)
+	}
+	return <-done
+}
+
+// Answers a RELAY_RESOLVE: all addresses of a hostname, or the hostname of an in-addr.arpa or ip6.arpa name.
+// The answer arrives on resultChan as a DNSResult.
+func (r *DNSResolver) ResolveAsync(host string, circ CircuitID, stream StreamID, resultChan CircReadQueue) {
+	deliver := func(results []DNSAddress) {
+		select {
+		case resultChan <- &DNSResult{
+			circuitID: circ,
+			streamID:  stream,
+			Results:   results,
+		}:
+		default:
+			Log(LOG_NOTICE, "Dropping the answer for %q, its connection is backed up", host)
 		}
-		return []DNSAddress{
-			DNSAddress{
-				Value: []byte(v),
-				Type:  t,
-				TTL:   86400, // XXX
-			},
+	}
+
+	if addr, ok := literalAddress(host); ok {
+		deliver([]DNSAddress{addr})
+		return
+	}
+
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+	lower := strings.ToLower(strings.TrimSuffix(host, "."))
+	if strings.HasSuffix(lower, ".in-addr.arpa") || strings.HasSuffix(lower, ".ip6.arpa") {
+		qtypes = []uint16{dns.TypePTR}
+	}
+
+	if !r.submit(&dnsJob{name: host, qtypes: qtypes, deliver: deliver}) {
+		deliver(dnsError(DNS_ERROR_TRANSIENT))
+	}
+}
+
+// Never blocks. Returns false if the queue is full
+func (r *DNSResolver) submit(job *dnsJob) bool {
+	select {
+	case r.jobs <- job:
+		return true
+	default:
+		r.lock.Lock()
+		r.stats.Dropped++
+		r.lock.Unlock()
+		Log(LOG_NOTICE, "Too many DNS lookups queued, refusing to resolve %q", job.name)
+		return false
+	}
+}
+
+func (r *DNSResolver) worker() {
+	for job := range r.jobs {
+		r.lock.Lock()
+		r.stats.Busy++
+		r.lock.Unlock()
+
+		results := r.lookup(job.name, job.qtypes)
+
+		r.lock.Lock()
+		r.stats.Busy--
+		r.lock.Unlock()
+
+		job.deliver(results)
+	}
+}
+
+// Looks up every record type in parallel and merges the answers. If there are none, the worst error wins
+func (r *DNSResolver) lookup(name string, qtypes []uint16) []DNSAddress {
+	answers := make([][]DNSAddress, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func(i int, qtype uint16) {
+			defer wg.Done()
+			answers[i] = r.query(name, qtype, time.Now())
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	var results []DNSAddress
+	errType := byte(DNS_ERROR_NONTRANSIENT)
+	for _, answer := range answers {
+		for _, addr := range answer {
+			switch addr.Type {
+			case DNS_ERROR_TRANSIENT:
+				errType = DNS_ERROR_TRANSIENT
+			case DNS_ERROR_NONTRANSIENT:
+			default:
+				results = append(results, addr)
+			}
 		}
 	}
 
+	if len(results) == 0 {
+		return dnsError(errType)
+	}
+	return results
+}
+
+func (r *DNSResolver) query(name string, qtype uint16, now time.Time) []DNSAddress {
+	key := dnsCacheKey{strings.ToLower(dns.Fqdn(name)), qtype}
+	if results, ok := r.cached(key, now); ok {
+		return results
+	}
+
+	results, ttl := r.exchange(key.name, qtype)
+	r.store(key, results, ttl, now)
+	return results
+}
+
+// Cached answers come with whatever is left of their TTL
+func (r *DNSResolver) cached(key dnsCacheKey, now time.Time) ([]DNSAddress, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	entry, ok := r.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if !now.Before(entry.expires) {
+		delete(r.cache, key)
+		return nil, false
+	}
+	r.stats.CacheHits++
+
+	remaining := int(entry.expires.Sub(now) / time.Second)
+	results := make([]DNSAddress, len(entry.results))
+	for i, addr := range entry.results {
+		addr.TTL = remaining
+		results[i] = addr
+	}
+	return results, true
+}
+
+func (r *DNSResolver) store(key dnsCacheKey, results []DNSAddress, ttl int, now time.Time) {
+	if ttl <= 0 {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.cache) >= DNS_CACHE_SIZE {
+		for k, entry := range r.cache {
+			if !now.Before(entry.expires) {
+				delete(r.cache, k)
+			}
+		}
+		if len(r.cache) >= DNS_CACHE_SIZE {
+			return
+		}
+	}
+	r.cache[key] = dnsCacheEntry{
+		results: results,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// Asks each server in turn until one gives a real answer, good or bad. Also returns how many seconds that
+// answer may be cached for.
+func (r *DNSResolver) exchange(name string, qtype uint16) ([]DNSAddress, int) {
 	m := new(dns.Msg)
-	m.SetQuestion(dns.Fqdn(host), dns.TypeA) //XXX will this stop us from getting AAAA?
-	in, _, err := dnsClient.Exchange(m, config.Servers[0]+":"+config.Port)
-	if err != nil {
-		return []DNSAddress{DNSAddress{0xF0, 0, nil}}
+	m.SetQuestion(name, qtype)
+
+	for _, server := range r.servers {
+		r.lock.Lock()
+		r.stats.Queries++
+		r.lock.Unlock()
+
+		in, _, err := r.udp.Exchange(m, server)
+		if err == nil && in.Truncated {
+			r.lock.Lock()
+			r.stats.Queries++
+			r.lock.Unlock()
+			in, _, err = r.tcp.Exchange(m, server)
+		}
+		if err != nil {
+			Log(LOG_INFO, "DNS server %s could not resolve %s: %s", server, name, err)
+			continue
+		}
+
+		switch in.Rcode {
+		case dns.RcodeSuccess:
+			if results, ttl := parseDNSAnswer(in, qtype); len(results) > 0 {
+				return results, ttl
+			}
+			return dnsError(DNS_ERROR_NONTRANSIENT), negativeDNSTTL(in)
+		case dns.RcodeNameError:
+			return dnsError(DNS_ERROR_NONTRANSIENT), negativeDNSTTL(in)
+		default:
+			Log(LOG_INFO, "DNS server %s answered %s for %s", server, dns.RcodeToString[in.Rcode], name)
+		}
 	}
 
-	var r []DNSAddress
+	r.lock.Lock()
+	r.stats.Failures++
+	r.lock.Unlock()
+	return dnsError(DNS_ERROR_TRANSIENT), 0
+}
+
+// Anything we didn't ask for, like the CNAMEs leading up to the answer, gets skipped. The TTL is the lowest
+// of all the records
+func parseDNSAnswer(in *dns.Msg, qtype uint16) ([]DNSAddress, int) {
+	var results []DNSAddress
+	ttl := -1
 	for _, answer := range in.Answer {
-		if a, ok := answer.(*dns.A); ok {
-			r = append(r, DNSAddress{
-				Value: []byte(a.A.To4()),
-				Type:  4,
-				TTL:   int(a.Hdr.Ttl),
-			})
+		if answer.Header().Rrtype != qtype {
+			continue
+		}
+
+		var addr DNSAddress
+		switch rr := answer.(type) {
+		case *dns.A:
+			addr = DNSAddress{Type: 4, Value: []byte(rr.A.To4())}
+		case *dns.AAAA:
+			addr = DNSAddress{Type: 6, Value: []byte(rr.AAAA.To16())}
+		case *dns.PTR:
+			name, ok := hostnameOctets(rr.Ptr)
+			if !ok {
+				continue
+			}
+			addr = DNSAddress{Type: DNS_TYPE_HOSTNAME, Value: name}
+		default:
+			continue
 		}
-		if aaaa, ok := answer.(*dns.AAAA); ok {
-			r = append(r, DNSAddress{
-				Value: []byte(aaaa.AAAA.To16()),
-				Type:  6,
-				TTL:   int(aaaa.Hdr.Ttl),
-			})
+
+		addr.TTL = int(answer.Header().Ttl)
+		if ttl < 0 || addr.TTL < ttl {
+			ttl = addr.TTL
 		}
+		results = append(results, addr)
 	}
-	if len(r) == 0 {
-		return []DNSAddress{DNSAddress{0xF1, 0, nil}}
+	return results, ttl
+}
+
+// Names come out of miekg/dns as presentation text, with \DDD escapes for anything unprintable. Clients get the
+// octets of the labels instead, joined by dots. Names that don't fit in a RELAY_RESOLVED answer are no use to anyone
+func hostnameOctets(name string) ([]byte, bool) {
+	var wire [256]byte
+	n, err := dns.PackDomainName(dns.Fqdn(name), wire[:], 0, nil, false)
+	if err != nil {
+		return nil, false
 	}
-	return r
+
+	var octets []byte
+	for off := 0; off < n && wire[off] != 0; {
+		labelLen := int(wire[off])
+		if off+1+labelLen > n {
+			return nil, false
+		}
+		if len(octets) > 0 {
+			octets = append(octets, '.')
+		}
+		octets = append(octets, wire[off+1:off+1+labelLen]...)
+		off += 1 + labelLen
+	}
+
+	if len(octets) == 0 || len(octets) > 255 {
+		return nil, false
+	}
+	return octets, true
 }
 
-func ResolveDNSAsync(host string, circ CircuitID, stream StreamID, resultChan CircReadQueue) {
-	go func() { // XXX this can be a lot faster and we really don't need a goroutine for each.
-		result := ResolveDNS(host)
-		resultChan <- &DNSResult{
-			circuitID: circ,
-			streamID:  stream,
-			Results:   result,
+// Negative answers may be cached for as long as the zone's SOA says
+func negativeDNSTTL(in *dns.Msg) int {
+	for _, rr := range in.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return int(ttl)
 		}
-	}()
+	}
+	return DNS_NEGATIVE_TTL
 }
 
 func (dr *DNSResult) Handle(c *OnionConnection, circ *Circuit) ActionableError {
@@ -105,7 +461,8 @@ func (dr *DNSResult) Handle(c *OnionConnection, circ *Circuit) ActionableError {
 	pos := 0
 	for _, item := range dr.Results {
 		if len(item.Value) > 255 {
-			panic("Huh? I thought we're talking IP addresses")
+			Log(LOG_NOTICE, "Answer for stream %d is too long for RELAY_RESOLVED, sending an error instead", dr.streamID)
+			item = DNSAddress{Type: DNS_ERROR_NONTRANSIENT}
 		}
 		if len(buf)-pos-6-len(item.Value) < 0 {
 			break
@@ -114,7 +471,7 @@ func (dr *DNSResult) Handle(c *OnionConnection, circ *Circuit) ActionableError {
 		buf[pos+1] = byte(len(item.Value))
 		copy(buf[pos+2:], []byte(item.Value))
 		pos += 2 + len(item.Value)
-		BigEndian.PutUint32(buf[pos:pos+4], uint32(item.TTL))
+		BigEndian.PutUint32(buf[pos:pos+4], clipDNSTTL(item.TTL))
 		pos += 4
 	}
 
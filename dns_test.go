@@ -0,0 +1,220 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A local stand-in for a DNS server, on UDP and TCP on the same port. Counts the queries it got per name and
+// type
+type testDNSServer struct {
+	addr    string
+	lock    sync.Mutex
+	queries map[string]int
+	udp     *dns.Server
+	tcp     *dns.Server
+}
+
+func newTestDNSServer(t *testing.T, handler func(w dns.ResponseWriter, req *dns.Msg, reply *dns.Msg)) *testDNSServer {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+
+	s := &testDNSServer{
+		addr:    pc.LocalAddr().String(),
+		queries: make(map[string]int),
+	}
+	h := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		s.lock.Lock()
+		s.queries[q.Name+" "+dns.TypeToString[q.Qtype]]++
+		s.lock.Unlock()
+
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		handler(w, req, reply)
+		w.WriteMsg(reply)
+	})
+	s.udp = &dns.Server{PacketConn: pc, Handler: h}
+	s.tcp = &dns.Server{Listener: l, Handler: h}
+	go s.udp.ActivateAndServe()
+	go s.tcp.ActivateAndServe()
+	return s
+}
+
+func (s *testDNSServer) count(query string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.queries[query]
+}
+
+func (s *testDNSServer) Close() {
+	s.udp.Shutdown()
+	s.tcp.Shutdown()
+}
+
+func testRR(t *testing.T, rr string) dns.RR {
+	r, err := dns.NewRR(rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestDNSResolveAndCache(t *testing.T) {
+	server := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg, reply *dns.Msg) {
+		q := req.Question[0]
+		switch {
+		case q.Name == "example.com." && q.Qtype == dns.TypeA:
+			reply.Answer = append(reply.Answer, testRR(t, "example.com. 600 IN A 192.0.2.1"))
+		case q.Name == "example.com." && q.Qtype == dns.TypeAAAA:
+			reply.Answer = append(reply.Answer,
+				testRR(t, "example.com. 900 IN CNAME www.example.com."),
+				testRR(t, "www.example.com. 900 IN AAAA 2001:db8::1"))
+		case q.Name == "missing.example.com.":
+			reply.Rcode = dns.RcodeNameError
+			reply.Ns = append(reply.Ns, testRR(t, "example.com. 3600 IN SOA ns.example.com. root.example.com. 1 7200 3600 86400 120"))
+		}
+	})
+	defer server.Close()
+	r := NewDNSResolver([]string{server.addr}, 2)
+
+	results := r.Resolve("example.com", dns.TypeA, dns.TypeAAAA)
+	if len(results) != 2 {
+		t.Fatalf("expected an A and an AAAA answer, got %v", results)
+	}
+	for _, addr := range results {
+		if !(addr.Type == 4 && addr.String() == "192.0.2.1" && addr.TTL == 600) && !(addr.Type == 6 && addr.String() == "[2001:db8::1]" && addr.TTL == 900) {
+			t.Errorf("unexpected answer %s (type %d, TTL %d)", addr, addr.Type, addr.TTL)
+		}
+	}
+
+	// Case doesn't matter for the cache
+	if results := r.Resolve("EXAMPLE.com", dns.TypeA); len(results) != 1 || results[0].Type != 4 || results[0].TTL > 600 {
+		t.Errorf("unexpected cached answer %v", results)
+	}
+	if server.count("example.com. A") != 1 || server.count("example.com. AAAA") != 1 {
+		t.Error("answer was not cached")
+	}
+
+	for i := 0; i < 2; i++ {
+		if results := r.Resolve("missing.example.com", dns.TypeA); len(results) != 1 || results[0].Type != DNS_ERROR_NONTRANSIENT {
+			t.Errorf("expected a non-transient error for a missing name, got %v", results)
+		}
+	}
+	if server.count("missing.example.com. A") != 1 {
+		t.Error("negative answer was not cached")
+	}
+
+	if stats := r.Stats(); stats.Workers != 2 || stats.CacheHits != 2 || stats.Queries != 3 || stats.Cached != 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestDNSServerFallback(t *testing.T) {
+	broken := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg, reply *dns.Msg) {
+		reply.Rcode = dns.RcodeServerFailure
+	})
+	defer broken.Close()
+	truncating := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg, reply *dns.Msg) {
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+			reply.Truncated = true
+			return
+		}
+		reply.Answer = append(reply.Answer, testRR(t, "big.example.com. 600 IN A 192.0.2.2"))
+	})
+	defer truncating.Close()
+
+	r := NewDNSResolver([]string{broken.addr, truncating.addr}, 1)
+	if results := r.Resolve("big.example.com", dns.TypeA); len(results) != 1 || results[0].String() != "192.0.2.2" {
+		t.Errorf("expected the answer over TCP from the second server, got %v", results)
+	}
+	if broken.count("big.example.com. A") != 1 || truncating.count("big.example.com. A") != 2 {
+		t.Error("servers were not tried in order")
+	}
+
+	// When nobody can answer, that's not something to remember
+	r = NewDNSResolver([]string{broken.addr}, 1)
+	for i := 0; i < 2; i++ {
+		if results := r.Resolve("big.example.com", dns.TypeA); len(results) != 1 || results[0].Type != DNS_ERROR_TRANSIENT {
+			t.Errorf("expected a transient error, got %v", results)
+		}
+	}
+	if stats := r.Stats(); stats.Failures != 2 || stats.Cached != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestDNSResolveAsyncPTR(t *testing.T) {
+	server := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg, reply *dns.Msg) {
+		if q := req.Question[0]; q.Name == "1.2.0.192.in-addr.arpa." && q.Qtype == dns.TypePTR {
+			reply.Answer = append(reply.Answer, testRR(t, "1.2.0.192.in-addr.arpa. 600 IN PTR host.example.com."))
+		}
+	})
+	defer server.Close()
+	r := NewDNSResolver([]string{server.addr}, 1)
+
+	queue := make(CircReadQueue, 1)
+	r.ResolveAsync("1.2.0.192.in-addr.arpa", 0x80000001, 3, queue)
+	result := (<-queue).(*DNSResult)
+	if result.CircID() != 0x80000001 || result.streamID != 3 {
+		t.Errorf("answer delivered for circuit %d stream %d", result.CircID(), result.streamID)
+	}
+	if len(result.Results) != 1 || result.Results[0].Type != DNS_TYPE_HOSTNAME || result.Results[0].String() != "host.example.com" {
+		t.Errorf("unexpected PTR answer %v", result.Results)
+	}
+	if server.count("1.2.0.192.in-addr.arpa. A") != 0 {
+		t.Error("reverse lookup also asked for addresses")
+	}
+}
+
+func TestDNSResolvePTROctets(t *testing.T) {
+	label := strings.Repeat(`\000`, 63)
+	server := newTestDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg, reply *dns.Msg) {
+		q := req.Question[0]
+		reply.Answer = append(reply.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 600},
+			Ptr: label + "." + label + "." + label + ".",
+		})
+	})
+	defer server.Close()
+	r := NewDNSResolver([]string{server.addr}, 1)
+
+	results := r.Resolve("2.2.0.192.in-addr.arpa", dns.TypePTR)
+	if len(results) != 1 || results[0].Type != DNS_TYPE_HOSTNAME {
+		t.Fatalf("unexpected PTR answer %v", results)
+	}
+	if name := results[0].Value; len(name) != 3*63+2 || name[0] != 0 || name[63] != '.' {
+		t.Errorf("PTR name not turned into octets: %q", name)
+	}
+
+	// Should an answer ever be too long, the client gets an error rather than a crashed relay
+	c := &OnionConnection{negotiatedVersion: 4, circQueues: newCircuitScheduler(nil)}
+	circ := testHopCircuit(80)
+	result := &DNSResult{
+		circuitID: circ.id,
+		streamID:  1,
+		Results:   []DNSAddress{DNSAddress{Type: DNS_TYPE_HOSTNAME, Value: make([]byte, 766)}},
+	}
+	if err := result.Handle(c, circ); err != nil {
+		t.Fatal(err)
+	}
+	cell := c.circQueues.next()
+	testHopCircuit(80).backward.cipher.Crypt(cell[5:], cell[5:])
+	if RelayCommand(cell[5]) != RELAY_RESOLVED || cell[5+11] != DNS_ERROR_NONTRANSIENT || cell[5+12] != 0 {
+		t.Errorf("expected a RELAY_RESOLVED with an error, got %x", cell[5:5+20])
+	}
+}
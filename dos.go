@@ -0,0 +1,250 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Defaults for the DoS mitigation, the same as what the consensus gives C tor
+const (
+	DOS_CC_MIN_CONCURRENT_CONN_DEFAULT = 3
+	DOS_CC_CIRCUIT_RATE_DEFAULT        = 3 // Per second
+	DOS_CC_CIRCUIT_BURST_DEFAULT       = 90
+	DOS_CC_DEFENSE_TIME_PERIOD_DEFAULT = time.Hour
+	DOS_CONN_MAX_CONCURRENT_DEFAULT    = 100
+	DOS_MAX_STREAMS_PER_CIRCUIT        = 512
+)
+
+// How often addresses we no longer need to remember get forgotten, and how often the counters get logged
+const DOS_HOUSEKEEPING_INTERVAL = time.Minute
+const DOS_REPORT_INTERVAL = 6 * time.Hour
+
+func (c *Config) dosMinConnections() int {
+	if c.DoSCircuitCreationMinConnections == 0 {
+		return DOS_CC_MIN_CONCURRENT_CONN_DEFAULT
+	}
+	return c.DoSCircuitCreationMinConnections
+}
+
+func (c *Config) dosCircuitRate() int {
+	if c.DoSCircuitCreationRate == 0 {
+		return DOS_CC_CIRCUIT_RATE_DEFAULT
+	}
+	return c.DoSCircuitCreationRate
+}
+
+func (c *Config) dosCircuitBurst() int {
+	if c.DoSCircuitCreationBurst == 0 {
+		return DOS_CC_CIRCUIT_BURST_DEFAULT
+	}
+	return c.DoSCircuitCreationBurst
+}
+
+func (c *Config) dosDefenseTimePeriod() time.Duration {
+	if c.DoSCircuitCreationDefenseTimePeriod == 0 {
+		return DOS_CC_DEFENSE_TIME_PERIOD_DEFAULT
+	}
+	return c.DoSCircuitCreationDefenseTimePeriod
+}
+
+func (c *Config) dosMaxConnections() int {
+	if c.DoSConnectionMaxConcurrentCount == 0 {
+		return DOS_CONN_MAX_CONCURRENT_DEFAULT
+	}
+	return c.DoSConnectionMaxConcurrentCount
+}
+
+func (c *Config) dosMaxStreams() int {
+	if c.DoSMaxStreamsPerCircuit == 0 {
+		return DOS_MAX_STREAMS_PER_CIRCUIT
+	}
+	return c.DoSMaxStreamsPerCircuit
+}
+
+// What the DoS mitigation did since we started
+type DoSCounters struct {
+	ConnectionsRefused int
+	CircuitsRefused    int
+	AddressesMarked    int // Ran out of circuits and got put in the penalty box
+	StreamsRefused     int
+}
+
+type dosClient struct {
+	connections  int
+	tokens       int // Circuits this address may still create
+	refilled     time.Time
+	penaltyUntil time.Time
+}
+
+// Keeps single client addresses from hogging connections, circuits or streams. All methods are fine to call
+// on a nil *DoSMitigation, which allows everything.
+type DoSMitigation struct {
+	config *Config
+
+	lock     sync.Mutex
+	clients  map[string]*dosClient
+	counters DoSCounters
+}
+
+func NewDoSMitigation(config *Config) *DoSMitigation {
+	return &DoSMitigation{
+		config:  config,
+		clients: make(map[string]*dosClient),
+	}
+}
+
+func (d *DoSMitigation) client(ip net.IP, now time.Time) *dosClient {
+	key := string(ip.To16())
+	cl, ok := d.clients[key]
+	if !ok {
+		cl = &dosClient{
+			tokens:   d.config.dosCircuitBurst(),
+			refilled: now,
+		}
+		d.clients[key] = cl
+	}
+	return cl
+}
+
+// Called for every incoming connection. Returns false if the address has too many open already
+func (d *DoSMitigation) openConnection(ip net.IP, now time.Time) bool {
+	if d == nil || ip == nil {
+		return true
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	cl := d.client(ip, now)
+	if !d.config.DoSConnectionDisabled && cl.connections >= d.config.dosMaxConnections() {
+		d.counters.ConnectionsRefused++
+		return false
+	}
+	cl.connections++
+	return true
+}
+
+// Undoes a successful openConnection
+func (d *DoSMitigation) closeConnection(ip net.IP) {
+	if d == nil || ip == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if cl, ok := d.clients[string(ip.To16())]; ok && cl.connections > 0 {
+		cl.connections--
+	}
+}
+
+// Called for every CREATE a client sends. Addresses that keep several connections open and use up their burst
+// get all their CREATEs refused for a while.
+func (d *DoSMitigation) allowCircuit(ip net.IP, now time.Time) bool {
+	if d == nil || ip == nil || d.config.DoSCircuitCreationDisabled {
+		return true
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	cl := d.client(ip, now)
+	if now.Before(cl.penaltyUntil) {
+		d.counters.CircuitsRefused++
+		return false
+	}
+
+	if seconds := now.Sub(cl.refilled) / time.Second; seconds > 0 {
+		cl.tokens += d.config.dosCircuitRate() * int(seconds)
+		if burst := d.config.dosCircuitBurst(); cl.tokens > burst {
+			cl.tokens = burst
+		}
+		cl.refilled = cl.refilled.Add(seconds * time.Second)
+	}
+
+	if cl.tokens > 0 {
+		cl.tokens--
+	}
+	if cl.tokens == 0 && cl.connections >= d.config.dosMinConnections() {
+		Log(LOG_NOTICE, "Address %s is creating too many circuits, refusing its CREATEs for a while", ip)
+		cl.penaltyUntil = now.Add(d.config.dosDefenseTimePeriod())
+		d.counters.AddressesMarked++
+		d.counters.CircuitsRefused++
+		return false
+	}
+	return true
+}
+
+// Called before opening another stream on a circuit that has open streams already
+func (d *DoSMitigation) allowStream(open int) bool {
+	if d == nil {
+		return true
+	}
+
+	if open < d.config.dosMaxStreams() {
+		return true
+	}
+
+	d.lock.Lock()
+	d.counters.StreamsRefused++
+	d.lock.Unlock()
+	return false
+}
+
+func (d *DoSMitigation) Counters() DoSCounters {
+	if d == nil {
+		return DoSCounters{}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.counters
+}
+
+// Forgets addresses that have nothing left for us to remember
+func (d *DoSMitigation) prune(now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	burst := d.config.dosCircuitBurst()
+	rate := d.config.dosCircuitRate()
+	for key, cl := range d.clients {
+		if cl.connections != 0 || now.Before(cl.penaltyUntil) {
+			continue
+		}
+		if cl.tokens+rate*int(now.Sub(cl.refilled)/time.Second) < burst {
+			continue
+		}
+		delete(d.clients, key)
+	}
+}
+
+func (d *DoSMitigation) Run() {
+	housekeeping := time.NewTicker(DOS_HOUSEKEEPING_INTERVAL)
+	defer housekeeping.Stop()
+	lastReport := time.Now()
+
+	for now := range housekeeping.C {
+		d.prune(now)
+
+		if now.Sub(lastReport) >= DOS_REPORT_INTERVAL {
+			lastReport = now
+			cnt := d.Counters()
+			Log(LOG_NOTICE, "DoS mitigation since startup: %d connections refused, %d circuits refused from %d marked addresses, %d streams refused",
+				cnt.ConnectionsRefused, cnt.CircuitsRefused, cnt.AddressesMarked, cnt.StreamsRefused)
+		}
+	}
+}
+
+// Clients (anyone that didn't authenticate as a relay) are subject to the circuit creation limits
+func (c *OnionConnection) circuitCreationAllowed() bool {
+	if c.isOutbound || c.theyAuthenticated {
+		return true
+	}
+	return c.parentOR.dos.allowCircuit(c.theirAddress, time.Now())
+}
@@ -0,0 +1,89 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDoSConnectionLimit(t *testing.T) {
+	d := NewDoSMitigation(&Config{DoSConnectionMaxConcurrentCount: 2})
+	ip := net.ParseIP("192.0.2.1")
+	now := time.Now()
+
+	if !d.openConnection(ip, now) || !d.openConnection(ip, now) {
+		t.Fatal("refused connections below the limit")
+	}
+	if d.openConnection(ip, now) {
+		t.Error("allowed a connection over the limit")
+	}
+	if !d.openConnection(net.ParseIP("192.0.2.2"), now) {
+		t.Error("limit applied to a different address")
+	}
+
+	d.closeConnection(ip)
+	if !d.openConnection(ip, now) {
+		t.Error("closed connection still counted")
+	}
+	if cnt := d.Counters(); cnt.ConnectionsRefused != 1 {
+		t.Errorf("expected 1 refused connection, got %d", cnt.ConnectionsRefused)
+	}
+}
+
+func TestDoSCircuitCreation(t *testing.T) {
+	d := NewDoSMitigation(&Config{
+		DoSCircuitCreationMinConnections:    2,
+		DoSCircuitCreationRate:              1,
+		DoSCircuitCreationBurst:             5,
+		DoSCircuitCreationDefenseTimePeriod: time.Minute,
+	})
+	ip := net.ParseIP("2001:db8::1")
+	now := time.Now()
+
+	// With a single connection the address never gets marked
+	d.openConnection(ip, now)
+	for i := 0; i < 10; i++ {
+		if !d.allowCircuit(ip, now) {
+			t.Fatalf("circuit %d refused for an address with one connection", i)
+		}
+	}
+
+	d.openConnection(ip, now)
+	if d.allowCircuit(ip, now) {
+		t.Error("allowed a circuit with an empty bucket")
+	}
+	if d.allowCircuit(ip, now.Add(30*time.Second)) {
+		t.Error("allowed a circuit during the penalty")
+	}
+	if !d.allowCircuit(ip, now.Add(time.Minute)) {
+		t.Error("still refusing circuits after the penalty")
+	}
+
+	cnt := d.Counters()
+	if cnt.AddressesMarked != 1 || cnt.CircuitsRefused != 2 {
+		t.Errorf("expected 1 marked address and 2 refused circuits, got %d and %d", cnt.AddressesMarked, cnt.CircuitsRefused)
+	}
+
+	d.closeConnection(ip)
+	d.closeConnection(ip)
+	d.prune(now.Add(time.Hour))
+	if len(d.clients) != 0 {
+		t.Error("idle address was not forgotten")
+	}
+}
+
+func TestDoSStreams(t *testing.T) {
+	d := NewDoSMitigation(&Config{DoSMaxStreamsPerCircuit: 3})
+	if !d.allowStream(2) || d.allowStream(3) {
+		t.Error("stream limit not enforced")
+	}
+
+	var disabled *DoSMitigation
+	if !disabled.allowStream(1000) || !disabled.allowCircuit(net.ParseIP("192.0.2.1"), time.Now()) {
+		t.Error("nil DoSMitigation refused something")
+	}
+}
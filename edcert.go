@@ -0,0 +1,260 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"filippo.io/edwards25519"
+	"fmt"
+	"time"
+)
+
+// Ed25519 certificate types from cert-spec.txt. Types 4-7 may appear in a CERTS cell
+const (
+	CERTTYPE_ED_ID_SIGNING    = 4
+	CERTTYPE_ED_SIGNING_LINK  = 5
+	CERTTYPE_ED_SIGNING_AUTH  = 6
+	CERTTYPE_RSA_ED_CROSSCERT = 7
+	CERTTYPE_ED_NTOR_ONION_ID = 10
+)
+
+// What CERTIFIED_KEY holds
+const (
+	ED_CERT_KEYTYPE_ED25519     = 1
+	ED_CERT_KEYTYPE_SHA256_X509 = 3
+)
+
+const ED_CERT_EXT_SIGNED_WITH_KEY = 4
+const ED_CERT_EXT_FLAG_AFFECTS_VALIDATION = 1
+
+// Same as C tor's default signing key lifetime
+const ED_SIGNING_KEY_LIFETIME = 30 * 24 * time.Hour
+
+var rsaEdCrossCertPrefix = []byte("Tor TLS RSA/Ed25519 cross-certificate")
+
+type Ed25519Cert struct {
+	CertType     byte
+	Expires      time.Time
+	KeyType      byte
+	CertifiedKey [32]byte
+	SignedWith   ed25519.PublicKey // From the signed-with-key extension, nil if absent
+	Signature    []byte
+
+	signedData []byte
+}
+
+func hoursSinceEpoch(t time.Time) uint32 {
+	return uint32(t.Unix() / 3600)
+}
+
+func buildEd25519Cert(certType, keyType byte, certified []byte, expires time.Time, signedWith []byte, sign func([]byte) []byte) []byte {
+	if len(certified) != 32 {
+		panic("Code error: certified keys are 32 bytes")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(1) // VERSION
+	buf.WriteByte(certType)
+	var exp [4]byte
+	BigEndian.PutUint32(exp[:], hoursSinceEpoch(expires))
+	buf.Write(exp[:])
+	buf.WriteByte(keyType)
+	buf.Write(certified)
+
+	if signedWith != nil {
+		buf.WriteByte(1) // N_EXTENSIONS
+		buf.Write([]byte{0, 32, ED_CERT_EXT_SIGNED_WITH_KEY, ED_CERT_EXT_FLAG_AFFECTS_VALIDATION})
+		buf.Write(signedWith)
+	} else {
+		buf.WriteByte(0)
+	}
+
+	buf.Write(sign(buf.Bytes()))
+	return buf.Bytes()
+}
+
+// NewEd25519Cert certifies a key (or digest) with an ed25519 key. includeSigner adds the signed-with-key extension.
+func NewEd25519Cert(certType, keyType byte, certified []byte, lifetime time.Duration, signer ed25519.PrivateKey, includeSigner bool) []byte {
+	var signedWith []byte
+	if includeSigner {
+		signedWith = signer.Public().(ed25519.PublicKey)
+	}
+
+	return buildEd25519Cert(certType, keyType, certified, time.Now().Add(lifetime), signedWith, func(data []byte) []byte {
+		return ed25519.Sign(signer, data)
+	})
+}
+
+func ParseEd25519Cert(data []byte) (*Ed25519Cert, error) {
+	if len(data) < 40+64 {
+		return nil, errors.New("ed25519 certificate too short")
+	}
+	if data[0] != 1 {
+		return nil, fmt.Errorf("unknown ed25519 certificate version %d", data[0])
+	}
+
+	cert := &Ed25519Cert{
+		CertType: data[1],
+		Expires:  time.Unix(int64(BigEndian.Uint32(data[2:6]))*3600, 0),
+		KeyType:  data[6],
+	}
+	copy(cert.CertifiedKey[:], data[7:39])
+
+	nExt := int(data[39])
+	readPos := 40
+	for i := 0; i < nExt; i++ {
+		if len(data) < readPos+4 {
+			return nil, errors.New("truncated ed25519 certificate extension")
+		}
+		extLen := int(BigEndian.Uint16(data[readPos : readPos+2]))
+		extType := data[readPos+2]
+		extFlags := data[readPos+3]
+		readPos += 4
+		if len(data) < readPos+extLen {
+			return nil, errors.New("truncated ed25519 certificate extension")
+		}
+		extData := data[readPos : readPos+extLen]
+		readPos += extLen
+
+		if extType == ED_CERT_EXT_SIGNED_WITH_KEY {
+			if extLen != 32 {
+				return nil, errors.New("malformed signed-with-key extension")
+			}
+			cert.SignedWith = ed25519.PublicKey(extData)
+		} else if extFlags&ED_CERT_EXT_FLAG_AFFECTS_VALIDATION != 0 {
+			return nil, fmt.Errorf("unknown ed25519 certificate extension %d affects validation", extType)
+		}
+	}
+
+	if len(data) != readPos+64 {
+		return nil, errors.New("ed25519 certificate has the wrong length")
+	}
+	cert.signedData = data[:readPos]
+	cert.Signature = data[readPos:]
+
+	return cert, nil
+}
+
+func (c *Ed25519Cert) CheckSignature(key ed25519.PublicKey) error {
+	if c.SignedWith != nil && !bytes.Equal(c.SignedWith, key) {
+		return errors.New("ed25519 certificate claims to be signed by another key")
+	}
+	if !ed25519.Verify(key, c.signedData, c.Signature) {
+		return errors.New("bad ed25519 certificate signature")
+	}
+	return nil
+}
+
+type RSAEdCrossCert struct {
+	EdKey     [32]byte
+	Expires   time.Time
+	Signature []byte
+
+	signedData []byte
+}
+
+func rsaEdCrossCertDigest(signed []byte) []byte {
+	h := sha256.New()
+	h.Write(rsaEdCrossCertPrefix)
+	h.Write(signed)
+	return h.Sum(nil)
+}
+
+// NewRSAEdCrossCert has our RSA identity vouch for our ed25519 identity
+func NewRSAEdCrossCert(edKey ed25519.PublicKey, lifetime time.Duration, rsaKey *rsa.PrivateKey) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(edKey)
+	var exp [4]byte
+	BigEndian.PutUint32(exp[:], hoursSinceEpoch(time.Now().Add(lifetime)))
+	buf.Write(exp[:])
+
+	sig, err := rsaSignRaw(rsaKey, rsaEdCrossCertDigest(buf.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	if len(sig) > 255 {
+		return nil, errors.New("RSA signature too long for a cross-certificate")
+	}
+
+	buf.WriteByte(byte(len(sig)))
+	buf.Write(sig)
+	return buf.Bytes(), nil
+}
+
+func ParseRSAEdCrossCert(data []byte) (*RSAEdCrossCert, error) {
+	if len(data) < 37 {
+		return nil, errors.New("RSA->ed25519 cross-certificate too short")
+	}
+	sigLen := int(data[36])
+	if len(data) != 37+sigLen {
+		return nil, errors.New("RSA->ed25519 cross-certificate has the wrong length")
+	}
+
+	cert := &RSAEdCrossCert{
+		Expires:    time.Unix(int64(BigEndian.Uint32(data[32:36]))*3600, 0),
+		Signature:  data[37:],
+		signedData: data[0:36],
+	}
+	copy(cert.EdKey[:], data[0:32])
+	return cert, nil
+}
+
+func (c *RSAEdCrossCert) CheckSignature(key *rsa.PublicKey) error {
+	return rsa.VerifyPKCS1v15(key, 0, rsaEdCrossCertDigest(c.signedData), c.Signature)
+}
+
+// NewNtorCrossCert certifies our ed25519 identity with the ed25519 key derived from our ntor onion key, as the
+// ntor-onion-key-crosscert descriptor entry wants. The sign bit is needed to recover that key from the curve25519 one.
+func NewNtorCrossCert(ntorPrivate [32]byte, edIdentity ed25519.PublicKey, lifetime time.Duration) ([]byte, byte) {
+	// Same derivation as C tor's ed25519_keypair_from_curve25519_keypair, including the NUL byte
+	a, err := edwards25519.NewScalar().SetBytesWithClamping(ntorPrivate[:])
+	if err != nil {
+		panic(err)
+	}
+	h := sha512.New()
+	h.Write(ntorPrivate[:])
+	h.Write([]byte("Derive high part of ed25519 key from curve25519 key\x00"))
+	prefix := h.Sum(nil)[0:32]
+
+	pub := edwards25519.NewIdentityPoint().ScalarBaseMult(a).Bytes()
+	signBit := pub[31] >> 7
+
+	cert := buildEd25519Cert(CERTTYPE_ED_NTOR_ONION_ID, ED_CERT_KEYTYPE_ED25519, edIdentity, time.Now().Add(lifetime), nil, func(data []byte) []byte {
+		return signEd25519Expanded(a, prefix, pub, data)
+	})
+
+	return cert, signBit
+}
+
+// RFC 8032 signing, except that we already have the expanded secret key instead of a seed
+func signEd25519Expanded(a *edwards25519.Scalar, prefix, pub, message []byte) []byte {
+	h := sha512.New()
+	h.Write(prefix)
+	h.Write(message)
+	r, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		panic(err)
+	}
+	R := edwards25519.NewIdentityPoint().ScalarBaseMult(r).Bytes()
+
+	h.Reset()
+	h.Write(R)
+	h.Write(pub)
+	h.Write(message)
+	k, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		panic(err)
+	}
+	S := edwards25519.NewScalar().MultiplyAdd(k, a, r)
+
+	sig := make([]byte, 0, 64)
+	sig = append(sig, R...)
+	return append(sig, S.Bytes()...)
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"filippo.io/edwards25519"
+	"golang.org/x/crypto/curve25519"
+	"testing"
+	"time"
+)
+
+func TestEd25519CertRoundTrip(t *testing.T) {
+	_, master, _ := ed25519.GenerateKey(rand.Reader)
+	signingPub, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	data := NewEd25519Cert(CERTTYPE_ED_ID_SIGNING, ED_CERT_KEYTYPE_ED25519, signingPub, time.Hour, master, true)
+	cert, err := ParseEd25519Cert(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.CertType != CERTTYPE_ED_ID_SIGNING || cert.KeyType != ED_CERT_KEYTYPE_ED25519 {
+		t.Errorf("wrong types %d/%d", cert.CertType, cert.KeyType)
+	}
+	if !bytes.Equal(cert.CertifiedKey[:], signingPub) {
+		t.Error("certified key mismatch")
+	}
+	if !bytes.Equal(cert.SignedWith, master.Public().(ed25519.PublicKey)) {
+		t.Error("signed-with-key extension mismatch")
+	}
+	if err := cert.CheckSignature(master.Public().(ed25519.PublicKey)); err != nil {
+		t.Error(err)
+	}
+	if err := cert.CheckSignature(signingPub); err == nil {
+		t.Error("signature verified with the wrong key")
+	}
+
+	data[10] ^= 1
+	cert, err = ParseEd25519Cert(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.CheckSignature(master.Public().(ed25519.PublicKey)); err == nil {
+		t.Error("tampered certificate verified")
+	}
+
+	if _, err := ParseEd25519Cert(data[:50]); err == nil {
+		t.Error("truncated certificate parsed")
+	}
+}
+
+func TestValidateEd25519Certs(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	otherRSA, _ := rsa.GenerateKey(rand.Reader, 1024)
+	_, master, _ := ed25519.GenerateKey(rand.Reader)
+	_, signing, _ := ed25519.GenerateKey(rand.Reader)
+	masterPub := master.Public().(ed25519.PublicKey)
+
+	linkDER := []byte("not really a certificate")
+	linkDigest := sha256.Sum256(linkDER)
+
+	var certs [8][]byte
+	certs[CERTTYPE_ED_ID_SIGNING] = NewEd25519Cert(CERTTYPE_ED_ID_SIGNING, ED_CERT_KEYTYPE_ED25519, signing.Public().(ed25519.PublicKey), 24*time.Hour, master, true)
+	certs[CERTTYPE_ED_SIGNING_LINK] = NewEd25519Cert(CERTTYPE_ED_SIGNING_LINK, ED_CERT_KEYTYPE_SHA256_X509, linkDigest[:], 24*time.Hour, signing, false)
+	cross, err := NewRSAEdCrossCert(masterPub, 24*time.Hour, rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs[CERTTYPE_RSA_ED_CROSSCERT] = cross
+
+	now := time.Now()
+	identity, err := validateEd25519Certs(certs, &rsaKey.PublicKey, true, linkDER, now)
+	expectCertsCheck(t, err, 0)
+	if !bytes.Equal(identity, masterPub) {
+		t.Error("wrong identity returned")
+	}
+
+	_, err = validateEd25519Certs(certs, &otherRSA.PublicKey, true, linkDER, now)
+	expectCertsCheck(t, err, CERTS_BAD_CROSSCERT)
+	_, err = validateEd25519Certs(certs, &rsaKey.PublicKey, true, []byte("another certificate"), now)
+	expectCertsCheck(t, err, CERTS_LINK_MISMATCH)
+	_, err = validateEd25519Certs(certs, &rsaKey.PublicKey, true, linkDER, now.Add(48*time.Hour))
+	expectCertsCheck(t, err, CERTS_NOT_VALID_NOW)
+	_, err = validateEd25519Certs(certs, &rsaKey.PublicKey, false, nil, now)
+	expectCertsCheck(t, err, CERTS_MISSING)
+
+	_, otherSigning, _ := ed25519.GenerateKey(rand.Reader)
+	certs[CERTTYPE_ED_SIGNING_LINK] = NewEd25519Cert(CERTTYPE_ED_SIGNING_LINK, ED_CERT_KEYTYPE_SHA256_X509, linkDigest[:], 24*time.Hour, otherSigning, false)
+	_, err = validateEd25519Certs(certs, &rsaKey.PublicKey, true, linkDER, now)
+	expectCertsCheck(t, err, CERTS_NOT_SIGNED_BY_SIGNING_KEY)
+}
+
+func TestNtorCrossCert(t *testing.T) {
+	var ntorPrivate [32]byte
+	rand.Read(ntorPrivate[:])
+	ntorPublic, _ := curve25519.X25519(ntorPrivate[:], curve25519.Basepoint)
+	identity, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	data, signBit := NewNtorCrossCert(ntorPrivate, identity, time.Hour)
+	cert, err := ParseEd25519Cert(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cert.CertifiedKey[:], identity) {
+		t.Error("certified key mismatch")
+	}
+
+	// Recover the ed25519 key the way a verifier would: from the curve25519 key and the sign bit
+	a, _ := edwards25519.NewScalar().SetBytesWithClamping(ntorPrivate[:])
+	point := edwards25519.NewIdentityPoint().ScalarBaseMult(a)
+	if !bytes.Equal(point.BytesMontgomery(), ntorPublic) {
+		t.Fatal("derived key does not match the ntor key")
+	}
+	edKey := point.Bytes()
+	if edKey[31]>>7 != signBit {
+		t.Error("wrong sign bit")
+	}
+	if err := cert.CheckSignature(ed25519.PublicKey(edKey)); err != nil {
+		t.Error(err)
+	}
+}
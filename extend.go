@@ -6,6 +6,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"log"
 )
 
@@ -52,6 +53,8 @@ func (c *OnionConnection) handleRelayExtend(circ *Circuit, cell *RelayCell) Acti
 	circReq.newHandshake = false
 	circReq.localID = circ.id
 	circReq.handshakeState = &CircuitHandshakeState{}
+	circReq.handshakeState.startDeadline(c.parentOR.config.circuitBuildTimeout())
+	circReq.handshakeState.attach(c.circuitReadQueue, circ.id)
 
 	circ.extendState = circReq.handshakeState
 
@@ -141,6 +144,8 @@ func (c *OnionConnection) handleRelayExtend2(circ *Circuit, cell *RelayCell) Act
 	circReq.successQueue = c.circuitReadQueue
 	circReq.localID = circ.id
 	circReq.handshakeState = &CircuitHandshakeState{}
+	circReq.handshakeState.startDeadline(c.parentOR.config.circuitBuildTimeout())
+	circReq.handshakeState.attach(c.circuitReadQueue, circ.id)
 
 	circ.extendState = circReq.handshakeState
 
@@ -170,10 +175,16 @@ func (c *OnionConnection) handleCreated(cell Cell, newHandshake bool) Actionable
 
 	Log(LOG_CIRC, "got a created: %d", circid)
 
+	if theirs && cell.Command() == CMD_CREATED_FAST {
+		return CloseCircuit(errors.New("CREATED_FAST for a circuit we extended"), DESTROY_REASON_PROTOCOL)
+	}
+
 	data := cell.Data()
 	hlen := 148
 	pos := 0
-	if newHandshake {
+	if cell.Command() == CMD_CREATED_FAST {
+		hlen = 40
+	} else if newHandshake {
 		hlen = int(BigEndian.Uint16(data[0:2]))
 		pos = 2
 	}
@@ -194,15 +205,21 @@ func (c *OnionConnection) handleCreated(cell Cell, newHandshake bool) Actionable
 	}
 
 	if ours {
-		kdf, err := NtorClientComplete(ourCirc.extendState, hdata)
+		if ourCirc.extendState == nil {
+			Log(LOG_INFO, "Got a %s for circuit %d but we weren't expecting one", cell.Command(), circid)
+			return nil
+		}
+		kdf, err := clientCompleteHandshake(ourCirc.extendState, hdata)
 		if err != nil {
-			log.Println("finishing the ntor handshake didn't work")
+			log.Println("finishing the handshake didn't work")
 			log.Println(err)
+			ourCirc.extendState.finish(buildFailed(DESTROY_REASON_PROTOCOL, err.Error()))
+			ourCirc.extendState = nil
 			return nil
 		}
-		Log(LOG_CIRC, "finished the ntor handshake")
+		Log(LOG_CIRC, "finished the %s handshake", ourCirc.extendState.handshake)
 
-		donechan := ourCirc.extendState.whenDone
+		extendState := ourCirc.extendState
 		ourCirc.extendState = nil
 
 		//todo super hax
@@ -210,14 +227,28 @@ func (c *OnionConnection) handleCreated(cell Cell, newHandshake bool) Actionable
 		ourCirc.forwardChain = append(ourCirc.forwardChain, tempCircuit.forward)
 		ourCirc.backwardChain = append(ourCirc.backwardChain, tempCircuit.backward)
 
-		if donechan != nil {
-			donechan <- circid
-		}
+		extendState.finish(CircuitBuildResult{ID: circid})
 	}
 
 	return nil
 }
 
+// Returns the key material for the new hop, laid out as the two digest seeds followed by the two AES keys
+func clientCompleteHandshake(state *CircuitHandshakeState, reply []byte) ([]byte, error) {
+	switch state.handshake {
+	case HANDSHAKE_NTOR:
+		return NtorClientComplete(state, reply)
+	case HANDSHAKE_NTOR_V3:
+		return NtorV3ClientComplete(state, reply)
+	case HANDSHAKE_TAP:
+		return TAPClientComplete(state, reply)
+	case HANDSHAKE_FAST:
+		return FastClientComplete(state, reply)
+	default:
+		return nil, fmt.Errorf("don't know how to finish handshake %d", state.handshake)
+	}
+}
+
 func (data *CircuitCreated) Handle(c *OnionConnection, circ *Circuit) ActionableError {
 	if circ.nextHop != nil {
 		panic("We managed to create two circuits?")
@@ -230,6 +261,7 @@ func (data *CircuitCreated) Handle(c *OnionConnection, circ *Circuit) Actionable
 	circ.nextHop = extendState.nextHop
 	circ.nextHopID = extendState.nextHopID
 	circ.extendState = nil
+	extendState.finish(CircuitBuildResult{ID: circ.id})
 
 	if data.newHandshake {
 		cell := GetCellBuf(false)
@@ -246,7 +278,12 @@ func (data *CircuitCreated) Handle(c *OnionConnection, circ *Circuit) Actionable
 }
 
 func (req *CircuitRequest) Handle(c *OnionConnection, notreallyanthingatall *Circuit) ActionableError {
-	newID := c.NewCircID()
+	newID, err := c.NewCircID()
+	if err != nil {
+		Log(LOG_WARN, "Refusing a circuit request: %s", err)
+		req.fail(DESTROY_REASON_RESOURCELIMIT)
+		return nil
+	}
 
 	req.handshakeState.lock.Lock()
 	aborted := req.handshakeState.aborted
@@ -262,9 +299,15 @@ func (req *CircuitRequest) Handle(c *OnionConnection, notreallyanthingatall *Cir
 	}
 
 	var writeCell Cell
+	var extended *ProxyCircuit // Set if writeCell is an EXTEND2 for one of our circuits
 	// the payloads for CREATE and EXTEND are similar.
 	// EXTEND's payload needs layers of encryption.
-	if req.extendCircId == 0 {
+	if req.extendCircId == 0 && req.handshakeType == uint16(HANDSHAKE_FAST) {
+		c.padding.noteCircuit()
+		writeCell = NewCell(c.negotiatedVersion, newID, CMD_CREATE_FAST, nil)
+		copy(writeCell.Data(), req.handshakeData)
+	} else if req.extendCircId == 0 {
+		c.padding.noteCircuit()
 		cmd := CMD_CREATE2
 		if !req.newHandshake {
 			cmd = CMD_CREATE
@@ -281,15 +324,21 @@ func (req *CircuitRequest) Handle(c *OnionConnection, notreallyanthingatall *Cir
 	} else {
 		pc, ok := c.proxyCircuits[req.extendCircId]
 		if !ok {
-			return CloseCircuit(errors.New("missing a circ"), DESTROY_REASON_INTERNAL)
-		}
-		if &(pc.forward) == nil {
-			err := errors.New("circuit doesn't have a crypto state")
-			return CloseCircuit(err, DESTROY_REASON_INTERNAL)
+			Log(LOG_INFO, "Can't extend circuit %d: it's gone", req.extendCircId)
+			req.fail(DESTROY_REASON_INTERNAL)
+			return nil
 		}
 		if pc.extendState != nil {
-			return CloseCircuit(errors.New("already extending"), DESTROY_REASON_INTERNAL)
+			Log(LOG_INFO, "Can't extend circuit %d: already extending", req.extendCircId)
+			req.fail(DESTROY_REASON_INTERNAL)
+			return nil
 		}
+		if pc.relayEarlyCount >= MAX_RELAY_EARLY {
+			Log(LOG_INFO, "Can't extend circuit %d: no RELAY_EARLY cells left", req.extendCircId)
+			req.fail(DESTROY_REASON_INTERNAL)
+			return nil
+		}
+		pc.relayEarlyCount++
 		writeCell = NewCell(c.negotiatedVersion, req.extendCircId, CMD_RELAY_EARLY, nil)
 		data := writeCell.Data()
 		data[0] = byte(RELAY_EXTEND2)
@@ -317,13 +366,15 @@ func (req *CircuitRequest) Handle(c *OnionConnection, notreallyanthingatall *Cir
 		}
 
 		pc.extendState = req.handshakeState
-
+		req.handshakeState.attach(c.circuitReadQueue, pc.id)
+		extended = pc
 	}
 
 	// if we're sending a CREATE, we need to make a new circuit on our end
 	// otherwise, we're EXTENDing an existing circuit
 	if req.weAreInitiator {
 		if req.extendCircId == 0 {
+			c.markClientUsed()
 			c.proxyCircuits[writeCell.CircID()] = &ProxyCircuit{
 				Circuit: Circuit{
 					id:             writeCell.CircID(),
@@ -333,6 +384,7 @@ func (req *CircuitRequest) Handle(c *OnionConnection, notreallyanthingatall *Cir
 				},
 				pendingStreams: make(map[StreamID]*PendingStream),
 			}
+			req.handshakeState.attach(c.circuitReadQueue, writeCell.CircID())
 		}
 	} else {
 		// XXX if they send data before the created2, it'll nicely work
@@ -343,7 +395,12 @@ func (req *CircuitRequest) Handle(c *OnionConnection, notreallyanthingatall *Cir
 		}
 	}
 
-	c.writeQueue <- writeCell.Bytes()
+	if extended != nil {
+		// A relay cell like any other, so it goes behind whatever the circuit already has queued
+		c.circQueues.enqueue(extended.id, extended.backwardWindow, writeCell.Bytes())
+	} else {
+		c.writeQueue <- writeCell.Bytes()
+	}
 
 	return nil
 }
@@ -7,22 +7,47 @@ package main
 import (
 	"bytes"
 	"crypto/hmac"
+	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/x509"
 	"errors"
-	"github.com/tvdw/openssl"
+	"fmt"
 	"hash"
 	"io"
 	"net"
 	"time"
 )
 
-const OUR_MIN_VERSION = 4
-const OUR_MAX_VERSION = 4
+const OUR_MIN_VERSION = 3
+const OUR_MAX_VERSION = 5
 
 type LinkVersion uint16
 
-func (c *OnionConnection) negotiateVersionServer(conn io.Reader) error {
+// Link protocol 5 introduced PADDING_NEGOTIATE. Older links must never see it.
+func (v LinkVersion) SupportsPaddingNegotiate() bool {
+	return v >= 5
+}
+
+// versionsCell builds a VERSIONS cell listing everything we support. VERSIONS always uses 2-byte circuit IDs.
+func versionsCell() []byte {
+	writeCell := GetCellBuf(false)
+	writeCell = writeCell[0 : 5+(2*(OUR_MAX_VERSION-OUR_MIN_VERSION+1))]
+	writeCell[0] = 0
+	writeCell[1] = 0
+	writeCell[2] = byte(CMD_VERSIONS)
+	writeCell[3] = 0
+	writeCell[4] = 2 * (OUR_MAX_VERSION - OUR_MIN_VERSION + 1)
+	for i, v := 0, OUR_MIN_VERSION; v <= OUR_MAX_VERSION; v++ {
+		writeCell[5+i] = 0
+		writeCell[6+i] = byte(v)
+
+		i += 2
+	}
+	return writeCell
+}
+
+func (c *OnionConnection) negotiateVersionServer(conn io.Reader, readHash, writeHash hash.Hash) error {
 	readCell := GetCellBuf(false)
 	defer ReturnCellBuf(readCell)
 
@@ -71,22 +96,20 @@ func (c *OnionConnection) negotiateVersionServer(conn io.Reader) error {
 	}
 
 	if bestVersion == 0 {
-		ssl := conn.(*openssl.Conn)
-		Log(LOG_INFO, "unknown versions data: %v %v", buf, ssl.RemoteAddr())
+		if netConn, ok := conn.(net.Conn); ok {
+			Log(LOG_INFO, "unknown versions data: %v %v", buf, netConn.RemoteAddr())
+		}
 		return errors.New("Failed to negotiate a version")
 	}
 
 	c.negotiatedVersion = bestVersion
 
-	writeCell := GetCellBuf(false)
-	writeCell = writeCell[0:7]
-	writeCell[0] = 0
-	writeCell[1] = 0
-	writeCell[2] = byte(CMD_VERSIONS)
-	writeCell[3] = 0
-	writeCell[4] = 2
-	BigEndian.PutUint16(writeCell[5:7], uint16(c.negotiatedVersion))
+	readHash.Write(readCell[0:5])
+	readHash.Write(buf)
 
+	// Tell them everything we support: they will arrive at the same version we did
+	writeCell := versionsCell()
+	writeHash.Write(writeCell)
 	c.writeQueue <- writeCell
 
 	return nil
@@ -94,19 +117,7 @@ func (c *OnionConnection) negotiateVersionServer(conn io.Reader) error {
 
 func (c *OnionConnection) negotiateVersionClient(conn io.Reader, readHash, writeHash hash.Hash) error {
 	// Send a VERSIONS cell with the versions we support, then wait for their reply
-	writeCell := GetCellBuf(false)
-	writeCell = writeCell[0 : 5+(2*(OUR_MAX_VERSION-OUR_MIN_VERSION+1))]
-	writeCell[0] = 0
-	writeCell[1] = 0
-	writeCell[2] = byte(CMD_VERSIONS)
-	writeCell[3] = 0
-	writeCell[4] = 2 * (OUR_MAX_VERSION - OUR_MIN_VERSION + 1)
-	for i, v := 0, OUR_MIN_VERSION; v <= OUR_MAX_VERSION; v++ {
-		writeCell[5+i] = 0
-		writeCell[6+i] = byte(v)
-
-		i += 2
-	}
+	writeCell := versionsCell()
 	writeHash.Write(writeCell)
 	c.writeQueue <- writeCell
 
@@ -131,6 +142,9 @@ func (c *OnionConnection) negotiateVersionClient(conn io.Reader, readHash, write
 	if length > 1024 {
 		return errors.New("incredibly long VERSIONS cell found")
 	}
+	if length%2 != 0 {
+		return errors.New("VERSIONS cell has an odd length")
+	}
 
 	readBuf := make([]byte, length)
 	gotBytes = 0
@@ -161,30 +175,42 @@ func (c *OnionConnection) negotiateVersionClient(conn io.Reader, readHash, write
 }
 
 func (c *OnionConnection) sendCerts(writeHash hash.Hash) error { // Now that we've established a version, we need to send our CERTS
-	var der1, der2 []byte
-	var type1, type2 byte
+	type certEntry struct {
+		certType byte
+		der      []byte
+	}
+	var certs []certEntry
 	if c.isOutbound {
-		type1 = 3
-		der1 = c.usedTLSCtx.AuthCertDER
+		// Ed25519 certificates would require an ed25519 AUTHENTICATE, which we don't do yet
+		certs = []certEntry{
+			{CERTTYPE_AUTH, c.usedTLSCtx.AuthCertDER},
+			{CERTTYPE_ID, c.usedTLSCtx.IdCertDER},
+		}
 	} else {
-		type1 = 1
-		der1 = c.usedTLSCtx.LinkCertDER
+		certs = []certEntry{
+			{CERTTYPE_LINK, c.usedTLSCtx.LinkCertDER},
+			{CERTTYPE_ID, c.usedTLSCtx.IdCertDER},
+			{CERTTYPE_ED_ID_SIGNING, c.usedTLSCtx.EdSigningCert},
+			{CERTTYPE_ED_SIGNING_LINK, c.usedTLSCtx.EdLinkCert},
+			{CERTTYPE_RSA_ED_CROSSCERT, c.usedTLSCtx.EdCrossCert},
+		}
 	}
-	type2 = 2
-	der2 = c.usedTLSCtx.IdCertDER
 
-	certsLen := 1 + (1 + 2 + len(der1)) + (1 + 2 + len(der2))
+	certsLen := 1
+	for _, cert := range certs {
+		certsLen += 1 + 2 + len(cert.der)
+	}
 	cell := NewVarCell(c.negotiatedVersion, 0, CMD_CERTS, nil, certsLen)
 	buf := cell.Data() // XXX we still have the 2 length bytes there, lol
 
-	buf[2] = 2 // 2 certs
-	buf[3] = type1
-	BigEndian.PutUint16(buf[4:6], uint16(len(der1)))
-	copy(buf[6:], der1)
-	ptr := 6 + len(der1)
-	buf[ptr] = type2
-	BigEndian.PutUint16(buf[ptr+1:ptr+3], uint16(len(der2)))
-	copy(buf[ptr+3:], der2)
+	buf[2] = byte(len(certs))
+	ptr := 3
+	for _, cert := range certs {
+		buf[ptr] = cert.certType
+		BigEndian.PutUint16(buf[ptr+1:ptr+3], uint16(len(cert.der)))
+		copy(buf[ptr+3:], cert.der)
+		ptr += 3 + len(cert.der)
+	}
 
 	if writeHash != nil {
 		writeHash.Write(cell.Bytes())
@@ -196,25 +222,14 @@ func (c *OnionConnection) sendCerts(writeHash hash.Hash) error { // Now that we'
 
 func (c *OnionConnection) sendNetinfo(writeHash hash.Hash) error {
 	cell := NewCell(c.negotiatedVersion, 0, CMD_NETINFO, nil)
-	buf := cell.Data()
-
-	// XXX TODO
-	t := time.Now().Unix()
-	BigEndian.PutUint32(buf[0:4], uint32(t))
-	buf[4] = 4
-	buf[5] = 4
-	buf[6] = 10
-	buf[7] = 0
-	buf[8] = 0
-	buf[9] = 1
-
-	myIP := net.ParseIP(c.parentOR.config.Address)
-	buf[10] = 1
-	buf[11] = 4
-	buf[12] = 4
-
-	ip := myIP.To4()
-	copy(buf[13:], ip) //XXX v6
+
+	var myAddresses []net.IP
+	if addr := c.parentOR.Address(); addr != nil {
+		myAddresses = append(myAddresses, addr)
+	}
+	if err := buildNetinfo(cell.Data(), time.Now(), c.theirAddress, myAddresses); err != nil {
+		return err
+	}
 
 	if writeHash != nil { // XXX
 		writeHash.Write(cell.Bytes())
@@ -224,7 +239,31 @@ func (c *OnionConnection) sendNetinfo(writeHash hash.Hash) error {
 	return nil
 }
 
-func (c *OnionConnection) sendAuthChallenge() error {
+func (c *OnionConnection) handleNetinfo(cell Cell) error {
+	info, err := parseNetinfo(cell.Data())
+	if err != nil {
+		return err
+	}
+
+	c.theirAddresses = info.MyAddresses
+
+	// Unauthenticated peers could make us believe anything about our clock
+	if c.theyAuthenticated && !info.Timestamp.IsZero() {
+		now := time.Now()
+		c.parentOR.noteClockSkew(info.ClockSkew(now), c, now)
+	}
+
+	// Only relays we connected to ourselves get a say in what our address is: anyone can connect to us and lie
+	if c.isOutbound && c.theyAuthenticated && info.OtherAddress != nil {
+		if c.parentOR.addressGuess.Report(c.theirFingerprint, info.OtherAddress) {
+			Log(LOG_NOTICE, "Our peers think our address is %s", info.OtherAddress)
+		}
+	}
+
+	return nil
+}
+
+func (c *OnionConnection) sendAuthChallenge(writeHash hash.Hash) error {
 	var buf bytes.Buffer
 	if c.negotiatedVersion >= 4 {
 		buf.Write([]byte{0, 0}) // XXX This is a pretty dirty hack. use NewVarCell() instead
@@ -236,12 +275,13 @@ func (c *OnionConnection) sendAuthChallenge() error {
 	buf.Write(challenge[:])
 	buf.Write([]byte{0, 1, 0, 1})
 
+	writeHash.Write(buf.Bytes())
 	c.writeQueue <- buf.Bytes()
 
 	return nil
 }
 
-func (c *OnionConnection) handleAuthChallenge(cell Cell, hashInbound, hashOutbound hash.Hash, conn *openssl.Conn) error {
+func (c *OnionConnection) handleAuthChallenge(cell Cell, hashInbound, hashOutbound hash.Hash, conn TLSConn) error {
 	if c.weAuthenticated {
 		return errors.New("But we already authenticated...")
 	}
@@ -288,21 +328,18 @@ func (c *OnionConnection) handleAuthChallenge(cell Cell, hashInbound, hashOutbou
 	buf.Write(hashInbound.Sum(nil))
 	buf.Write(hashOutbound.Sum(nil))
 
-	theirCert, err := conn.PeerCertificate()
-	if err != nil {
-		return err
-	}
-	DER, err := theirCert.MarshalDER()
+	DER, err := conn.PeerCertificateDER()
 	if err != nil {
 		return err
 	}
 	sha.Write(DER)
 	buf.Write(sha.Sum(nil))
 
-	mac := hmac.New(sha256.New, conn.GetTLSSecret())
-	mac.Write(conn.GetClientServerHelloRandom())
-	mac.Write([]byte("Tor V3 handshake TLS cross-certification\x00"))
-	buf.Write(mac.Sum(nil))
+	tlsSecrets, err := auth0001TLSSecrets(conn)
+	if err != nil {
+		return err
+	}
+	buf.Write(tlsSecrets)
 
 	// Add 24 random bytes
 	var rand [24]byte
@@ -313,7 +350,7 @@ func (c *OnionConnection) handleAuthChallenge(cell Cell, hashInbound, hashOutbou
 	sha.Reset()
 	sha.Write(buf.Bytes()[4:])
 	digest := sha.Sum(nil)
-	sig, err := c.usedTLSCtx.AuthKey.PrivateEncrypt(digest[:])
+	sig, err := rsaSignRaw(c.usedTLSCtx.AuthKey, digest[:])
 	if err != nil {
 		return err
 	}
@@ -327,76 +364,190 @@ func (c *OnionConnection) handleAuthChallenge(cell Cell, hashInbound, hashOutbou
 	return nil
 }
 
-func (c *OnionConnection) handleCerts(cell Cell, cert *openssl.Certificate) error {
+// The TLSSECRETS field of AUTH0001, which binds the AUTHENTICATE cell to this TLS session
+func auth0001TLSSecrets(conn TLSConn) ([]byte, error) {
+	secret, err := conn.TLSSecret()
+	if err != nil {
+		return nil, err
+	}
+	randoms, err := conn.ClientServerRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(randoms)
+	mac.Write([]byte("Tor V3 handshake TLS cross-certification\x00"))
+	return mac.Sum(nil), nil
+}
+
+func (c *OnionConnection) handleCerts(cell Cell, peerCertDER []byte) error {
+	if c.theirFingerprint256 != nil {
+		return certsError(CERTS_MALFORMED, 0, "duplicate CERTS cell")
+	}
+
 	data := cell.Data()
 	if len(data) < 3 {
-		return errors.New("way too short")
+		return certsError(CERTS_MALFORMED, 0, "way too short")
 	}
 
-	var typeHad [4]bool
-	var fp Fingerprint
-	var fp256 []byte
+	var certs [4]*x509.Certificate
+	var edCerts [8][]byte
+	haveEdCerts := false
 
 	numCerts := int(data[2])
 	readPos := 3
 	for i := 0; i < numCerts; i++ {
 		if len(data) < readPos+3 {
-			return errors.New("malformed CERTS")
+			return certsError(CERTS_MALFORMED, 0, "truncated certificate header")
 		}
 
 		cType := data[readPos]
-		if cType < 1 || cType > 3 {
-			return errors.New("no idea what to do with that certificate")
+		length := int(BigEndian.Uint16(data[readPos+1 : readPos+3]))
+		readPos += 3
+		if len(data) < readPos+length {
+			return certsError(CERTS_MALFORMED, cType, "truncated certificate")
 		}
+		certData := data[readPos : readPos+length]
+		readPos += length
 
-		if typeHad[cType] {
-			return errors.New("duplicate certificate in CERTS")
+		if cType >= CERTTYPE_ED_ID_SIGNING && cType <= CERTTYPE_RSA_ED_CROSSCERT {
+			if edCerts[cType] != nil {
+				return certsError(CERTS_MALFORMED, cType, "duplicate certificate in CERTS")
+			}
+			edCerts[cType] = certData
+			haveEdCerts = true
+			continue
 		}
-		typeHad[cType] = true
 
-		length := int(BigEndian.Uint16(data[readPos+1 : readPos+3]))
-		readPos += 3
-		if len(data) < readPos+length {
-			return errors.New("malformed CERTS")
+		if cType < CERTTYPE_LINK || cType > CERTTYPE_AUTH {
+			Log(LOG_INFO, "ignoring unknown certificate type %d in CERTS", cType)
+			continue
 		}
 
-		theCert, err := openssl.LoadCertificateFromDER(data[readPos : readPos+length])
+		if certs[cType] != nil {
+			return certsError(CERTS_MALFORMED, cType, "duplicate certificate in CERTS")
+		}
+
+		theCert, err := x509.ParseCertificate(certData)
 		if err != nil {
-			return err
+			return certsError(CERTS_MALFORMED, cType, "%s", err)
 		}
+		certs[cType] = theCert
+	}
 
-		// XXX todo: lots of checks
+	if c.isOutbound && peerCertDER == nil {
+		return errors.New("no TLS peer certificate to check CERTS against")
+	}
 
-		if cType == 2 { // ID
-			// Find the fingerprint
-			pubkey, err := theCert.PublicKey()
-			if err != nil {
-				return err
-			}
+	if err := validateRSACerts(certs, c.isOutbound, peerCertDER, time.Now()); err != nil {
+		return err
+	}
 
-			keyDer, err := pubkey.MarshalPKCS1PublicKeyDER()
-			if err != nil {
-				return err
-			}
+	if haveEdCerts {
+		edIdentity, err := validateEd25519Certs(edCerts, certs[CERTTYPE_ID].PublicKey.(*rsa.PublicKey), c.isOutbound, peerCertDER, time.Now())
+		if err != nil {
+			return err
+		}
+		c.theirEdIdentity = edIdentity
+	}
 
-			fingerprint := sha1.Sum(keyDer)
-			copy(fp[:], fingerprint[:])
+	Log(LOG_CIRC, "CERTS are looking good")
 
-			sha := sha256.New()
-			sha.Write(keyDer)
-			fp256 = sha.Sum(nil)
+	// Find the fingerprint
+	c.theirIdentityKey = certs[CERTTYPE_ID].PublicKey.(*rsa.PublicKey)
+	keyDer := x509.MarshalPKCS1PublicKey(c.theirIdentityKey)
+	fingerprint := sha1.Sum(keyDer)
+	fp256 := sha256.Sum256(keyDer)
+	copy(c.theirFingerprint[:], fingerprint[:])
+	c.theirFingerprint256 = fp256[:]
+
+	if certs[CERTTYPE_AUTH] != nil {
+		// Only needed to check the signature on their AUTHENTICATE cell
+		authKey, ok := certs[CERTTYPE_AUTH].PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return certsError(CERTS_MALFORMED, CERTTYPE_AUTH, "AUTH certificate without an RSA key")
 		}
+		c.theirAuthKey = authKey
+	}
 
-		readPos += length
+	// As the initiator the TLS link proves who they are. As the responder we still need their AUTHENTICATE
+	if c.isOutbound {
+		c.theyAuthenticated = true
 	}
 
-	Log(LOG_CIRC, "CERTS are looking good")
+	return nil
+}
 
-	if typeHad[2] { // ID
-		c.theyAuthenticated = true
-		copy(c.theirFingerprint[:], fp[:])
-		c.theirFingerprint256 = fp256
+func (c *OnionConnection) handleAuthenticate(cell Cell, hashInbound, hashOutbound hash.Hash, conn TLSConn) error {
+	if c.isOutbound {
+		return errors.New("only initiators send AUTHENTICATE")
+	}
+	if c.theyAuthenticated {
+		return errors.New("they already authenticated")
+	}
+	if c.theirAuthKey == nil || c.theirFingerprint256 == nil {
+		return errors.New("AUTHENTICATE without the certificates to back it up")
+	}
+
+	// Again including the 2 length bytes of the varlen cell
+	data := cell.Data()
+	if len(data) < 6 {
+		return errors.New("AUTHENTICATE cell too short")
+	}
+	authType := BigEndian.Uint16(data[2:4])
+	authLen := int(BigEndian.Uint16(data[4:6]))
+	if authType != 1 {
+		return fmt.Errorf("unsupported AUTHENTICATE type %d", authType)
+	}
+	if len(data) < 6+authLen {
+		return errors.New("malformed AUTHENTICATE cell")
+	}
+
+	// TYPE(8) CID(32) SID(32) SLOG(32) CLOG(32) SCERT(32) TLSSECRETS(32) RAND(24) SIG(rest)
+	auth := data[6 : 6+authLen]
+	if len(auth) < 224+1 {
+		return errors.New("AUTHENTICATE body too short")
 	}
 
+	if !bytes.Equal(auth[0:8], []byte("AUTH0001")) {
+		return errors.New("AUTHENTICATE body is not AUTH0001")
+	}
+	if !hmac.Equal(auth[8:40], c.theirFingerprint256) {
+		return errors.New("AUTHENTICATE CID does not match their CERTS")
+	}
+	if !hmac.Equal(auth[40:72], c.usedTLSCtx.Fingerprint256) {
+		return errors.New("AUTHENTICATE SID is not us")
+	}
+	if !hmac.Equal(auth[72:104], hashOutbound.Sum(nil)) {
+		return errors.New("AUTHENTICATE SLOG mismatch")
+	}
+	if !hmac.Equal(auth[104:136], hashInbound.Sum(nil)) {
+		return errors.New("AUTHENTICATE CLOG mismatch")
+	}
+
+	scert := sha256.Sum256(c.usedTLSCtx.LinkCertDER)
+	if !hmac.Equal(auth[136:168], scert[:]) {
+		return errors.New("AUTHENTICATE SCERT is not our link certificate")
+	}
+
+	tlsSecrets, err := auth0001TLSSecrets(conn)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(auth[168:200], tlsSecrets) {
+		return errors.New("AUTHENTICATE TLSSECRETS mismatch")
+	}
+
+	// RAND is auth[200:224], the signature covers everything before SIG
+	digest := sha256.Sum256(auth[0:224])
+	if err := rsa.VerifyPKCS1v15(c.theirAuthKey, 0, digest[:], auth[224:]); err != nil {
+		return fmt.Errorf("AUTHENTICATE signature did not verify: %s", err)
+	}
+
+	Log(LOG_CIRC, "AUTHENTICATE is looking good")
+
+	c.theyAuthenticated = true
+
 	return nil
 }
@@ -0,0 +1,223 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"testing"
+)
+
+// A VERSIONS cell claiming the given body length, followed by the versions
+func testVersionsCell(length int, versions ...uint16) []byte {
+	cell := []byte{0, 0, byte(CMD_VERSIONS), byte(length >> 8), byte(length)}
+	for _, v := range versions {
+		cell = append(cell, byte(v>>8), byte(v))
+	}
+	return cell
+}
+
+func TestVersionsCell(t *testing.T) {
+	expected := testVersionsCell(6, 3, 4, 5)
+	if cell := versionsCell(); !bytes.Equal(cell, expected) {
+		t.Errorf("expected VERSIONS cell %x, got %x", expected, cell)
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		cell     []byte
+		expected LinkVersion // 0 if negotiation should fail
+	}{
+		{"all of ours", testVersionsCell(6, 3, 4, 5), 5},
+		{"best in common", testVersionsCell(8, 1, 2, 4, 9), 4},
+		{"only v3", testVersionsCell(2, 3), 3},
+		{"too old", testVersionsCell(4, 1, 2), 0},
+		{"too new", testVersionsCell(4, 6, 7), 0},
+		{"empty", testVersionsCell(0), 0},
+		{"odd length", append(testVersionsCell(3, 4), 5), 0},
+		{"oversize", testVersionsCell(1026, make([]uint16, 513)...), 0},
+	}
+
+	for _, test := range tests {
+		for _, server := range []bool{true, false} {
+			c := &OnionConnection{writeQueue: make(chan []byte, 1)}
+			readHash, writeHash := sha256.New(), sha256.New()
+			var err error
+			if server {
+				err = c.negotiateVersionServer(bytes.NewReader(test.cell), readHash, writeHash)
+			} else {
+				err = c.negotiateVersionClient(bytes.NewReader(test.cell), readHash, writeHash)
+			}
+
+			if test.expected == 0 {
+				if err == nil {
+					t.Errorf("%s (server=%t): negotiated version %d, expected a failure", test.name, server, c.negotiatedVersion)
+				}
+				continue
+			}
+			if err != nil || c.negotiatedVersion != test.expected {
+				t.Errorf("%s (server=%t): expected version %d, got %d (%v)", test.name, server, test.expected, c.negotiatedVersion, err)
+				continue
+			}
+
+			// Both sides send everything they support, and it all goes into the transcript
+			if sent := <-c.writeQueue; !bytes.Equal(sent, versionsCell()) {
+				t.Errorf("%s (server=%t): sent %x instead of our VERSIONS cell", test.name, server, sent)
+			}
+			expectedRead, expectedWrite := sha256.Sum256(test.cell), sha256.Sum256(versionsCell())
+			if !bytes.Equal(readHash.Sum(nil), expectedRead[:]) || !bytes.Equal(writeHash.Sum(nil), expectedWrite[:]) {
+				t.Errorf("%s (server=%t): VERSIONS cells missing from the handshake transcript", test.name, server)
+			}
+		}
+	}
+}
+
+func TestPaddingNegotiateNeedsV5(t *testing.T) {
+	for _, version := range []LinkVersion{3, 4, 5} {
+		c := &OnionConnection{negotiatedVersion: version, padding: newChannelPadding()}
+		c.padding.start(PADDING_ITO_LOW_DEFAULT, PADDING_ITO_HIGH_DEFAULT)
+		c.padding.noteCircuit()
+
+		cell := NewCell(version, 0, CMD_PADDING_NEGOTIATE, nil)
+		cell.Data()[0] = 0
+		cell.Data()[1] = PADDING_NEGOTIATE_STOP
+		if err := c.routeCellToFunction(cell); err != nil {
+			t.Fatalf("v%d: %s", version, err)
+		}
+
+		_, padding := c.padding.timeout()
+		if version < 5 && !padding {
+			t.Errorf("v%d: PADDING_NEGOTIATE was not dropped", version)
+		}
+		if version >= 5 && padding {
+			t.Errorf("v%d: PADDING_NEGOTIATE was ignored", version)
+		}
+	}
+}
+
+// Just enough of a TLS connection for AUTH0001
+type testTLSConn struct {
+	net.Conn
+	secret, randoms []byte
+}
+
+func (c *testTLSConn) PeerCertificateDER() ([]byte, error) {
+	return nil, errors.New("no peer certificate")
+}
+
+func (c *testTLSConn) TLSSecret() ([]byte, error) {
+	return c.secret, nil
+}
+
+func (c *testTLSConn) ClientServerRandom() ([]byte, error) {
+	return c.randoms, nil
+}
+
+func TestHandleAuthenticate(t *testing.T) {
+	authKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ourTLS := &TorTLS{Fingerprint256: make([]byte, 32), LinkCertDER: []byte("our link certificate")}
+	CRandBytes(ourTLS.Fingerprint256)
+	theirFingerprint256 := make([]byte, 32)
+	CRandBytes(theirFingerprint256)
+	conn := &testTLSConn{secret: []byte("master secret"), randoms: make([]byte, 64)}
+	CRandBytes(conn.randoms)
+
+	// What they sent us and what we sent them, so far
+	hashInbound, hashOutbound := sha256.New(), sha256.New()
+	hashInbound.Write([]byte("VERSIONS CERTS NETINFO from them"))
+	hashOutbound.Write([]byte("VERSIONS CERTS AUTH_CHALLENGE NETINFO from us"))
+
+	// An AUTH0001 body as an honest initiator builds it
+	var auth bytes.Buffer
+	auth.WriteString("AUTH0001")
+	auth.Write(theirFingerprint256)
+	auth.Write(ourTLS.Fingerprint256)
+	auth.Write(hashOutbound.Sum(nil))
+	auth.Write(hashInbound.Sum(nil))
+	scert := sha256.Sum256(ourTLS.LinkCertDER)
+	auth.Write(scert[:])
+	mac := hmac.New(sha256.New, conn.secret)
+	mac.Write(conn.randoms)
+	mac.Write([]byte("Tor V3 handshake TLS cross-certification\x00"))
+	auth.Write(mac.Sum(nil))
+	var random [24]byte
+	CRandBytes(random[:])
+	auth.Write(random[:])
+	digest := sha256.Sum256(auth.Bytes())
+	sig, err := rsa.SignPKCS1v15(rand.Reader, authKey, 0, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.Write(sig)
+	valid := auth.Bytes()
+
+	tests := []struct {
+		name     string
+		tamper   int // Offset of a byte in the body to flip, or -1
+		body     []byte
+		outbound bool
+		ok       bool
+	}{
+		{"valid", -1, valid, false, true},
+		{"wrong type", 7, valid, false, false},
+		{"CID", 8, valid, false, false},
+		{"SID", 40, valid, false, false},
+		{"SLOG", 72, valid, false, false},
+		{"CLOG", 104, valid, false, false},
+		{"SCERT", 136, valid, false, false},
+		{"TLSSECRETS", 168, valid, false, false},
+		{"RAND", 200, valid, false, false},
+		{"signature", len(valid) - 1, valid, false, false},
+		{"short body", -1, valid[:224], false, false},
+		{"outbound", -1, valid, true, false},
+	}
+
+	for _, test := range tests {
+		body := append([]byte(nil), test.body...)
+		if test.tamper >= 0 {
+			body[test.tamper] ^= 1
+		}
+		data := append([]byte{0, 1, byte(len(body) >> 8), byte(len(body))}, body...)
+		cell := NewVarCell(4, 0, CMD_AUTHENTICATE, data, 0)
+
+		c := &OnionConnection{
+			negotiatedVersion:   4,
+			isOutbound:          test.outbound,
+			usedTLSCtx:          ourTLS,
+			theirFingerprint256: theirFingerprint256,
+			theirAuthKey:        &authKey.PublicKey,
+		}
+		err := c.handleAuthenticate(cell, hashInbound, hashOutbound, conn)
+		if test.ok && (err != nil || !c.theyAuthenticated) {
+			t.Errorf("%s: AUTHENTICATE refused: %v", test.name, err)
+		}
+		if !test.ok && (err == nil || c.theyAuthenticated) {
+			t.Errorf("%s: AUTHENTICATE accepted", test.name)
+		}
+	}
+
+	// Authenticating twice makes no sense either
+	c := &OnionConnection{
+		negotiatedVersion:   4,
+		usedTLSCtx:          ourTLS,
+		theirFingerprint256: theirFingerprint256,
+		theirAuthKey:        &authKey.PublicKey,
+		theyAuthenticated:   true,
+	}
+	data := append([]byte{0, 1, byte(len(valid) >> 8), byte(len(valid))}, valid...)
+	if err := c.handleAuthenticate(NewVarCell(4, 0, CMD_AUTHENTICATE, data, 0), hashInbound, hashOutbound, conn); err == nil {
+		t.Error("accepted a second AUTHENTICATE")
+	}
+}
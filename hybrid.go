@@ -5,14 +5,21 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
 	"github.com/tvdw/gotor/aes"
-	"github.com/tvdw/openssl"
 )
 
-func HybridDecrypt(priv openssl.PrivateKey, d []byte) ([]byte, error) {
+// RSA-1024 with OAEP padding, as used for hybrid encryption
+const PK_ENC_LEN = 128
+const PK_PAD_LEN = 42
+const HYBRID_KEY_LEN = 16
+
+func HybridDecrypt(priv *rsa.PrivateKey, d []byte) ([]byte, error) {
 	// XXX this could probably be optimized a little
 
-	res, err := priv.Decrypt(d[0:128])
+	res, err := rsa.DecryptOAEP(sha1.New(), nil, priv, d[0:128], nil)
 	if err != nil {
 		return nil, err
 	}
@@ -36,3 +43,31 @@ func HybridDecrypt(priv openssl.PrivateKey, d []byte) ([]byte, error) {
 
 	return finalRes, nil
 }
+
+// HybridEncrypt is the counterpart of HybridDecrypt: whatever doesn't fit in the RSA block gets encrypted with
+// an AES key that's sent along in that block.
+func HybridEncrypt(pub *rsa.PublicKey, m []byte) ([]byte, error) {
+	if len(m) <= PK_ENC_LEN-PK_PAD_LEN {
+		return rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, m, nil)
+	}
+
+	split := PK_ENC_LEN - PK_PAD_LEN - HYBRID_KEY_LEN
+	block := make([]byte, HYBRID_KEY_LEN+split)
+	if err := CRandBytes(block[0:HYBRID_KEY_LEN]); err != nil {
+		return nil, err
+	}
+	copy(block[HYBRID_KEY_LEN:], m[0:split])
+
+	c1, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, block, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	aes := aes.New(block[0:HYBRID_KEY_LEN], make([]byte, 16))
+	c2, err := aes.Crypt(m[split:], make([]byte, len(m)-split))
+	if err != nil {
+		return nil, err
+	}
+
+	return append(c1, c2...), nil
+}
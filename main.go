@@ -8,7 +8,6 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"github.com/tvdw/cgolock"
 	"log"
 	"os"
 	"runtime"
@@ -23,7 +22,6 @@ var torrc = flag.String("f", "torrc", "torrc filename")
 var ors = [5]*ORCtx{}
 
 func main() {
-	cgolock.Init(runtime.NumCPU())
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	SetupRand()
 	SeedCellBuf()
@@ -126,7 +124,11 @@ func chainOrs() error {
 		if err != nil {
 			return err
 		}
-		extendCircId = <-doneChan
+		result := <-doneChan
+		if result.Err != nil {
+			return result.Err
+		}
+		extendCircId = result.ID
 		fmt.Println("extended to", extendCircId)
 	}
 	return nil
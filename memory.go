@@ -0,0 +1,239 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const MAX_MEM_IN_QUEUES_DEFAULT = 1 << 30
+
+// Once we're over MaxMemInQueues we kill circuits until we're this far under it, so we don't end up right back
+const OOM_TARGET_PERCENT = 90
+
+func (c *Config) maxMemInQueues() int64 {
+	if c.MaxMemInQueues == 0 {
+		return MAX_MEM_IN_QUEUES_DEFAULT
+	}
+	return c.MaxMemInQueues
+}
+
+// Keeps track of how much memory the cells waiting in our queues hold, per circuit. Cells waiting to be written to
+// a connection and data waiting to be written to a stream both count against the circuit they belong to.
+// A connection's writeQueue and circuitReadQueue are not charged: they hold at most WRITE_QUEUE_LENGTH and
+// CIRC_QUEUE_LENGTH entries per connection, and whoever fills them blocks instead of queueing more.
+type memAccountant struct {
+	lock     sync.Mutex
+	limit    int64
+	total    int64
+	accounts map[*queueAccount]struct{}
+}
+
+// Shared by every ORCtx in the process, like the cell buffers themselves
+var queueMem = &memAccountant{
+	limit:    MAX_MEM_IN_QUEUES_DEFAULT,
+	accounts: make(map[*queueAccount]struct{}),
+}
+
+func (m *memAccountant) setLimit(limit int64) {
+	m.lock.Lock()
+	m.limit = limit
+	m.lock.Unlock()
+}
+
+func (m *memAccountant) queued() int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.total
+}
+
+type queueAccount struct {
+	conn   *OnionConnection // Nil if nobody can be asked to tear the circuit down
+	id     CircuitID
+	bytes  int64
+	since  time.Time // When the account last went from empty to not empty: how long the oldest data may have waited
+	closed bool
+	killed bool
+}
+
+func (m *memAccountant) open(conn *OnionConnection, id CircuitID) *queueAccount {
+	a := &queueAccount{conn: conn, id: id}
+	m.lock.Lock()
+	m.accounts[a] = struct{}{}
+	m.lock.Unlock()
+	return a
+}
+
+// Returns true if that took us over the limit, in which case the caller should call reclaim once it holds no locks
+func (a *queueAccount) add(n int, now time.Time) bool {
+	if a == nil {
+		return false
+	}
+
+	m := queueMem
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if a.closed {
+		return false
+	}
+	if a.bytes == 0 {
+		a.since = now
+	}
+	a.bytes += int64(n)
+	m.total += int64(n)
+	return m.total > m.limit
+}
+
+func (a *queueAccount) sub(n int) {
+	if a == nil {
+		return
+	}
+
+	m := queueMem
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if a.closed {
+		return
+	}
+	a.bytes -= int64(n)
+	m.total -= int64(n)
+}
+
+// The circuit went away, so whatever it still had queued is about to be freed
+func (a *queueAccount) close() {
+	if a == nil {
+		return
+	}
+
+	m := queueMem
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if a.closed {
+		return
+	}
+	a.closed = true
+	m.total -= a.bytes
+	a.bytes = 0
+	delete(m.accounts, a)
+}
+
+// The OOM handler: kills the circuits whose data has been waiting the longest until we're comfortably under the
+// limit again
+func (m *memAccountant) reclaim(now time.Time) {
+	m.lock.Lock()
+	if m.total <= m.limit {
+		m.lock.Unlock()
+		return
+	}
+
+	var candidates []*queueAccount
+	for a := range m.accounts {
+		if a.bytes > 0 && !a.killed {
+			candidates = append(candidates, a)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].since.Before(candidates[j].since)
+	})
+
+	before, limit := m.total, m.limit
+	target := limit / 100 * OOM_TARGET_PERCENT
+	toFree := m.total - target
+	var victims []*queueAccount
+	var freeing int64
+	for _, a := range candidates {
+		if freeing >= toFree {
+			break
+		}
+		a.killed = true
+		freeing += a.bytes
+		victims = append(victims, a)
+	}
+	m.lock.Unlock()
+
+	oldest := time.Duration(0)
+	if len(victims) > 0 {
+		oldest = now.Sub(victims[0].since)
+	}
+	Log(LOG_WARN, "Out of memory: %d bytes queued, over MaxMemInQueues (%d). Killing %d circuits to free %d bytes, the oldest data had waited %s",
+		before, limit, len(victims), freeing, oldest)
+
+	for _, a := range victims {
+		if a.conn == nil {
+			a.close()
+			continue
+		}
+
+		// Cells waiting for the connection can go right away. The rest goes once the circuit is torn down
+		select {
+		case a.conn.circuitReadQueue <- &OutOfMemoryKill{id: a.id}:
+			a.conn.circQueues.remove(a.id)
+			a.close()
+		default:
+			// Its cells keep counting, so the next time we're over the limit it gets picked again
+			Log(LOG_NOTICE, "Could not ask for circuit %d to be killed, its connection is backed up", a.id)
+			m.lock.Lock()
+			a.killed = false
+			m.lock.Unlock()
+		}
+	}
+
+	Log(LOG_NOTICE, "OOM handler done, %d bytes queued now", m.queued())
+}
+
+// Data for the stream's own connection counts against the circuit it came in on
+func (s *Stream) queueData(data []byte) {
+	atomic.AddInt64(&s.queued, int64(len(data)))
+	if s.mem.add(len(data), time.Now()) {
+		queueMem.reclaim(time.Now())
+	}
+	s.writeChan <- data
+}
+
+func (s *Stream) dataWritten(n int) {
+	atomic.AddInt64(&s.queued, -int64(n))
+	s.mem.sub(n)
+}
+
+// Whatever is still in writeChan when the stream goes away never gets written
+func (s *Stream) releaseQueued() {
+	s.mem.sub(int(atomic.SwapInt64(&s.queued, 0)))
+}
+
+// Tears down a circuit the OOM handler picked, whatever kind it is
+type OutOfMemoryKill struct {
+	NoBuffers
+	NeverForRelay
+	id CircuitID
+}
+
+func (data *OutOfMemoryKill) CircID() CircuitID {
+	return 0
+}
+
+func (data *OutOfMemoryKill) Handle(c *OnionConnection, circ *Circuit) ActionableError {
+	reason := DESTROY_REASON_RESOURCELIMIT
+
+	if circ, ok := c.circuits[data.id]; ok {
+		c.destroyCircuit(circ, true, true, reason)
+		c.writeQueue <- NewCell(c.negotiatedVersion, data.id, CMD_DESTROY, []byte{byte(reason)}).Bytes()
+	} else if rcirc, ok := c.relayCircuits[data.id]; ok {
+		c.destroyRelayCircuit(rcirc, true, true, reason)
+		c.writeQueue <- NewCell(c.negotiatedVersion, data.id, CMD_DESTROY, []byte{byte(reason)}).Bytes()
+	} else if pc, ok := c.proxyCircuits[data.id]; ok {
+		c.destroyProxyCircuit(pc, true, true, reason)
+	} else {
+		return nil
+	}
+
+	Log(LOG_NOTICE, "Killed circuit %d to free memory", data.id)
+	return nil
+}
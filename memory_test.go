@@ -0,0 +1,138 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOOMKillsOldestCircuit(t *testing.T) {
+	defer func(old *memAccountant) { queueMem = old }(queueMem)
+	queueMem = &memAccountant{
+		limit:    10 * MAX_CELL_SIZE,
+		accounts: make(map[*queueAccount]struct{}),
+	}
+
+	newConn := func() *OnionConnection {
+		c := &OnionConnection{
+			negotiatedVersion: 4,
+			circuits:          make(map[CircuitID]*Circuit),
+			circuitReadQueue:  make(CircReadQueue, 1),
+			writeQueue:        make(chan []byte, 1),
+		}
+		c.circQueues = newCircuitScheduler(c)
+		return c
+	}
+	old, young := newConn(), newConn()
+	oldCirc := testHopCircuit(90)
+	old.circuits[oldCirc.id] = oldCirc
+
+	for i := 0; i < 6; i++ {
+		old.circQueues.enqueue(oldCirc.id, nil, GetCellBuf(false))
+	}
+	time.Sleep(time.Millisecond)
+	for i := 0; i < 6; i++ {
+		young.circQueues.enqueue(2, nil, GetCellBuf(false))
+	}
+
+	if old.circQueues.queued(oldCirc.id) != 0 {
+		t.Error("cells of the oldest circuit were not dropped")
+	}
+	if young.circQueues.queued(2) != 6 {
+		t.Error("OOM handler killed more than it needed to")
+	}
+	if queued := queueMem.queued(); queued != 6*MAX_CELL_SIZE {
+		t.Errorf("expected %d bytes accounted for, got %d", 6*MAX_CELL_SIZE, queued)
+	}
+
+	// The circuit itself goes away once its connection gets to it
+	if err := old.routeCircuitCommandToFunction(<-old.circuitReadQueue); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := old.circuits[oldCirc.id]; ok {
+		t.Error("killed circuit still exists")
+	}
+	if cell := <-old.writeQueue; Command(cell[4]) != CMD_DESTROY || DestroyReason(cell[5]) != DESTROY_REASON_RESOURCELIMIT {
+		t.Error("expected a DESTROY with DESTROY_REASON_RESOURCELIMIT")
+	}
+	if len(young.circuitReadQueue) != 0 {
+		t.Error("asked to kill a circuit that was not over the limit")
+	}
+}
+
+func TestStreamMemoryAccounting(t *testing.T) {
+	defer func(old *memAccountant) { queueMem = old }(queueMem)
+	queueMem = &memAccountant{
+		limit:    MAX_MEM_IN_QUEUES_DEFAULT,
+		accounts: make(map[*queueAccount]struct{}),
+	}
+
+	c := &OnionConnection{}
+	c.circQueues = newCircuitScheduler(c)
+	stream, _ := NewStream(1)
+	stream.mem = c.circQueues.account(5)
+
+	stream.queueData(make([]byte, 100))
+	stream.queueData(make([]byte, 200))
+	if queued := queueMem.queued(); queued != 300 {
+		t.Errorf("expected 300 bytes queued, got %d", queued)
+	}
+
+	stream.dataWritten(len(<-stream.writeChan))
+	if queued := queueMem.queued(); queued != 200 {
+		t.Errorf("expected 200 bytes queued after a write, got %d", queued)
+	}
+
+	stream.releaseQueued()
+	if queued := queueMem.queued(); queued != 0 {
+		t.Errorf("expected nothing queued after the stream went away, got %d", queued)
+	}
+
+	// Once the circuit is gone, its streams no longer count
+	stream.queueData(make([]byte, 100))
+	c.circQueues.remove(5)
+	stream.dataWritten(len(<-stream.writeChan))
+	if queued := queueMem.queued(); queued != 0 {
+		t.Errorf("expected nothing queued after the circuit went away, got %d", queued)
+	}
+}
+
+func TestOOMRetriesBackedUpConnection(t *testing.T) {
+	defer func(old *memAccountant) { queueMem = old }(queueMem)
+	queueMem = &memAccountant{
+		limit:    10 * MAX_CELL_SIZE,
+		accounts: make(map[*queueAccount]struct{}),
+	}
+
+	c := &OnionConnection{
+		negotiatedVersion: 4,
+		circuits:          make(map[CircuitID]*Circuit),
+		circuitReadQueue:  make(CircReadQueue, 1),
+		writeQueue:        make(chan []byte, 1),
+	}
+	c.circQueues = newCircuitScheduler(c)
+	circ := testHopCircuit(91)
+	c.circuits[circ.id] = circ
+
+	// With nowhere to send the kill, the circuit has to stay on the books
+	c.circuitReadQueue <- &OutOfMemoryKill{}
+	for i := 0; i < 11; i++ {
+		c.circQueues.enqueue(circ.id, nil, GetCellBuf(false))
+	}
+	if c.circQueues.queued(circ.id) != 11 || queueMem.queued() != 11*MAX_CELL_SIZE {
+		t.Error("circuit escaped the OOM handler while its connection was backed up")
+	}
+
+	// Once the connection catches up, the next cell over the limit gets it killed
+	<-c.circuitReadQueue
+	c.circQueues.enqueue(circ.id, nil, GetCellBuf(false))
+	if c.circQueues.queued(circ.id) != 0 || queueMem.queued() != 0 {
+		t.Error("OOM handler did not try again")
+	}
+	if kill, ok := (<-c.circuitReadQueue).(*OutOfMemoryKill); !ok || kill.id != circ.id {
+		t.Error("expected the circuit to be killed")
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Address types in NETINFO cells
+const (
+	NETINFO_ADDR_IPV4 = 4
+	NETINFO_ADDR_IPV6 = 6
+)
+
+// Same threshold C tor uses before it starts complaining about the clock
+const CLOCK_SKEW_WARN_THRESHOLD = time.Hour
+
+// How long a reported skew counts as recent, and how often we complain about it at most
+const CLOCK_SKEW_WINDOW = time.Hour
+const CLOCK_SKEW_WARN_INTERVAL = time.Hour
+
+type NetinfoCell struct {
+	Timestamp    time.Time // Zero if the peer didn't send one, as clients tend to do
+	OtherAddress net.IP    // Our address, as seen by the peer. nil if it's not something we understand
+	MyAddresses  []net.IP  // The addresses the peer claims to have
+}
+
+func writeNetinfoAddress(buf []byte, ip net.IP) (int, error) {
+	aType, addr := byte(NETINFO_ADDR_IPV6), ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		aType, addr = NETINFO_ADDR_IPV4, ip4
+	}
+	if addr == nil {
+		return 0, errors.New("not an IP address")
+	}
+	if len(buf) < 2+len(addr) {
+		return 0, errors.New("no room for the address in NETINFO")
+	}
+
+	buf[0] = aType
+	buf[1] = byte(len(addr))
+	copy(buf[2:], addr)
+	return 2 + len(addr), nil
+}
+
+// Returns the address (nil if the type is unknown to us) and the amount of bytes it took
+func readNetinfoAddress(data []byte) (net.IP, int, error) {
+	if len(data) < 2 {
+		return nil, 0, errors.New("truncated NETINFO address")
+	}
+	aType, aLen := data[0], int(data[1])
+	if len(data) < 2+aLen {
+		return nil, 0, errors.New("truncated NETINFO address")
+	}
+
+	switch {
+	case aType == NETINFO_ADDR_IPV4 && aLen == 4:
+		return net.IPv4(data[2], data[3], data[4], data[5]), 2 + aLen, nil
+	case aType == NETINFO_ADDR_IPV6 && aLen == 16:
+		ip := make(net.IP, 16)
+		copy(ip, data[2:18])
+		return ip, 2 + aLen, nil
+	case aType == NETINFO_ADDR_IPV4 || aType == NETINFO_ADDR_IPV6:
+		return nil, 0, errors.New("NETINFO address with a bad length")
+	default:
+		return nil, 2 + aLen, nil
+	}
+}
+
+func buildNetinfo(buf []byte, timestamp time.Time, otherAddress net.IP, myAddresses []net.IP) error {
+	if len(buf) < 4 {
+		return errors.New("no room for NETINFO")
+	}
+
+	if !timestamp.IsZero() {
+		BigEndian.PutUint32(buf[0:4], uint32(timestamp.Unix()))
+	}
+	pos := 4
+
+	if otherAddress != nil {
+		n, err := writeNetinfoAddress(buf[pos:], otherAddress)
+		if err != nil {
+			return err
+		}
+		pos += n
+	} else {
+		// Type 4 with a zero length means we don't know
+		if len(buf) < pos+2 {
+			return errors.New("no room for NETINFO")
+		}
+		buf[pos] = NETINFO_ADDR_IPV4
+		buf[pos+1] = 0
+		pos += 2
+	}
+
+	if len(buf) < pos+1 || len(myAddresses) > 255 {
+		return errors.New("no room for NETINFO")
+	}
+	buf[pos] = byte(len(myAddresses))
+	pos++
+	for _, addr := range myAddresses {
+		n, err := writeNetinfoAddress(buf[pos:], addr)
+		if err != nil {
+			return err
+		}
+		pos += n
+	}
+
+	return nil
+}
+
+func parseNetinfo(data []byte) (*NetinfoCell, error) {
+	if len(data) < 4+2+1 {
+		return nil, errors.New("NETINFO too short")
+	}
+
+	info := &NetinfoCell{}
+	if ts := BigEndian.Uint32(data[0:4]); ts != 0 {
+		info.Timestamp = time.Unix(int64(ts), 0)
+	}
+
+	pos := 4
+	if data[pos] == NETINFO_ADDR_IPV4 && data[pos+1] == 0 {
+		pos += 2
+	} else {
+		addr, n, err := readNetinfoAddress(data[pos:])
+		if err != nil {
+			return nil, err
+		}
+		info.OtherAddress = addr
+		pos += n
+	}
+
+	if len(data) < pos+1 {
+		return nil, errors.New("NETINFO too short")
+	}
+	count := int(data[pos])
+	pos++
+	for i := 0; i < count; i++ {
+		addr, n, err := readNetinfoAddress(data[pos:])
+		if err != nil {
+			return nil, err
+		}
+		if addr != nil {
+			info.MyAddresses = append(info.MyAddresses, addr)
+		}
+		pos += n
+	}
+
+	return info, nil
+}
+
+// Positive if their clock is behind ours
+func (n *NetinfoCell) ClockSkew(now time.Time) time.Duration {
+	if n.Timestamp.IsZero() {
+		return 0
+	}
+	return now.Sub(n.Timestamp)
+}
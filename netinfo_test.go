@@ -0,0 +1,133 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNetinfoRoundTrip(t *testing.T) {
+	buf := make([]byte, 509)
+	now := time.Unix(time.Now().Unix(), 0)
+	other := net.ParseIP("2001:db8::1")
+	mine := []net.IP{net.ParseIP("192.0.2.7"), net.ParseIP("2001:db8::2")}
+
+	if err := buildNetinfo(buf, now, other, mine); err != nil {
+		t.Fatal(err)
+	}
+	info, err := parseNetinfo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Timestamp.Equal(now) {
+		t.Errorf("timestamp %s, expected %s", info.Timestamp, now)
+	}
+	if !info.OtherAddress.Equal(other) {
+		t.Errorf("other address %s, expected %s", info.OtherAddress, other)
+	}
+	if len(info.MyAddresses) != 2 || !info.MyAddresses[0].Equal(mine[0]) || !info.MyAddresses[1].Equal(mine[1]) {
+		t.Errorf("my addresses %v, expected %v", info.MyAddresses, mine)
+	}
+	if skew := info.ClockSkew(now.Add(2 * time.Hour)); skew != 2*time.Hour {
+		t.Errorf("clock skew %s", skew)
+	}
+}
+
+func TestNetinfoParse(t *testing.T) {
+	// What a client sends: no timestamp, no idea of our address, no addresses of its own
+	info, err := parseNetinfo([]byte{0, 0, 0, 0, 4, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Timestamp.IsZero() || info.OtherAddress != nil || len(info.MyAddresses) != 0 {
+		t.Errorf("unexpected %+v", info)
+	}
+	if info.ClockSkew(time.Now()) != 0 {
+		t.Error("clock skew without a timestamp")
+	}
+
+	// Unknown address types are skipped
+	info, err = parseNetinfo([]byte{0, 0, 0, 1, 9, 2, 1, 2, 1, 4, 4, 10, 0, 0, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.OtherAddress != nil || len(info.MyAddresses) != 1 || !info.MyAddresses[0].Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("unexpected %+v", info)
+	}
+
+	for _, bad := range [][]byte{
+		{0, 0, 0, 0, 4},
+		{0, 0, 0, 0, 4, 4, 1, 2},
+		{0, 0, 0, 0, 6, 4, 1, 2, 3, 4, 0},
+		{0, 0, 0, 0, 4, 0, 1, 4, 4, 1},
+	} {
+		if _, err := parseNetinfo(bad); err == nil {
+			t.Errorf("parsed %v", bad)
+		}
+	}
+}
+
+func TestAddressGuesser(t *testing.T) {
+	g := NewAddressGuesser()
+	ours := net.ParseIP("198.51.100.1")
+	other := net.ParseIP("198.51.100.2")
+
+	if g.Report(Fingerprint{1}, net.ParseIP("10.0.0.1")) || g.Report(Fingerprint{1}, net.ParseIP("127.0.0.1")) {
+		t.Error("private addresses should be ignored")
+	}
+
+	g.Report(Fingerprint{1}, ours)
+	g.Report(Fingerprint{2}, ours)
+	g.Report(Fingerprint{2}, ours) // The same peer twice only counts once
+	if g.Guess() != nil {
+		t.Error("guessed with too few reports")
+	}
+	if !g.Report(Fingerprint{3}, ours) {
+		t.Error("expected a guess")
+	}
+	if !g.Guess().Equal(ours) {
+		t.Errorf("guessed %s", g.Guess())
+	}
+	if g.GuessIPv6() != nil {
+		t.Error("unexpected IPv6 guess")
+	}
+
+	g.Report(Fingerprint{4}, other)
+	g.Report(Fingerprint{5}, other)
+	if !g.Report(Fingerprint{6}, other) || g.Guess() != nil {
+		t.Error("a split vote should not give a guess")
+	}
+	if !g.Report(Fingerprint{1}, other) || !g.Guess().Equal(other) {
+		t.Errorf("guessed %s", g.Guess())
+	}
+}
+
+func TestClockSkewWindow(t *testing.T) {
+	or := &ORCtx{}
+	conn := &OnionConnection{}
+	now := time.Now()
+
+	or.noteClockSkew(3*time.Hour, conn, now)
+	or.noteClockSkew(-time.Minute, conn, now.Add(time.Minute))
+	if skew, bad := or.clockSkewAt(now.Add(2 * time.Minute)); skew != 3*time.Hour || !bad {
+		t.Errorf("largest recent skew lost, got %s", skew)
+	}
+	firstWarning := or.clockSkewWarned
+
+	or.noteClockSkew(-2*time.Hour, conn, now.Add(10*time.Minute))
+	if or.clockSkewWarned != firstWarning {
+		t.Error("warned about the clock twice within the interval")
+	}
+
+	if skew, bad := or.clockSkewAt(now.Add(2 * time.Hour)); skew != 0 || bad {
+		t.Errorf("old skew still reported: %s", skew)
+	}
+	or.noteClockSkew(time.Minute, conn, now.Add(2*time.Hour))
+	if skew, bad := or.clockSkewAt(now.Add(2 * time.Hour)); skew != time.Minute || bad {
+		t.Errorf("expected the new skew once the old one expired, got %s", skew)
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/sha3"
+	"crypto/subtle"
+	"errors"
+	"golang.org/x/crypto/curve25519"
+)
+
+const NTOR3_PROTOID = "ntor3-curve25519-sha3_256-1"
+
+var ntor3TMsgKDF = []byte(NTOR3_PROTOID + ":kdf_phase1")
+var ntor3TMsgMAC = []byte(NTOR3_PROTOID + ":msg_mac")
+var ntor3TKeySeed = []byte(NTOR3_PROTOID + ":key_seed")
+var ntor3TVerify = []byte(NTOR3_PROTOID + ":verify")
+var ntor3TFinal = []byte(NTOR3_PROTOID + ":kdf_final")
+var ntor3TAuth = []byte(NTOR3_PROTOID + ":auth_final")
+
+// The verification string both sides bind into the handshake when it's used for CREATE2
+var ntor3CircVerification = []byte("circuit extend")
+
+const NTOR3_ENC_KEY_LEN = 32
+const NTOR3_MAC_KEY_LEN = 32
+const NTOR3_DIGEST_LEN = 32
+
+// Digest seeds plus AES keys for the relay crypto, same as what the ntor KDF hands out
+const NTOR3_CIRCUIT_KEY_LEN = 72
+
+// Extension types carried in the encrypted handshake messages
+const (
+	NTOR3_EXT_CC_REQUEST  = 1
+	NTOR3_EXT_CC_RESPONSE = 2
+)
+
+type NtorV3Extension struct {
+	Type byte
+	Data []byte
+}
+
+func encodeNtorV3Extensions(exts []NtorV3Extension) ([]byte, error) {
+	if len(exts) > 255 {
+		return nil, errors.New("too many ntor v3 extensions")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(byte(len(exts)))
+	for _, ext := range exts {
+		if len(ext.Data) > 255 {
+			return nil, errors.New("ntor v3 extension too long")
+		}
+		buf.WriteByte(ext.Type)
+		buf.WriteByte(byte(len(ext.Data)))
+		buf.Write(ext.Data)
+	}
+	return buf.Bytes(), nil
+}
+
+func parseNtorV3Extensions(data []byte) ([]NtorV3Extension, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	n := int(data[0])
+	pos := 1
+	exts := make([]NtorV3Extension, 0, n)
+	for i := 0; i < n; i++ {
+		if len(data) < pos+2 || len(data) < pos+2+int(data[pos+1]) {
+			return nil, errors.New("truncated ntor v3 extension")
+		}
+		extLen := int(data[pos+1])
+		exts = append(exts, NtorV3Extension{
+			Type: data[pos],
+			Data: data[pos+2 : pos+2+extLen],
+		})
+		pos += 2 + extLen
+	}
+	if pos != len(data) {
+		return nil, errors.New("trailing data after ntor v3 extensions")
+	}
+	return exts, nil
+}
+
+func ntor3Encap(s []byte) []byte {
+	buf := make([]byte, 8+len(s))
+	BigEndian.PutUint64(buf[0:8], uint64(len(s)))
+	copy(buf[8:], s)
+	return buf
+}
+
+func ntor3H(s, t []byte) []byte {
+	h := sha3.New256()
+	h.Write(ntor3Encap(t))
+	h.Write(s)
+	return h.Sum(nil)
+}
+
+func ntor3MAC(k, msg, t []byte) []byte {
+	h := sha3.New256()
+	h.Write(ntor3Encap(t))
+	h.Write(ntor3Encap(k))
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+func ntor3KDF(s, t []byte, n int) []byte {
+	h := sha3.NewSHAKE256()
+	h.Write(ntor3Encap(t))
+	h.Write(s)
+	out := make([]byte, n)
+	h.Read(out)
+	return out
+}
+
+// AES-256 in counter mode with a zero IV. Each key only ever encrypts one message.
+func ntor3Enc(k, m []byte) []byte {
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		panic(err)
+	}
+	out := make([]byte, len(m))
+	cipher.NewCTR(block, make([]byte, aes.BlockSize)).XORKeyStream(out, m)
+	return out
+}
+
+func concat(parts ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, p := range parts {
+		buf.Write(p)
+	}
+	return buf.Bytes()
+}
+
+// The keys protecting the client's message, derived from EXP(B, x) alone
+func ntor3Phase1(bx, id, B, X, verification []byte) (encKey, macKey []byte) {
+	secretInput := concat(bx, id, X, B, []byte(NTOR3_PROTOID), ntor3Encap(verification))
+	keys := ntor3KDF(secretInput, ntor3TMsgKDF, NTOR3_ENC_KEY_LEN+NTOR3_MAC_KEY_LEN)
+	return keys[:NTOR3_ENC_KEY_LEN], keys[NTOR3_ENC_KEY_LEN:]
+}
+
+// Everything that follows from both DH results: the verifier for AUTH, the key for the server's message and
+// the circuit keys
+func ntor3Final(xy, xb, id, B, X, Y, verification []byte) (verify, encKey, circuitKeys []byte) {
+	secretInput := concat(xy, xb, id, B, X, Y, []byte(NTOR3_PROTOID), ntor3Encap(verification))
+	keySeed := ntor3H(secretInput, ntor3TKeySeed)
+	verify = ntor3H(secretInput, ntor3TVerify)
+	keystream := ntor3KDF(keySeed, ntor3TFinal, NTOR3_ENC_KEY_LEN+NTOR3_CIRCUIT_KEY_LEN)
+	return verify, keystream[:NTOR3_ENC_KEY_LEN], keystream[NTOR3_ENC_KEY_LEN:]
+}
+
+func ntor3Auth(verify, id, B, Y, X, msgMAC, encryptedMsg []byte) []byte {
+	authInput := concat(verify, id, B, Y, X, msgMAC, ntor3Encap(encryptedMsg), []byte(NTOR3_PROTOID), []byte("Server"))
+	return ntor3H(authInput, ntor3TAuth)
+}
+
+// NtorV3ServerHandshake answers a client's ntor v3 request. respond gets the extensions the client sent and
+// returns the ones to send back. The result is the reply for the CREATED2 cell and the circuit keys.
+func NtorV3ServerHandshake(edIdentity ed25519.PublicKey, ntorPrivate, ntorPublic [32]byte, request []byte, respond func([]NtorV3Extension) []NtorV3Extension) ([]byte, []byte, error) {
+	var y [32]byte
+	CRandBytes(y[:])
+
+	return ntor3ServerHandshake(edIdentity, ntorPrivate[:], ntorPublic[:], y[:], ntor3CircVerification, request, func(clientMsg []byte) ([]byte, error) {
+		clientExts, err := parseNtorV3Extensions(clientMsg)
+		if err != nil {
+			return nil, err
+		}
+		return encodeNtorV3Extensions(respond(clientExts))
+	})
+}
+
+// The handshake itself, with the messages as opaque bytes and our ephemeral key y picked by the caller
+func ntor3ServerHandshake(edIdentity, b, ntorPublic, y, verification, request []byte, respond func([]byte) ([]byte, error)) ([]byte, []byte, error) {
+	if len(request) < 3*32+NTOR3_DIGEST_LEN {
+		return nil, nil, errors.New("ntor v3 request too short")
+	}
+	id := request[0:32]
+	B := request[32:64]
+	X := request[64:96]
+	encryptedMsg := request[96 : len(request)-NTOR3_DIGEST_LEN]
+	msgMAC := request[len(request)-NTOR3_DIGEST_LEN:]
+
+	if !bytes.Equal(id, edIdentity) {
+		return nil, nil, errors.New("ntor v3 request is for another relay")
+	}
+	if !bytes.Equal(B, ntorPublic) {
+		return nil, nil, errors.New("ntor v3 request is for another onion key")
+	}
+
+	xb, err := curve25519.X25519(b, X)
+	if err != nil {
+		return nil, nil, err
+	}
+	encKey1, macKey1 := ntor3Phase1(xb, id, B, X, verification)
+	if subtle.ConstantTimeCompare(ntor3MAC(macKey1, concat(id, B, X, encryptedMsg), ntor3TMsgMAC), msgMAC) != 1 {
+		return nil, nil, errors.New("bad MAC on the ntor v3 client message")
+	}
+	serverMsg, err := respond(ntor3Enc(encKey1, encryptedMsg))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	Y, err := curve25519.X25519(y, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	xy, err := curve25519.X25519(y, X)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	verify, encKey, circuitKeys := ntor3Final(xy, xb, id, B, X, Y, verification)
+	encryptedReply := ntor3Enc(encKey, serverMsg)
+	auth := ntor3Auth(verify, id, B, Y, X, msgMAC, encryptedReply)
+
+	return concat(Y, auth, encryptedReply), circuitKeys, nil
+}
+
+// We don't do congestion control yet, and not answering the request is how the client learns that
+func ntorV3ServerExtensions(clientExts []NtorV3Extension) []NtorV3Extension {
+	for _, ext := range clientExts {
+		Log(LOG_DEBUG, "Ignoring ntor v3 extension %d from the client", ext.Type)
+	}
+	return nil
+}
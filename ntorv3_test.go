@@ -0,0 +1,208 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"golang.org/x/crypto/curve25519"
+	"testing"
+)
+
+func TestNtorV3Extensions(t *testing.T) {
+	exts := []NtorV3Extension{
+		{Type: NTOR3_EXT_CC_REQUEST},
+		{Type: 9, Data: []byte("hello")},
+	}
+	encoded, err := encodeNtorV3Extensions(exts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseNtorV3Extensions(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 2 || parsed[0].Type != NTOR3_EXT_CC_REQUEST || len(parsed[0].Data) != 0 || !bytes.Equal(parsed[1].Data, []byte("hello")) {
+		t.Errorf("extensions changed in transit: %v", parsed)
+	}
+
+	if _, err := parseNtorV3Extensions(encoded[:len(encoded)-1]); err == nil {
+		t.Error("parsed truncated extensions")
+	}
+	if _, err := parseNtorV3Extensions(append(encoded, 0)); err == nil {
+		t.Error("parsed extensions with trailing garbage")
+	}
+	if parsed, err := parseNtorV3Extensions(nil); err != nil || parsed != nil {
+		t.Error("an empty message should mean no extensions")
+	}
+}
+
+func testNtorV3Relay(t *testing.T) (ed25519.PublicKey, [32]byte, [32]byte) {
+	edIdentity, _, _ := ed25519.GenerateKey(rand.Reader)
+	var ntorPrivate, ntorPublic [32]byte
+	CRandBytes(ntorPrivate[:])
+	pub, err := curve25519.X25519(ntorPrivate[:], curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(ntorPublic[:], pub)
+	return edIdentity, ntorPrivate, ntorPublic
+}
+
+func testNtorV3ClientState(t *testing.T, edIdentity ed25519.PublicKey, ntorPublic [32]byte) *CircuitHandshakeState {
+	state := &CircuitHandshakeState{
+		handshake:   HANDSHAKE_NTOR_V3,
+		onionPublic: ntorPublic,
+		edIdentity:  edIdentity,
+	}
+	CRandBytes(state.keys[0][:])
+	pub, err := curve25519.X25519(state.keys[0][:], curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(state.keys[1][:], pub)
+	return state
+}
+
+func TestNtorV3Handshake(t *testing.T) {
+	edIdentity, ntorPrivate, ntorPublic := testNtorV3Relay(t)
+	state := testNtorV3ClientState(t, edIdentity, ntorPublic)
+
+	request, err := NtorV3ClientPayload(state, []NtorV3Extension{{Type: NTOR3_EXT_CC_REQUEST}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotExts []NtorV3Extension
+	reply, serverKeys, err := NtorV3ServerHandshake(edIdentity, ntorPrivate, ntorPublic, request, func(exts []NtorV3Extension) []NtorV3Extension {
+		gotExts = exts
+		return []NtorV3Extension{{Type: NTOR3_EXT_CC_RESPONSE, Data: []byte{31}}}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotExts) != 1 || gotExts[0].Type != NTOR3_EXT_CC_REQUEST {
+		t.Errorf("relay saw the wrong extensions: %v", gotExts)
+	}
+
+	clientKeys, err := clientCompleteHandshake(state, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clientKeys) != NTOR3_CIRCUIT_KEY_LEN || !bytes.Equal(clientKeys, serverKeys) {
+		t.Error("client and relay disagree on the circuit keys")
+	}
+	if len(state.replyExtensions) != 1 || state.replyExtensions[0].Type != NTOR3_EXT_CC_RESPONSE || !bytes.Equal(state.replyExtensions[0].Data, []byte{31}) {
+		t.Errorf("client saw the wrong extensions: %v", state.replyExtensions)
+	}
+
+	reply[40] ^= 1
+	if _, err := NtorV3ClientComplete(state, reply); err == nil {
+		t.Error("accepted a reply with a bad AUTH")
+	}
+}
+
+func TestNtorV3ServerRejects(t *testing.T) {
+	edIdentity, ntorPrivate, ntorPublic := testNtorV3Relay(t)
+	noExts := func([]NtorV3Extension) []NtorV3Extension { return nil }
+
+	state := testNtorV3ClientState(t, edIdentity, ntorPublic)
+	request, err := NtorV3ClientPayload(state, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte{}, request...)
+	tampered[len(tampered)-33] ^= 1
+	if _, _, err := NtorV3ServerHandshake(edIdentity, ntorPrivate, ntorPublic, tampered, noExts); err == nil {
+		t.Error("accepted a client message with a bad MAC")
+	}
+
+	otherIdentity, _, _ := testNtorV3Relay(t)
+	if _, _, err := NtorV3ServerHandshake(otherIdentity, ntorPrivate, ntorPublic, request, noExts); err == nil {
+		t.Error("accepted a request for another relay")
+	}
+
+	if _, _, err := NtorV3ServerHandshake(edIdentity, ntorPrivate, ntorPublic, request[:100], noExts); err == nil {
+		t.Error("accepted a truncated request")
+	}
+}
+
+func testHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// The test vectors from tor's test_ntor_v3.c, which also has them from the reference implementation in
+// proposal 332
+func TestNtorV3TestVectors(t *testing.T) {
+	b := testHex(t, "4051daa5921cfa2a1c27b08451324919538e79e788a81b38cbed097a5dff454a")
+	B := testHex(t, "f8307a2bc1870b00b828bb74dbb8fd88e632a6375ab3bcd1ae706aaa8b6cdd1d")
+	x := testHex(t, "b825a3719147bcbe5fb1d0b0fcb9c09e51948048e2e3283d2ab7b45b5ef38b49")
+	X := testHex(t, "252fe9ae91264c91d4ecb8501f79d0387e34ad8ca0f7c995184f7d11d5da4f46")
+	y := testHex(t, "4865a5b7689dafd978f529291c7171bc159be076b92186405d13220b80e2a053")
+	id := testHex(t, "9fad2af287ef942632833d21f946c6260c33fae6172b60006e86e4a6911753a2")
+	clientMsg := testHex(t, "68656c6c6f20776f726c64")
+	serverMsg := testHex(t, "486f6c61204d756e646f")
+	verification := testHex(t, "78797a7a79")
+
+	expectedRequest := testHex(t, "9fad2af287ef942632833d21f946c6260c33fae6172b60006e86e4a6911753a2"+
+		"f8307a2bc1870b00b828bb74dbb8fd88e632a6375ab3bcd1ae706aaa8b6cdd1d"+
+		"252fe9ae91264c91d4ecb8501f79d0387e34ad8ca0f7c995184f7d11d5da4f46"+
+		"3bebd9151fd3b47c180abc"+
+		"9e044d53565f04d82bbb3bebed3d06cea65db8be9c72b68cd461942088502f67")
+	expectedReply := testHex(t, "4bf4814326fdab45ad5184f5518bd7fae25dc59374062698201a50a22954246d"+
+		"2fc5f8773ca824542bc6cf6f57c7c29bbf4e5476461ab130c5b18ab0a9127665"+
+		"1202c3e1e87c0d32054c")
+	// The first NTOR3_CIRCUIT_KEY_LEN bytes of the key stream the test vectors give
+	expectedKeys := testHex(t, "9c19b631fd94ed86a817e01f6c80b0743a43f5faebd39cfaa8b00fa8bcc65c3bfeaa403d"+
+		"91acbd68a821bf6ee8504602b094a254392a07737d5662768c7a9fb1b2814bb34780eaee")
+
+	state := &CircuitHandshakeState{handshake: HANDSHAKE_NTOR_V3, edIdentity: id}
+	copy(state.onionPublic[:], B)
+	copy(state.keys[0][:], x)
+	copy(state.keys[1][:], X)
+	request, err := ntor3ClientRequest(state, verification, clientMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(request, expectedRequest) {
+		t.Errorf("client request %x, expected %x", request, expectedRequest)
+	}
+
+	var gotMsg []byte
+	reply, serverKeys, err := ntor3ServerHandshake(id, b, B, y, verification, expectedRequest, func(msg []byte) ([]byte, error) {
+		gotMsg = msg
+		return serverMsg, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotMsg, clientMsg) {
+		t.Errorf("relay decrypted the client message to %x", gotMsg)
+	}
+	if !bytes.Equal(reply, expectedReply) {
+		t.Errorf("relay reply %x, expected %x", reply, expectedReply)
+	}
+	if !bytes.Equal(serverKeys, expectedKeys) {
+		t.Errorf("relay circuit keys %x, expected %x", serverKeys, expectedKeys)
+	}
+
+	gotMsg, clientKeys, err := ntor3ClientComplete(state, verification, expectedReply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotMsg, serverMsg) {
+		t.Errorf("client decrypted the relay message to %x", gotMsg)
+	}
+	if !bytes.Equal(clientKeys, expectedKeys) {
+		t.Errorf("client circuit keys %x, expected %x", clientKeys, expectedKeys)
+	}
+}
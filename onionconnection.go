@@ -5,10 +5,15 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/rsa"
 	"crypto/sha256"
 	"errors"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const READ_QUEUE_LENGTH = 100
@@ -21,10 +26,16 @@ type OnionConnection struct {
 	parentOR         *ORCtx
 	readQueue        chan Cell
 	circuitReadQueue CircReadQueue
-	writeQueue       chan []byte
+	writeQueue       chan []byte       // Link-level cells, which go out before anything in circQueues
+	circQueues       *circuitScheduler // Relay cells, per circuit
 	circuits         map[CircuitID]*Circuit
 	proxyCircuits    map[CircuitID]*ProxyCircuit
 	relayCircuits    map[CircuitID]*RelayCircuit
+	pendingCreates   map[CircuitID]struct{} // Waiting for an onion-skin worker
+
+	createAnswersLock  sync.Mutex
+	createAnswers      []*CreateAnswered // Handed over by the onion-skin workers
+	createAnswersReady chan struct{}     // Poked when createAnswers gets something, drained by the runloop
 
 	usedTLSCtx        *TorTLS
 	negotiatedVersion LinkVersion
@@ -34,21 +45,48 @@ type OnionConnection struct {
 	theyAuthenticated   bool
 	theirFingerprint    Fingerprint
 	theirFingerprint256 []byte
+	theirIdentityKey    *rsa.PublicKey
+	theirAuthKey        *rsa.PublicKey
+	theirEdIdentity     ed25519.PublicKey // Only set if they sent ed25519 certificates
+	theirAddress        net.IP            // Where the TCP connection goes to or comes from
+	theirAddresses      []net.IP          // What they claim in NETINFO
+
+	padding *channelPadding
+
+	established      time.Time // When it got registered with the ORCtx
+	closing          int32     // Atomic. Set once we're shutting down
+	circIDsExhausted int32     // Atomic. Set once we failed to find a free circuit ID
+	load             int32     // Atomic. Circuits on this connection, as of the last runloop iteration
+
+	conn         net.Conn
+	lastActivity int64 // Atomic, UnixNano. Last time we saw something that wasn't padding
+	lastWrite    int64 // Atomic, UnixNano
+	clientUsed   int32 // Atomic. Set once we build circuits of our own over it
 }
 
-func newOnionConnection(tlsctx *TorTLS, or *ORCtx) *OnionConnection {
+func newOnionConnection(conn net.Conn, tlsctx *TorTLS, or *ORCtx) *OnionConnection {
 	StatsAddConnection()
 
-	return &OnionConnection{
-		usedTLSCtx:       tlsctx,
-		circuits:         make(map[CircuitID]*Circuit),
-		proxyCircuits:    make(map[CircuitID]*ProxyCircuit),
-		relayCircuits:    make(map[CircuitID]*RelayCircuit),
-		readQueue:        make(chan Cell, READ_QUEUE_LENGTH),
-		writeQueue:       make(chan []byte, WRITE_QUEUE_LENGTH),
-		circuitReadQueue: make(CircReadQueue, CIRC_QUEUE_LENGTH),
-		parentOR:         or,
+	c := &OnionConnection{
+		conn:               conn,
+		usedTLSCtx:         tlsctx,
+		circuits:           make(map[CircuitID]*Circuit),
+		proxyCircuits:      make(map[CircuitID]*ProxyCircuit),
+		relayCircuits:      make(map[CircuitID]*RelayCircuit),
+		pendingCreates:     make(map[CircuitID]struct{}),
+		readQueue:          make(chan Cell, READ_QUEUE_LENGTH),
+		writeQueue:         make(chan []byte, WRITE_QUEUE_LENGTH),
+		circuitReadQueue:   make(CircReadQueue, CIRC_QUEUE_LENGTH),
+		createAnswersReady: make(chan struct{}, 1),
+		parentOR:           or,
+		padding:            newChannelPadding(),
 	}
+	c.circQueues = newCircuitScheduler(c)
+	c.touch()
+	c.noteWrite()
+	or.trackConnection(c)
+
+	return c
 }
 
 func (c *OnionConnection) randomProxyCircuit() (*ProxyCircuit, error) {
@@ -58,8 +96,22 @@ func (c *OnionConnection) randomProxyCircuit() (*ProxyCircuit, error) {
 	return nil, errors.New("no connections")
 }
 
+func (c *OnionConnection) markClosing() {
+	atomic.StoreInt32(&c.closing, 1)
+}
+
+func (c *OnionConnection) isClosing() bool {
+	return atomic.LoadInt32(&c.closing) != 0
+}
+
+func (c *OnionConnection) circuitLoad() int {
+	return int(atomic.LoadInt32(&c.load))
+}
+
 func (c *OnionConnection) cleanup() {
 	StatsRemoveConnection()
+	c.markClosing()
+	c.parentOR.untrackConnection(c)
 
 	if c.theyAuthenticated {
 		if err := c.parentOR.EndConnection(c.theirFingerprint, c); err != nil {
@@ -79,6 +131,15 @@ func (c *OnionConnection) cleanup() {
 	}
 	c.circuits = nil
 
+	for _, pc := range c.proxyCircuits {
+		c.destroyProxyCircuit(pc, false, false, DESTROY_REASON_OR_CONN_CLOSED)
+	}
+	c.proxyCircuits = nil
+	c.pendingCreates = nil
+	for _, answer := range c.takeCreateAnswers() {
+		answer.ReleaseBuffers()
+	}
+
 	// It is guaranteed that after calling EndConnection we will no longer receive any CircuitRequest
 	// So just process whatever was left.
 readTheQueue:
@@ -87,11 +148,7 @@ readTheQueue:
 		case cmd := <-c.circuitReadQueue:
 			creationRequest, ok := cmd.(*CircuitRequest)
 			if ok {
-				creationRequest.successQueue <- &CircuitDestroyed{
-					reason: 8, // OR_CONN_CLOSED
-					id:     creationRequest.localID,
-					//truncate: true,
-				}
+				creationRequest.fail(DESTROY_REASON_OR_CONN_CLOSED)
 			}
 
 			cmd.ReleaseBuffers()
@@ -101,25 +158,41 @@ readTheQueue:
 	}
 }
 
+func tcpAddressIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	return nil
+}
+
 func HandleORConnClient(or *ORCtx, conn net.Conn, req *CircuitRequest) {
 	// XXX WTF BUG: The Tor spec requires us to allow AUTHORIZE/VPADDING before VERSIONS
 
+	// Other requests for the same relay may be waiting for this connection. They get it once the handshake is
+	// done, or get failed if it never is.
+	var dialedFor *Fingerprint
+	if req != nil {
+		dialedFor = req.connHint.GetFingerprint()
+	}
+	defer func() {
+		if dialedFor != nil {
+			or.finishDial(*dialedFor, nil)
+		}
+	}()
+
 	tlsConn, usedTLSCtx, err := or.WrapTLS(conn, true)
 	if err != nil {
 		Log(LOG_WARN, "%s", err)
 		if req != nil {
-			req.successQueue <- &CircuitDestroyed{
-				reason: 2, //INTERNAL
-				id:     req.localID,
-				//truncate: true,
-			}
+			req.fail(DESTROY_REASON_INTERNAL)
 		}
 		return
 	}
 	defer tlsConn.Close()
 
-	me := newOnionConnection(usedTLSCtx, or)
+	me := newOnionConnection(tlsConn, usedTLSCtx, or)
 	me.isOutbound = true
+	me.theirAddress = tcpAddressIP(conn.RemoteAddr())
 
 	if req != nil {
 		me.circuitReadQueue <- req
@@ -157,6 +230,10 @@ handshake:
 
 		switch cell.Command() {
 		case CMD_NETINFO:
+			if err := me.handleNetinfo(cell); err != nil {
+				Log(LOG_INFO, "%s", err)
+				return
+			}
 			me.sendNetinfo(hash_outbound)
 			break handshake
 
@@ -173,7 +250,11 @@ handshake:
 			}
 
 		case CMD_CERTS:
-			peerCert, err := tlsConn.PeerCertificate()
+			peerCert, err := tlsConn.PeerCertificateDER()
+			if err != nil {
+				Log(LOG_INFO, "%s", err)
+				return
+			}
 			if err = me.handleCerts(cell, peerCert); err != nil {
 				Log(LOG_INFO, "%s", err)
 				return
@@ -194,6 +275,17 @@ handshake:
 		}
 	}
 
+	if dialedFor != nil {
+		// Whoever answered at that address has to prove they're the relay the waiting requests asked for
+		if me.theyAuthenticated && me.theirFingerprint == *dialedFor {
+			or.finishDial(*dialedFor, me)
+		} else {
+			Log(LOG_INFO, "Connection dialed for %s did not authenticate as that relay", *dialedFor)
+			or.finishDial(*dialedFor, nil)
+		}
+		dialedFor = nil
+	}
+
 	hash_inbound = nil
 	hash_outbound = nil
 	me.Runloop()
@@ -207,14 +299,19 @@ func HandleORConnServer(or *ORCtx, conn net.Conn) {
 	}
 	defer tlsConn.Close() // As soon as we leave this function, we make sure the connection is closed
 
-	me := newOnionConnection(usedTLSCtx, or)
+	me := newOnionConnection(tlsConn, usedTLSCtx, or)
 	me.isOutbound = false
+	me.theirAddress = tcpAddressIP(conn.RemoteAddr())
 	defer me.cleanup()
 
+	// Everything up to AUTH_CHALLENGE (ours) and AUTHENTICATE (theirs) ends up in their AUTHENTICATE cell
+	hash_inbound := sha256.New()
+	hash_outbound := sha256.New()
+
 	// Spawn the reader later - we still need to negotiate the version
 	go me.writer(tlsConn)
 
-	if err := me.negotiateVersionServer(tlsConn); err != nil {
+	if err := me.negotiateVersionServer(tlsConn, hash_inbound, hash_outbound); err != nil {
 		Log(LOG_INFO, "%s", err)
 		return
 	}
@@ -223,13 +320,13 @@ func HandleORConnServer(or *ORCtx, conn net.Conn) {
 
 	Log(LOG_CIRC, "Negotiated version %d", me.negotiatedVersion)
 
-	if err := me.sendCerts(nil); err != nil {
+	if err := me.sendCerts(hash_outbound); err != nil {
 		Log(LOG_INFO, "%s", err)
 		return
 	}
 	me.weAuthenticated = true
 
-	if err := me.sendAuthChallenge(); err != nil {
+	if err := me.sendAuthChallenge(hash_outbound); err != nil {
 		Log(LOG_INFO, "%s", err)
 		return
 	}
@@ -247,6 +344,10 @@ handshake:
 			return
 		}
 
+		if cell.Command() != CMD_AUTHENTICATE && !me.theyAuthenticated {
+			hash_inbound.Write(cell.Bytes())
+		}
+
 		switch cell.Command() {
 		case CMD_AUTHORIZE, CMD_PADDING, CMD_VPADDING:
 			// Ignore
@@ -256,9 +357,15 @@ handshake:
 				return
 			}
 		case CMD_AUTHENTICATE:
-			// XXX
+			if err := me.handleAuthenticate(cell, hash_inbound, hash_outbound, tlsConn); err != nil {
+				Log(LOG_INFO, "%s", err)
+				return
+			}
 		case CMD_NETINFO:
-			// Good
+			if err := me.handleNetinfo(cell); err != nil {
+				Log(LOG_INFO, "%s", err)
+				return
+			}
 			break handshake
 		default:
 			// Not good
@@ -269,17 +376,38 @@ handshake:
 		cell.ReleaseBuffers()
 	}
 
+	if me.theyAuthenticated {
+		if err := or.RegisterConnection(me.theirFingerprint, me); err != nil {
+			// No worries
+			Log(LOG_INFO, "register warning: %s", err)
+		}
+	}
+
+	hash_inbound = nil
+	hash_outbound = nil
 	me.Runloop()
 }
 
 func (me *OnionConnection) Runloop() {
 	Log(LOG_CIRC, "handshake done, runloop starting")
 
+	me.startPadding()
+
+	housekeeping := time.NewTicker(CONN_HOUSEKEEPING_INTERVAL)
+	defer housekeeping.Stop()
+
 	for {
 		var err ActionableError
 		var circID CircuitID // XXX This is messed up.
 
 		select {
+		case now := <-housekeeping.C:
+			if me.housekeeping(now) {
+				Log(LOG_INFO, "Closing idle connection")
+				return
+			}
+			continue
+
 		case cell, ok := <-me.readQueue:
 			if !ok {
 				return
@@ -287,6 +415,10 @@ func (me *OnionConnection) Runloop() {
 
 			circID = cell.CircID()
 
+			if cell.Command() != CMD_PADDING && cell.Command() != CMD_VPADDING {
+				me.touch()
+			}
+
 			if cell.Command() != CMD_PADDING {
 				Log(LOG_DEBUG, "%s got a %s: %v", me.parentOR.serverTlsCtx.Fingerprint, cell.Command(), cell)
 			}
@@ -296,11 +428,22 @@ func (me *OnionConnection) Runloop() {
 
 		case circData := <-me.circuitReadQueue:
 			circID = circData.CircID()
+			me.touch()
 
 			err = me.routeCircuitCommandToFunction(circData)
 			circData.ReleaseBuffers()
+
+		case <-me.createAnswersReady:
+			for _, answer := range me.takeCreateAnswers() {
+				if answerErr := me.routeCircuitCommandToFunction(answer); err == nil {
+					err = answerErr
+				}
+				answer.ReleaseBuffers()
+			}
 		}
 
+		atomic.StoreInt32(&me.load, int32(len(me.circuits)+len(me.relayCircuits)+len(me.proxyCircuits)))
+
 		if err != nil {
 			switch err.Handle() {
 			case ERROR_CLOSE_CONNECTION:
@@ -315,7 +458,7 @@ func (me *OnionConnection) Runloop() {
 
 				me.writeQueue <- NewCell(me.negotiatedVersion, circID, CMD_DESTROY, []byte{byte(err.CircDestroyReason())}).Bytes()
 
-				if circID.MSB(me.negotiatedVersion) != me.isOutbound { // Front
+				if me.isTheirCircID(circID) { // Front
 					circ, ok := me.circuits[circID]
 					if !ok {
 						Log(LOG_WARN, "Got a ERROR_CLOSE_CIRCUIT but don't know the circuit. Disconnecting. Original: %s", err)
@@ -355,6 +498,8 @@ func (me *OnionConnection) Runloop() {
 func (c *OnionConnection) reader(conn io.Reader) {
 	defer close(c.readQueue)
 
+	conn = &limitedReader{conn, c}
+
 	var buffer [SSLRecordSize]byte
 	readPos, decodePos := 0, 0
 	for {
@@ -433,9 +578,16 @@ func (c *OnionConnection) writer(conn net.Conn) {
 		conn.Close()
 	}()
 
+	conn = &limitedConn{conn, c}
+
 	var buffer [SSLRecordSize]byte
 	var nextItem []byte
 
+	// Fires when the link has been idle for long enough to need padding
+	padTimer := time.NewTimer(time.Hour)
+	padTimer.Stop()
+	defer padTimer.Stop()
+
 	for {
 		if nextItem != nil {
 			_, err := conn.Write(nextItem)
@@ -445,50 +597,101 @@ func (c *OnionConnection) writer(conn net.Conn) {
 			}
 			ReturnCellBuf(nextItem)
 			nextItem = nil
+			c.noteWrite()
+		}
+
+		if !padTimer.Stop() {
+			select {
+			case <-padTimer.C:
+			default:
+			}
+		}
+		if timeout, ok := c.padding.timeout(); ok {
+			padTimer.Reset(timeout)
 		}
 
 		select {
+		case <-c.padding.changed:
+			// Timeouts changed, pick a new one
+
+		case <-padTimer.C:
+			cell := NewCell(c.negotiatedVersion, 0, CMD_PADDING, nil)
+			_, err := conn.Write(cell.Bytes())
+			cell.ReleaseBuffers()
+			if err != nil {
+				Log(LOG_INFO, "%s", err)
+				return
+			}
+			c.noteWrite()
+
 		case data, ok := <-c.writeQueue:
 			if !ok {
 				return
 			}
+			if !c.writeBatch(conn, data, buffer[:], &nextItem) {
+				return
+			}
 
-			Log(LOG_DEBUG, "writing %d: %v", len(data), data)
+		case <-c.circQueues.ready:
+			data, ok := c.nextQueuedCell()
+			if !ok {
+				return
+			}
+			if data == nil {
+				continue
+			}
+			if !c.writeBatch(conn, data, buffer[:], &nextItem) {
+				return
+			}
+		}
+	}
+}
 
-			datalen := len(data)
-			copy(buffer[:], data)
-			ReturnCellBuf(data)
+// Writes data along with whatever else is queued and fits into buffer. Returns false if the connection broke
+func (c *OnionConnection) writeBatch(conn net.Conn, data, buffer []byte, nextItem *[]byte) bool {
+	Log(LOG_DEBUG, "writing %d: %v", len(data), data)
 
-		extradata:
-			for { // See if we got any extra data
-				select {
-				case data2, ok := <-c.writeQueue:
-					if !ok {
-						break extradata
-					}
+	datalen := len(data)
+	copy(buffer, data)
+	ReturnCellBuf(data)
 
-					if datalen+len(data2) > cap(buffer) {
-						nextItem = data2
-						break extradata
-					}
+	for datalen+MAX_CELL_SIZE <= cap(buffer) { // See if we got any extra data
+		data2, ok := c.nextQueuedCell()
+		if !ok || data2 == nil {
+			break
+		}
 
-					copy(buffer[datalen:], data2)
-					datalen += len(data2)
-					ReturnCellBuf(data2)
+		if datalen+len(data2) > cap(buffer) {
+			*nextItem = data2
+			break
+		}
 
-					if datalen+MAX_CELL_SIZE > cap(buffer) {
-						break extradata
-					}
-				default:
-					break extradata
-				}
-			}
+		copy(buffer[datalen:], data2)
+		datalen += len(data2)
+		ReturnCellBuf(data2)
+	}
+	full := datalen+MAX_CELL_SIZE > cap(buffer) || *nextItem != nil
 
-			_, err := conn.Write(buffer[:datalen])
-			if err != nil {
-				Log(LOG_INFO, "%s", err)
-				return
-			}
-		}
+	_, err := conn.Write(buffer[:datalen])
+	if err != nil {
+		Log(LOG_INFO, "%s", err)
+		return false
+	}
+	c.noteWrite()
+
+	if full {
+		// We stopped because the buffer was full, not because we ran out. Make sure we come back for the rest
+		c.circQueues.wake()
+	}
+	return true
+}
+
+// Link-level cells first, then whatever circuit the scheduler picks. Returns false once writeQueue got closed
+func (c *OnionConnection) nextQueuedCell() ([]byte, bool) {
+	select {
+	case data, ok := <-c.writeQueue:
+		return data, ok
+	default:
+		return c.circQueues.next(), true
 	}
 }
@@ -0,0 +1,210 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"runtime"
+	"time"
+)
+
+// CREATE handshakes are expensive enough that they shouldn't hold up the connection they came in on. They get
+// queued here and answered by a fixed set of workers shared by all connections.
+const ONIONSKIN_QUEUE_LENGTH = 1024
+
+// Anything that waited longer than this gets refused: the client has probably given up anyway
+const ONIONSKIN_MAX_WAIT = 1750 * time.Millisecond
+
+// A connection that lets this many answers pile up gets refusals instead, which don't hold on to a CREATED cell
+const ONIONSKIN_MAX_ANSWERS = ONIONSKIN_QUEUE_LENGTH
+
+func (c *Config) onionSkinWorkers() int {
+	if c.NumCPUs == 0 {
+		return runtime.NumCPU()
+	}
+	return c.NumCPUs
+}
+
+type onionSkinJob struct {
+	conn         *OnionConnection
+	id           CircuitID
+	handshake    HandshakeType
+	data         []byte // Our own copy, the cell is long gone by the time a worker looks at it
+	newHandshake bool
+	queued       time.Time
+}
+
+type onionSkinPool struct {
+	ntor, tap chan *onionSkinJob // ntor is cheap and what everyone should use, so it goes first
+}
+
+func newOnionSkinPool(workers int) *onionSkinPool {
+	p := &onionSkinPool{
+		ntor: make(chan *onionSkinJob, ONIONSKIN_QUEUE_LENGTH),
+		tap:  make(chan *onionSkinJob, ONIONSKIN_QUEUE_LENGTH),
+	}
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+// Never blocks. Returns false if the queue for that kind of handshake is full
+func (p *onionSkinPool) submit(job *onionSkinJob) bool {
+	queue := p.ntor
+	if job.handshake == HANDSHAKE_TAP {
+		queue = p.tap
+	}
+
+	select {
+	case queue <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *onionSkinPool) take() *onionSkinJob {
+	select {
+	case job := <-p.ntor:
+		return job
+	default:
+	}
+
+	select {
+	case job := <-p.ntor:
+		return job
+	case job := <-p.tap:
+		return job
+	}
+}
+
+func (p *onionSkinPool) worker() {
+	for {
+		p.process(p.take(), time.Now())
+	}
+}
+
+func (p *onionSkinPool) process(job *onionSkinJob, now time.Time) {
+	c := job.conn
+	if c.isClosing() {
+		return
+	}
+
+	var answer *CreateAnswered
+	if waited := now.Sub(job.queued); waited > ONIONSKIN_MAX_WAIT {
+		Log(LOG_INFO, "Dropping a %s for circuit %d that waited %s", job.handshake, job.id, waited)
+		answer = &CreateAnswered{
+			id:  job.id,
+			err: RefuseCircuit(errors.New("onion skin queue is too long"), DESTROY_REASON_RESOURCELIMIT),
+		}
+	} else {
+		answer = c.answerCreate(job)
+	}
+
+	c.deliverCreateAnswer(answer)
+}
+
+// Never blocks, so one slow connection can't hold up the workers. Every pending CREATE gets exactly one answer
+// this way: if the connection is too far behind to take the handshake result, the circuit gets refused instead.
+func (c *OnionConnection) deliverCreateAnswer(answer *CreateAnswered) {
+	c.createAnswersLock.Lock()
+	if c.isClosing() {
+		c.createAnswersLock.Unlock()
+		answer.ReleaseBuffers()
+		return
+	}
+	if len(c.createAnswers) >= ONIONSKIN_MAX_ANSWERS && answer.err == nil {
+		Log(LOG_INFO, "Refusing circuit %d, its connection has too many CREATE answers waiting", answer.id)
+		answer.ReleaseBuffers()
+		answer = &CreateAnswered{
+			id:  answer.id,
+			err: RefuseCircuit(errors.New("connection is not keeping up with CREATE answers"), DESTROY_REASON_RESOURCELIMIT),
+		}
+	}
+	c.createAnswers = append(c.createAnswers, answer)
+	c.createAnswersLock.Unlock()
+
+	select {
+	case c.createAnswersReady <- struct{}{}:
+	default: // Already poked, the runloop will pick this up along with the rest
+	}
+}
+
+// Everything the workers handed over since the last call
+func (c *OnionConnection) takeCreateAnswers() []*CreateAnswered {
+	c.createAnswersLock.Lock()
+	defer c.createAnswersLock.Unlock()
+	answers := c.createAnswers
+	c.createAnswers = nil
+	return answers
+}
+
+func (c *OnionConnection) answerCreate(job *onionSkinJob) *CreateAnswered {
+	var reply Cell
+	var keys []byte
+	var err ActionableError
+	switch job.handshake {
+	case HANDSHAKE_TAP:
+		reply, keys, err = c.handleCreateTAP(job.id, job.data, job.newHandshake)
+	case HANDSHAKE_NTOR:
+		reply, keys, err = c.handleCreateNTOR(job.id, job.data, job.newHandshake)
+	case HANDSHAKE_NTOR_V3:
+		reply, keys, err = c.handleCreateNTORv3(job.id, job.data)
+	default:
+		err = RefuseCircuit(errors.New("unknown handshake"), DESTROY_REASON_PROTOCOL)
+	}
+
+	return &CreateAnswered{
+		id:    job.id,
+		reply: reply,
+		keys:  keys,
+		err:   err,
+	}
+}
+
+// Handed back to the connection once a worker is done with a CREATE
+type CreateAnswered struct {
+	NeverForRelay
+	id    CircuitID
+	reply Cell
+	keys  []byte // Forward digest, backward digest, forward key, backward key
+	err   ActionableError
+}
+
+func (a *CreateAnswered) CircID() CircuitID {
+	return 0 // The circuit doesn't exist until we handled this
+}
+
+func (a *CreateAnswered) Handle(c *OnionConnection, circ *Circuit) ActionableError {
+	if _, ok := c.pendingCreates[a.id]; !ok {
+		Log(LOG_CIRC, "Circuit %d went away while its CREATE was being handled", a.id)
+		return nil
+	}
+	delete(c.pendingCreates, a.id)
+
+	if _, ok := c.circuits[a.id]; ok {
+		// handleCreate and handleCreateFast never let this happen, but an existing circuit must not be replaced
+		Log(LOG_WARN, "Circuit %d already exists, not answering its CREATE", a.id)
+		return nil
+	}
+
+	if a.err != nil {
+		Log(LOG_CIRC, "Refusing circuit %d: %s", a.id, a.err)
+		c.writeQueue <- NewCell(c.negotiatedVersion, a.id, CMD_DESTROY, []byte{byte(a.err.CircDestroyReason())}).Bytes()
+		return nil
+	}
+
+	c.circuits[a.id] = NewCircuit(a.id, a.keys[0:20], a.keys[20:40], a.keys[40:56], a.keys[56:72])
+	c.writeQueue <- a.reply.Bytes()
+	a.reply = nil // The writer owns it now
+	return nil
+}
+
+func (a *CreateAnswered) ReleaseBuffers() {
+	if a.reply != nil {
+		a.reply.ReleaseBuffers()
+	}
+}
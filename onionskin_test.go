@@ -0,0 +1,219 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"golang.org/x/crypto/curve25519"
+	"testing"
+	"time"
+)
+
+func testOnionSkinConn(t *testing.T) *OnionConnection {
+	or := &ORCtx{onionSkins: newOnionSkinPool(0)}
+	CRandBytes(or.ntorPrivate[:])
+	pub, err := curve25519.X25519(or.ntorPrivate[:], curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(or.ntorPublic[:], pub)
+
+	tlsCtx := &TorTLS{}
+	CRandBytes(tlsCtx.Fingerprint[:])
+
+	return &OnionConnection{
+		parentOR:           or,
+		usedTLSCtx:         tlsCtx,
+		negotiatedVersion:  4,
+		circuits:           make(map[CircuitID]*Circuit),
+		pendingCreates:     make(map[CircuitID]struct{}),
+		circuitReadQueue:   make(CircReadQueue, 1),
+		createAnswersReady: make(chan struct{}, 1),
+		writeQueue:         make(chan []byte, 2),
+	}
+}
+
+// What the runloop does when createAnswersReady fires, for a single answer
+func testCreateAnswer(t *testing.T, c *OnionConnection) *CreateAnswered {
+	select {
+	case <-c.createAnswersReady:
+	default:
+		t.Fatal("worker did not wake up the connection")
+	}
+	answers := c.takeCreateAnswers()
+	if len(answers) != 1 {
+		t.Fatalf("expected one CREATE answer, got %d", len(answers))
+	}
+	return answers[0]
+}
+
+func TestOnionSkinNtor(t *testing.T) {
+	c := testOnionSkinConn(t)
+
+	state := &CircuitHandshakeState{fingerprint: c.usedTLSCtx.Fingerprint, onionPublic: c.parentOR.ntorPublic}
+	CRandBytes(state.keys[0][:])
+	pub, _ := curve25519.X25519(state.keys[0][:], curve25519.Basepoint)
+	copy(state.keys[1][:], pub)
+	payload, _ := NtorClientPayload(state.fingerprint, state.onionPublic, state.keys[1])
+
+	create := NewCell(4, 0x80001234, CMD_CREATE2, nil)
+	BigEndian.PutUint16(create.Data()[0:2], uint16(HANDSHAKE_NTOR))
+	BigEndian.PutUint16(create.Data()[2:4], uint16(len(payload)))
+	copy(create.Data()[4:], payload[:])
+
+	if err := c.handleCreate(create, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.circuits) != 0 || len(c.writeQueue) != 0 {
+		t.Fatal("handshake happened on the connection instead of a worker")
+	}
+	if err := c.handleCreate(create, true); err == nil || err.Handle() != ERROR_CLOSE_CONNECTION {
+		t.Errorf("expected a second CREATE for a pending circuit to close the connection, got %v", err)
+	}
+
+	pool := c.parentOR.onionSkins
+	pool.process(pool.take(), time.Now())
+	answer := testCreateAnswer(t, c)
+	if answer.err != nil {
+		t.Fatal(answer.err)
+	}
+	keys := answer.keys
+	if err := c.routeCircuitCommandToFunction(answer); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := c.circuits[0x80001234]; !ok {
+		t.Fatal("circuit not created")
+	}
+	created := <-c.writeQueue
+	if Command(created[4]) != CMD_CREATED2 {
+		t.Fatalf("expected a CREATED2, got %s", Command(created[4]))
+	}
+	ourKeys, err := NtorClientComplete(state, created[7:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ourKeys, keys) {
+		t.Error("client and relay disagree on the keys")
+	}
+}
+
+func TestOnionSkinPriorityAndExpiry(t *testing.T) {
+	c := testOnionSkinConn(t)
+	pool := c.parentOR.onionSkins
+	now := time.Now()
+
+	tap := &onionSkinJob{conn: c, id: 0x80000001, handshake: HANDSHAKE_TAP, queued: now}
+	ntor := &onionSkinJob{conn: c, id: 0x80000002, handshake: HANDSHAKE_NTOR, queued: now}
+	if !pool.submit(tap) || !pool.submit(ntor) {
+		t.Fatal("could not queue onion skins")
+	}
+	if pool.take() != ntor || pool.take() != tap {
+		t.Error("ntor did not go before TAP")
+	}
+
+	for i := 0; i < ONIONSKIN_QUEUE_LENGTH; i++ {
+		pool.submit(tap)
+	}
+	if pool.submit(tap) {
+		t.Error("queue took more than ONIONSKIN_QUEUE_LENGTH onion skins")
+	}
+	if !pool.submit(ntor) {
+		t.Error("a full TAP queue held up ntor")
+	}
+
+	// Too old to bother: the client hears RESOURCELIMIT
+	c.pendingCreates[0x80000002] = struct{}{}
+	pool.process(ntor, now.Add(ONIONSKIN_MAX_WAIT+time.Second))
+	if err := c.routeCircuitCommandToFunction(testCreateAnswer(t, c)); err != nil {
+		t.Fatal(err)
+	}
+	destroy := <-c.writeQueue
+	if Command(destroy[4]) != CMD_DESTROY || DestroyReason(destroy[5]) != DESTROY_REASON_RESOURCELIMIT {
+		t.Error("expected a DESTROY with DESTROY_REASON_RESOURCELIMIT")
+	}
+	if len(c.pendingCreates) != 0 || len(c.circuits) != 0 {
+		t.Error("expired CREATE left state behind")
+	}
+
+	// The client gave up before we got to it
+	c.pendingCreates[0x80000002] = struct{}{}
+	if err := c.handleDestroy(NewCell(4, 0x80000002, CMD_DESTROY, []byte{0})); err != nil {
+		t.Fatal(err)
+	}
+	pool.process(ntor, now.Add(ONIONSKIN_MAX_WAIT+time.Second))
+	c.routeCircuitCommandToFunction(testCreateAnswer(t, c))
+	if len(c.writeQueue) != 0 {
+		t.Error("answered a CREATE for a circuit that was destroyed")
+	}
+}
+
+func TestOnionSkinPendingIDs(t *testing.T) {
+	c := testOnionSkinConn(t)
+	pool := c.parentOR.onionSkins
+
+	// A CREATE_FAST can't take over an ID whose CREATE is still with a worker
+	c.pendingCreates[0x80000003] = struct{}{}
+	if err := c.handleCreateFast(NewCell(4, 0x80000003, CMD_CREATE_FAST, nil)); err == nil || err.Handle() != ERROR_CLOSE_CONNECTION {
+		t.Errorf("expected a CREATE_FAST for a pending circuit to close the connection, got %v", err)
+	}
+
+	// Nor can an answer replace a circuit that exists
+	existing := testHopCircuit(60)
+	c.circuits[0x80000003] = existing
+	answer := &CreateAnswered{id: 0x80000003, reply: NewCell(4, 0x80000003, CMD_CREATED2, nil), keys: make([]byte, 72)}
+	if err := c.routeCircuitCommandToFunction(answer); err != nil {
+		t.Fatal(err)
+	}
+	if c.circuits[0x80000003] != existing || len(c.writeQueue) != 0 {
+		t.Error("answered a CREATE for a circuit that already exists")
+	}
+	delete(c.circuits, 0x80000003)
+
+	// A backed-up connection doesn't hold up the worker, its answer waits for the runloop
+	c.circuitReadQueue <- &CreateAnswered{}
+	done := make(chan struct{})
+	go func() {
+		pool.process(&onionSkinJob{conn: c, id: 0x80000004, handshake: HANDSHAKE_NTOR, queued: time.Now()}, time.Now())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("worker blocked on a full circuitReadQueue")
+	}
+	if answer := testCreateAnswer(t, c); answer.id != 0x80000004 {
+		t.Errorf("expected the answer for circuit 80000004, got %x", answer.id)
+	}
+
+	// One that's too far behind gets the circuit refused, so it still leaves pendingCreates
+	for i := 0; i < ONIONSKIN_MAX_ANSWERS; i++ {
+		c.createAnswers = append(c.createAnswers, &CreateAnswered{id: 0x80000006})
+	}
+	c.pendingCreates[0x80000005] = struct{}{}
+	c.deliverCreateAnswer(&CreateAnswered{id: 0x80000005, reply: NewCell(4, 0x80000005, CMD_CREATED2, nil), keys: make([]byte, 72)})
+	answers := c.takeCreateAnswers()
+	refused := answers[len(answers)-1]
+	if refused.id != 0x80000005 || refused.reply != nil || refused.err == nil {
+		t.Fatal("expected a refusal instead of a CREATED2")
+	}
+	if err := c.routeCircuitCommandToFunction(refused); err != nil {
+		t.Fatal(err)
+	}
+	if destroy := <-c.writeQueue; Command(destroy[4]) != CMD_DESTROY || DestroyReason(destroy[5]) != DESTROY_REASON_RESOURCELIMIT {
+		t.Error("expected a DESTROY with DESTROY_REASON_RESOURCELIMIT")
+	}
+	if len(c.pendingCreates) != 0 || len(c.circuits) != 0 {
+		t.Error("refused CREATE left state behind")
+	}
+
+	// Nothing is kept around for a connection that went away
+	<-c.createAnswersReady
+	c.markClosing()
+	c.deliverCreateAnswer(&CreateAnswered{id: 0x80000007})
+	if len(c.takeCreateAnswers()) != 0 || len(c.createAnswersReady) != 0 {
+		t.Error("handed an answer to a connection that is closing")
+	}
+}
@@ -6,10 +6,14 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"github.com/tvdw/gotor/tordir"
-	"github.com/tvdw/openssl"
 	"golang.org/x/crypto/curve25519"
 	"io/ioutil"
 	"math/rand"
@@ -31,17 +35,46 @@ type ORCtx struct {
 	listener net.Listener
 	config   *Config
 
-	// Hold Fingerprint to OnionConnection mappings
-	authenticatedConnections map[Fingerprint]*OnionConnection
+	// Hold Fingerprint to OnionConnection mappings. We may have more than one connection to a relay
+	authenticatedConnections map[Fingerprint][]*OnionConnection
 	authConnLock             sync.Mutex
 
+	// Relays we're opening a connection to, and the circuit requests waiting for it. Also under authConnLock
+	pendingDials map[Fingerprint][]*CircuitRequest
+
 	descriptor tordir.Descriptor
 
-	identityKey, onionKey   openssl.PrivateKey
+	identityKey, onionKey   *rsa.PrivateKey
 	ntorPrivate, ntorPublic [32]byte
+	edIdentityKey           ed25519.PrivateKey
+
+	// Certified by edIdentityKey. Outlives our TLS contexts, which only get link and auth certificates signed by it
+	edSigningKey     ed25519.PrivateKey
+	edSigningCert    []byte
+	edSigningExpires time.Time
+	edCrossCert      []byte // RSA identity -> ed25519 identity, renewed along with the signing key
+	edSigningLock    sync.Mutex
 
 	clientTlsCtx, serverTlsCtx *TorTLS
 	tlsLock                    sync.Mutex
+
+	addressGuess *AddressGuesser
+
+	bandwidth *BandwidthLimiter
+
+	onionSkins *onionSkinPool
+	dos        *DoSMitigation
+	resolver   *DNSResolver
+
+	// Every connection we have open, authenticated or not
+	openConnections map[*OnionConnection]struct{}
+	openConnLock    sync.Mutex
+
+	// Largest clock skew reported by any of our peers recently
+	clockSkew       time.Duration
+	clockSkewNoted  time.Time // When clockSkew was reported
+	clockSkewWarned time.Time
+	clockSkewLock   sync.Mutex
 }
 
 func NewOR(torConf *Config) (*ORCtx, error) {
@@ -53,9 +86,24 @@ func NewOR(torConf *Config) (*ORCtx, error) {
 
 	ctx := &ORCtx{
 		listener:                 listener,
-		authenticatedConnections: make(map[Fingerprint]*OnionConnection),
-		config: torConf,
+		authenticatedConnections: make(map[Fingerprint][]*OnionConnection),
+		pendingDials:             make(map[Fingerprint][]*CircuitRequest),
+		config:                   torConf,
+		addressGuess:             NewAddressGuesser(),
+		openConnections:          make(map[*OnionConnection]struct{}),
+		bandwidth:                NewBandwidthLimiter(torConf),
+		onionSkins:               newOnionSkinPool(torConf.onionSkinWorkers()),
+		dos:                      NewDoSMitigation(torConf),
 	}
+	go ctx.bandwidth.Run()
+	go ctx.dos.Run()
+	queueMem.setLimit(torConf.maxMemInQueues())
+
+	dnsServers, err := DNSServersFromResolvConf(torConf.serverDNSResolvConfFile())
+	if err != nil {
+		Log(LOG_WARN, "Could not read DNS servers from %s, exit streams won't resolve: %s", torConf.serverDNSResolvConfFile(), err)
+	}
+	ctx.resolver = NewDNSResolver(dnsServers, DNS_WORKERS)
 
 	if _, err := os.Stat(torConf.DataDirectory + "/keys/secret_id_key"); os.IsNotExist(err) {
 		Log(LOG_INFO, "Generating new keys")
@@ -69,28 +117,22 @@ func NewOR(torConf *Config) (*ORCtx, error) {
 		}
 
 		{
-			newIDKey, err := openssl.GenerateRSAKeyWithExponent(1024, 65537)
-			if err != nil {
-				return nil, err
-			}
-			newIDKeyPEM, err := newIDKey.MarshalPKCS1PrivateKeyPEM()
+			newIDKey, err := generateRSAKey()
 			if err != nil {
 				return nil, err
 			}
+			newIDKeyPEM := marshalRSAPrivateKeyPEM(newIDKey)
 			if err := ioutil.WriteFile(torConf.DataDirectory+"/keys/secret_id_key", newIDKeyPEM, 0600); err != nil {
 				return nil, err
 			}
 		}
 
 		{
-			newOnionKey, err := openssl.GenerateRSAKeyWithExponent(1024, 65537)
-			if err != nil {
-				return nil, err
-			}
-			newOnionKeyPEM, err := newOnionKey.MarshalPKCS1PrivateKeyPEM()
+			newOnionKey, err := generateRSAKey()
 			if err != nil {
 				return nil, err
 			}
+			newOnionKeyPEM := marshalRSAPrivateKeyPEM(newOnionKey)
 			if err := ioutil.WriteFile(torConf.DataDirectory+"/keys/secret_onion_key", newOnionKeyPEM, 0600); err != nil {
 				return nil, err
 			}
@@ -123,7 +165,7 @@ func NewOR(torConf *Config) (*ORCtx, error) {
 		if err != nil {
 			return nil, err
 		}
-		identityPk, err := openssl.LoadPrivateKeyFromPEM(identityPem)
+		identityPk, err := loadRSAPrivateKeyPEM(identityPem)
 		if err != nil {
 			return nil, err
 		}
@@ -134,7 +176,7 @@ func NewOR(torConf *Config) (*ORCtx, error) {
 		if err != nil {
 			return nil, err
 		}
-		onionPk, err := openssl.LoadPrivateKeyFromPEM(onionPem)
+		onionPk, err := loadRSAPrivateKeyPEM(onionPem)
 		if err != nil {
 			return nil, err
 		}
@@ -152,6 +194,36 @@ func NewOR(torConf *Config) (*ORCtx, error) {
 		copy(ctx.ntorPublic[:], ntorData[64:96])
 	}
 
+	if _, err := os.Stat(torConf.DataDirectory + "/keys/secret_ed25519_master_id_seed"); os.IsNotExist(err) {
+		Log(LOG_INFO, "Generating a new ed25519 identity")
+
+		_, newEdKey, err := ed25519.GenerateKey(crand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		// Unlike C tor we store the seed, not the expanded key, so the file gets a name C tor doesn't use
+		var buf bytes.Buffer
+		buf.WriteString("== ed25519v1-secret: seed ==")
+		for i := buf.Len(); i < 32; i++ {
+			buf.Write([]byte{0})
+		}
+		buf.Write(newEdKey.Seed())
+		if err := ioutil.WriteFile(torConf.DataDirectory+"/keys/secret_ed25519_master_id_seed", buf.Bytes(), 0600); err != nil {
+			return nil, err
+		}
+	}
+	{
+		edData, err := ioutil.ReadFile(torConf.DataDirectory + "/keys/secret_ed25519_master_id_seed")
+		if err != nil {
+			return nil, err
+		}
+		if len(edData) != 32+ed25519.SeedSize {
+			return nil, errors.New("ed25519 identity data corrupt")
+		}
+		ctx.edIdentityKey = ed25519.NewKeyFromSeed(edData[32:])
+	}
+
 	if err := SetupTLS(ctx); err != nil {
 		return nil, err
 	}
@@ -170,7 +242,7 @@ func (or *ORCtx) UpdateDescriptor() {
 	d.Nickname = or.config.Nickname
 	d.Contact = or.config.Contact
 	d.Platform = or.config.Platform
-	d.Address = net.ParseIP(or.config.Address)
+	d.Address = or.Address()
 	d.ORPort = or.config.ORPort
 	d.OnionKey = or.onionKey
 	d.SigningKey = or.identityKey
@@ -179,6 +251,23 @@ func (or *ORCtx) UpdateDescriptor() {
 	d.BandwidthObserved = or.config.BandwidthObserved
 	d.NTORKey = or.ntorPublic[:]
 	d.Family = or.config.Family
+
+	tls := or.GetTLSCtx(false)
+	edIdentity := or.edIdentityKey.Public().(ed25519.PublicKey)
+	d.Ed25519IdentityCert = tls.EdSigningCert
+	d.Ed25519MasterKey = edIdentity
+	d.Ed25519SigningKey = tls.EdSigningKey
+	d.NTORKeyCrossCert, d.NTORKeyCrossCertSign = NewNtorCrossCert(or.ntorPrivate, edIdentity, ED_SIGNING_KEY_LIFETIME)
+
+	// The onion key vouches for both our identities
+	idDigest := sha1.Sum(x509.MarshalPKCS1PublicKey(&or.identityKey.PublicKey))
+	onionCross, err := rsaSignRaw(or.onionKey, append(idDigest[:], edIdentity...))
+	if err != nil {
+		Log(LOG_WARN, "%s", err)
+		return
+	}
+	d.OnionKeyCrossCert = onionCross
+
 	policy, err := or.config.ExitPolicy.Describe()
 	if err != nil {
 		Log(LOG_WARN, "%s", err)
@@ -195,6 +284,62 @@ func (or *ORCtx) UpdateDescriptor() {
 	Log(LOG_DEBUG, "%s", signed)
 }
 
+// Our public IPv4 address: the configured one if we have it, otherwise whatever our peers think it is
+func (or *ORCtx) Address() net.IP {
+	if or.config.Address != "" {
+		return net.ParseIP(or.config.Address)
+	}
+	return or.addressGuess.Guess()
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// Keeps the largest skew reported within CLOCK_SKEW_WINDOW. Only authenticated relays should get a say: anyone
+// can connect to us and send a NETINFO with a silly timestamp.
+func (or *ORCtx) noteClockSkew(skew time.Duration, conn *OnionConnection, now time.Time) {
+	abs := absDuration(skew)
+
+	or.clockSkewLock.Lock()
+	if now.Sub(or.clockSkewNoted) > CLOCK_SKEW_WINDOW || abs >= absDuration(or.clockSkew) {
+		or.clockSkew = skew
+		or.clockSkewNoted = now
+	}
+	warn := abs > CLOCK_SKEW_WARN_THRESHOLD && now.Sub(or.clockSkewWarned) >= CLOCK_SKEW_WARN_INTERVAL
+	if warn {
+		or.clockSkewWarned = now
+	}
+	or.clockSkewLock.Unlock()
+
+	if warn {
+		direction := "ahead"
+		if skew < 0 {
+			direction = "behind"
+		}
+		Log(LOG_WARN, "Our clock is %s %s of relay %s. Tor needs an accurate clock to work: please check your time settings", abs, direction, conn.theirFingerprint)
+	}
+}
+
+// ClockSkew returns the largest clock skew reported by a peer recently (positive if we're ahead of them), and
+// whether it's large enough to worry about
+func (or *ORCtx) ClockSkew() (time.Duration, bool) {
+	return or.clockSkewAt(time.Now())
+}
+
+func (or *ORCtx) clockSkewAt(now time.Time) (time.Duration, bool) {
+	or.clockSkewLock.Lock()
+	defer or.clockSkewLock.Unlock()
+
+	if now.Sub(or.clockSkewNoted) > CLOCK_SKEW_WINDOW {
+		return 0, false
+	}
+	return or.clockSkew, absDuration(or.clockSkew) > CLOCK_SKEW_WARN_THRESHOLD
+}
+
 func (or *ORCtx) PublishDescriptor() error {
 	if or.config.IsPublicServer {
 		or.UpdateDescriptor()
@@ -216,8 +361,16 @@ func (or *ORCtx) Run() {
 			continue
 		}
 
+		ip := tcpAddressIP(conn.RemoteAddr())
+		if !or.dos.openConnection(ip, time.Now()) {
+			Log(LOG_INFO, "Refusing a connection from %s, it has too many open already", ip)
+			conn.Close()
+			continue
+		}
+
 		// Handshake, etc
 		go func() {
+			defer or.dos.closeConnection(ip)
 			defer conn.Close()
 			Log(LOG_DEBUG, "%s says hi", conn.RemoteAddr())
 			HandleORConnServer(or, conn)
@@ -229,13 +382,15 @@ func (or *ORCtx) RegisterConnection(fp Fingerprint, conn *OnionConnection) error
 	or.authConnLock.Lock()
 	defer or.authConnLock.Unlock()
 
-	_, ok := or.authenticatedConnections[fp]
-	if ok {
-		return errors.New("we already have this fingerprint registered")
+	for _, cur := range or.authenticatedConnections[fp] {
+		if cur == conn {
+			return errors.New("this connection is already registered")
+		}
 	}
 
 	Log(LOG_INFO, "registering a connection for fp %s", fp)
-	or.authenticatedConnections[fp] = conn
+	conn.established = time.Now()
+	or.authenticatedConnections[fp] = append(or.authenticatedConnections[fp], conn)
 
 	return nil
 }
@@ -244,18 +399,27 @@ func (or *ORCtx) EndConnection(fp Fingerprint, conn *OnionConnection) error {
 	or.authConnLock.Lock()
 	defer or.authConnLock.Unlock()
 
-	cur, ok := or.authenticatedConnections[fp]
+	conns, ok := or.authenticatedConnections[fp]
 	if !ok {
 		return nil // Not an error
 	}
 
-	if cur != conn {
-		return errors.New("mismatch: another connection is registered")
-	}
+	for i, cur := range conns {
+		if cur == conn {
+			conns[i] = conns[len(conns)-1]
+			conns[len(conns)-1] = nil
+			conns = conns[:len(conns)-1]
 
-	delete(or.authenticatedConnections, fp)
+			if len(conns) == 0 {
+				delete(or.authenticatedConnections, fp)
+			} else {
+				or.authenticatedConnections[fp] = conns
+			}
+			return nil
+		}
+	}
 
-	return nil
+	return errors.New("mismatch: this connection was never registered")
 }
 
 func (or *ORCtx) RequestCircuit(req *CircuitRequest) error {
@@ -264,9 +428,8 @@ func (or *ORCtx) RequestCircuit(req *CircuitRequest) error {
 
 	fp := req.connHint.GetFingerprint()
 	if fp != nil {
-		// XXX This needs to be a lot smarter (check IP addresses, etc)
-		conn, ok := or.authenticatedConnections[*fp]
-		if ok {
+		conn := selectConnectionForExtend(or.authenticatedConnections[*fp], req.connHint.GetIPs(), time.Now())
+		if conn != nil {
 			conn.circuitReadQueue <- req
 			return nil
 		}
@@ -275,16 +438,27 @@ func (or *ORCtx) RequestCircuit(req *CircuitRequest) error {
 	//todo check aborted lock?
 	if req.extendCircId != 0 {
 		fmt.Println("looking for", req.extendCircId)
-		for _, conn := range or.authenticatedConnections {
-			_, ok := conn.proxyCircuits[req.extendCircId]
-			if ok {
-				conn.circuitReadQueue <- req
-				return nil
+		for _, conns := range or.authenticatedConnections {
+			for _, conn := range conns {
+				_, ok := conn.proxyCircuits[req.extendCircId]
+				if ok {
+					conn.circuitReadQueue <- req
+					return nil
+				}
 			}
 		}
 		return errors.New("Can't extend from nonexistent circuit")
 	}
 
+	// Somebody is connecting there already: their connection will do for us too
+	if fp != nil {
+		if waiting, dialing := or.pendingDials[*fp]; dialing {
+			or.pendingDials[*fp] = append(waiting, req)
+			return nil
+		}
+		or.pendingDials[*fp] = nil
+	}
+
 	// Try and dial
 	go func() {
 		addresses := req.connHint.GetAddresses()
@@ -295,6 +469,9 @@ func (or *ORCtx) RequestCircuit(req *CircuitRequest) error {
 			req.handshakeState.lock.Unlock()
 			if aborted {
 				Log(LOG_INFO, "Aborting connection attempt")
+				if fp != nil {
+					or.finishDial(*fp, nil)
+				}
 				return
 			}
 
@@ -313,19 +490,32 @@ func (or *ORCtx) RequestCircuit(req *CircuitRequest) error {
 		}
 
 		// Bad luck but it does need to be reported
-		req.successQueue <- &CircuitDestroyed{
-			id:     req.localID,
-			reason: 6, //CONNECTFAILED
-			//truncate: true,
+		req.fail(DESTROY_REASON_CONNECTFAILED)
+		if fp != nil {
+			or.finishDial(*fp, nil)
 		}
 	}()
 
 	return nil
 }
 
-func (or *ORCtx) RequestProxyCircuit(extCirc CircuitID, theirAddress []byte, theirFingerprint Fingerprint, theirPublic [32]byte) (chan CircuitID, error) {
-	doneChan := make(chan CircuitID)
+// Hands the requests that were waiting for a connection to fp over to it, or fails them if we couldn't connect
+func (or *ORCtx) finishDial(fp Fingerprint, conn *OnionConnection) {
+	or.authConnLock.Lock()
+	waiting := or.pendingDials[fp]
+	delete(or.pendingDials, fp)
+	or.authConnLock.Unlock()
+
+	for _, req := range waiting {
+		if conn != nil {
+			conn.circuitReadQueue <- req
+		} else {
+			req.fail(DESTROY_REASON_CONNECTFAILED)
+		}
+	}
+}
 
+func (or *ORCtx) RequestProxyCircuit(extCirc CircuitID, theirAddress []byte, theirFingerprint Fingerprint, theirPublic [32]byte) (chan CircuitBuildResult, error) {
 	var curveDataPriv [32]byte
 	var curveDataPub [32]byte
 	CRandBytes(curveDataPriv[0:32])
@@ -338,45 +528,114 @@ func (or *ORCtx) RequestProxyCircuit(extCirc CircuitID, theirAddress []byte, the
 	if err != nil {
 		return nil, err
 	}
-	err = or.RequestCircuit(&CircuitRequest{
+	return or.requestProxyCircuit(extCirc, theirAddress, hdata[:], &CircuitHandshakeState{
+		handshake:   HANDSHAKE_NTOR,
+		keys:        [2][32]byte{curveDataPriv, curveDataPub},
+		fingerprint: theirFingerprint,
+		onionPublic: theirPublic,
+	})
+}
+
+// RequestNtorV3ProxyCircuit is RequestProxyCircuit with the ntor v3 handshake, which also needs the relay's
+// ed25519 identity and can carry extensions
+func (or *ORCtx) RequestNtorV3ProxyCircuit(extCirc CircuitID, theirAddress []byte, theirFingerprint Fingerprint, theirEdIdentity ed25519.PublicKey, theirPublic [32]byte, extensions []NtorV3Extension) (chan CircuitBuildResult, error) {
+	var curveDataPriv [32]byte
+	CRandBytes(curveDataPriv[0:32])
+	curveDataPub, err := curve25519.X25519(curveDataPriv[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &CircuitHandshakeState{
+		handshake:   HANDSHAKE_NTOR_V3,
+		fingerprint: theirFingerprint,
+		onionPublic: theirPublic,
+		edIdentity:  theirEdIdentity,
+	}
+	state.keys[0] = curveDataPriv
+	copy(state.keys[1][:], curveDataPub)
+
+	hdata, err := NtorV3ClientPayload(state, extensions)
+	if err != nil {
+		return nil, err
+	}
+	return or.requestProxyCircuit(extCirc, theirAddress, hdata, state)
+}
+
+// RequestTAPProxyCircuit is RequestProxyCircuit for relays that only have an RSA onion key
+func (or *ORCtx) RequestTAPProxyCircuit(extCirc CircuitID, theirAddress []byte, theirFingerprint Fingerprint, onionKey *rsa.PublicKey) (chan CircuitBuildResult, error) {
+	hdata, private, err := TAPClientPayload(onionKey)
+	if err != nil {
+		return nil, err
+	}
+	return or.requestProxyCircuit(extCirc, theirAddress, hdata, &CircuitHandshakeState{
+		handshake:   HANDSHAKE_TAP,
+		secret:      private,
+		fingerprint: theirFingerprint,
+	})
+}
+
+// RequestFastProxyCircuit builds a first hop with CREATE_FAST, which can't be used to extend
+func (or *ORCtx) RequestFastProxyCircuit(theirAddress []byte, theirFingerprint Fingerprint) (chan CircuitBuildResult, error) {
+	hdata, err := FastClientPayload()
+	if err != nil {
+		return nil, err
+	}
+	return or.requestProxyCircuit(0, theirAddress, hdata, &CircuitHandshakeState{
+		handshake:   HANDSHAKE_FAST,
+		secret:      hdata,
+		fingerprint: theirFingerprint,
+	})
+}
+
+func (or *ORCtx) requestProxyCircuit(extCirc CircuitID, theirAddress []byte, hdata []byte, state *CircuitHandshakeState) (chan CircuitBuildResult, error) {
+	doneChan := make(chan CircuitBuildResult, 1)
+	state.whenDone = doneChan
+	state.startDeadline(or.config.circuitBuildTimeout())
+
+	err := or.RequestCircuit(&CircuitRequest{
 		connHint: ConnectionHint{
 			address: [][]byte{theirAddress},
 		},
-		handshakeState: &CircuitHandshakeState{
-			keys:        [2][32]byte{curveDataPriv, curveDataPub},
-			fingerprint: theirFingerprint,
-			onionPublic: theirPublic,
-			whenDone:    doneChan,
-		},
+		handshakeState: state,
 		newHandshake:   true,
-		handshakeType:  uint16(HANDSHAKE_NTOR),
-		handshakeData:  hdata[:],
+		handshakeType:  uint16(state.handshake),
+		handshakeData:  hdata,
 		weAreInitiator: true,
 		extendCircId:   extCirc,
 	})
+	if err != nil {
+		state.finish(buildFailed(DESTROY_REASON_INTERNAL, err.Error()))
+	}
 	return doneChan, err
 }
 
 func (or *ORCtx) DestroyAllProxyCircuits() {
-	for _, conn := range or.authenticatedConnections {
-		for _, pc := range conn.proxyCircuits {
-			fmt.Println("queueing destroy for circuit", pc.id)
-			conn.writeQueue <- NewCell(conn.negotiatedVersion, pc.id, CMD_DESTROY, []byte{0}).Bytes()
+	or.authConnLock.Lock()
+	defer or.authConnLock.Unlock()
+
+	for _, conns := range or.authenticatedConnections {
+		for _, conn := range conns {
+			conn.circuitReadQueue <- &DestroyProxyCircuits{reason: DESTROY_REASON_NONE}
 		}
 	}
 }
 
 func (or *ORCtx) RandomConnection() (*OnionConnection, error) {
-	for _, conn := range or.authenticatedConnections {
-		return conn, nil
+	for _, conns := range or.authenticatedConnections {
+		for _, conn := range conns {
+			return conn, nil
+		}
 	}
 	return nil, errors.New("no connections")
 }
 
 func (or *ORCtx) ListConns() {
-	for fp, conn := range or.authenticatedConnections {
-		for pc, _ := range conn.proxyCircuits {
-			fmt.Printf("conn %s has pc %d\n", fp.String(), pc)
+	for fp, conns := range or.authenticatedConnections {
+		for _, conn := range conns {
+			for pc, _ := range conn.proxyCircuits {
+				fmt.Printf("conn %s has pc %d\n", fp.String(), pc)
+			}
 		}
 	}
 }
@@ -388,7 +647,14 @@ func (c *OnionConnection) sendProxyCell(pc *ProxyCircuit, stream StreamID, comma
 		panic("Somehow we're trying to send a massive cell")
 	}
 
-	cell := NewCell(c.negotiatedVersion, pc.id, CMD_RELAY, nil)
+	// The first hop can see which cells are RELAY_EARLY anyway, and EXTENDs need the budget more
+	cmd := CMD_RELAY
+	if len(pc.forwardChain) > 1 && pc.relayEarlyCount < MAX_RELAY_EARLY-RELAY_EARLY_EXTEND_RESERVE {
+		cmd = CMD_RELAY_EARLY
+		pc.relayEarlyCount++
+	}
+
+	cell := NewCell(c.negotiatedVersion, pc.id, cmd, nil)
 	buf := cell.Data()
 
 	// The rest will be crypto'd
@@ -405,6 +671,9 @@ func (c *OnionConnection) sendProxyCell(pc *ProxyCircuit, stream StreamID, comma
 	}
 
 	pc.forwardChain[len(pc.forwardChain)-1].digest.Write(buf)
+	if command == RELAY_DATA {
+		pc.sendme.notePackaged(pc.forwardChain[len(pc.forwardChain)-1].digest)
+	}
 	digest := pc.forwardChain[len(pc.forwardChain)-1].digest.Sum(nil)
 	buf[5] = digest[0]
 	buf[6] = digest[1]
@@ -418,7 +687,7 @@ func (c *OnionConnection) sendProxyCell(pc *ProxyCircuit, stream StreamID, comma
 		pc.forwardChain[i].cipher.Crypt(buf, buf)
 	}
 
-	c.writeQueue <- cell.Bytes() // XXX this could deadlock
+	c.circQueues.enqueue(pc.id, pc.backwardWindow, cell.Bytes())
 
 	return nil
 }
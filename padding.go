@@ -0,0 +1,173 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Netflow padding timeouts from padding-spec.txt, in milliseconds. C tor takes these from the consensus, but
+// these are its defaults.
+const (
+	PADDING_ITO_LOW_DEFAULT  = 1500
+	PADDING_ITO_HIGH_DEFAULT = 9500
+	PADDING_ITO_LOW_REDUCED  = 9000
+	PADDING_ITO_HIGH_REDUCED = 14000
+)
+
+// PADDING_NEGOTIATE commands
+const (
+	PADDING_NEGOTIATE_STOP  = 1
+	PADDING_NEGOTIATE_START = 2
+)
+
+// channelPadding decides when a connection needs a PADDING cell. The runloop configures it, the writer uses it.
+type channelPadding struct {
+	lock        sync.Mutex
+	enabled     bool
+	hadCircuits bool // Links that never carried a circuit are not interesting to an observer
+	low, high   time.Duration
+
+	changed chan struct{} // Pokes the writer when the timeouts changed
+}
+
+func newChannelPadding() *channelPadding {
+	return &channelPadding{
+		low:     PADDING_ITO_LOW_DEFAULT * time.Millisecond,
+		high:    PADDING_ITO_HIGH_DEFAULT * time.Millisecond,
+		changed: make(chan struct{}, 1),
+	}
+}
+
+func (p *channelPadding) poke() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (p *channelPadding) start(low, high time.Duration) {
+	p.lock.Lock()
+	p.enabled = true
+	p.low, p.high = low, high
+	p.lock.Unlock()
+	p.poke()
+}
+
+func (p *channelPadding) stop() {
+	p.lock.Lock()
+	p.enabled = false
+	p.lock.Unlock()
+	p.poke()
+}
+
+func (p *channelPadding) noteCircuit() {
+	p.lock.Lock()
+	wasUsed := p.hadCircuits
+	p.hadCircuits = true
+	p.lock.Unlock()
+	if !wasUsed {
+		p.poke()
+	}
+}
+
+// How long the link may stay idle before we send padding. false if we shouldn't pad at all.
+func (p *channelPadding) timeout() (time.Duration, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.enabled || !p.hadCircuits {
+		return 0, false
+	}
+	return samplePaddingTimeout(p.low, p.high), true
+}
+
+// The maximum of two uniform samples, which is what padding-spec.txt asks for
+func samplePaddingTimeout(low, high time.Duration) time.Duration {
+	if high <= low {
+		return low
+	}
+	a := low + time.Duration(rand.Int63n(int64(high-low)+1))
+	b := low + time.Duration(rand.Int63n(int64(high-low)+1))
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (c *OnionConnection) paddingTimeouts() (uint16, uint16) {
+	if c.parentOR.config.ReducedConnectionPadding {
+		return PADDING_ITO_LOW_REDUCED, PADDING_ITO_HIGH_REDUCED
+	}
+	return PADDING_ITO_LOW_DEFAULT, PADDING_ITO_HIGH_DEFAULT
+}
+
+// Called once the handshake is done. Like C tor we only pad links to clients, and links where we are the client.
+func (c *OnionConnection) startPadding() {
+	if !c.negotiatedVersion.SupportsPaddingNegotiate() {
+		return
+	}
+
+	weAreClient := c.isOutbound && !c.weAuthenticated
+	theyAreClient := !c.isOutbound && !c.theyAuthenticated
+	if !weAreClient && !theyAreClient {
+		return
+	}
+
+	low, high := c.paddingTimeouts()
+	c.padding.start(time.Duration(low)*time.Millisecond, time.Duration(high)*time.Millisecond)
+
+	if weAreClient && c.parentOR.config.ReducedConnectionPadding {
+		// Ask the relay to pad less as well
+		c.sendPaddingNegotiate(PADDING_NEGOTIATE_START, low, high)
+	}
+}
+
+func (c *OnionConnection) sendPaddingNegotiate(command byte, low, high uint16) {
+	cell := NewCell(c.negotiatedVersion, 0, CMD_PADDING_NEGOTIATE, nil)
+	data := cell.Data()
+	data[0] = 0 // Version
+	data[1] = command
+	BigEndian.PutUint16(data[2:4], low)
+	BigEndian.PutUint16(data[4:6], high)
+	c.writeQueue <- cell.Bytes()
+}
+
+func (c *OnionConnection) handlePaddingNegotiate(cell Cell) ActionableError {
+	data := cell.Data()
+	if data[0] != 0 {
+		Log(LOG_INFO, "Got a PADDING_NEGOTIATE of unknown version %d - dropping", data[0])
+		return nil
+	}
+
+	switch data[1] {
+	case PADDING_NEGOTIATE_STOP:
+		c.padding.stop()
+
+	case PADDING_NEGOTIATE_START:
+		theirLow, theirHigh := BigEndian.Uint16(data[2:4]), BigEndian.Uint16(data[4:6])
+		if theirLow > theirHigh {
+			return CloseConnection(errors.New("PADDING_NEGOTIATE with a low timeout above the high one"))
+		}
+
+		// They may ask for less padding, not more
+		low, high := c.paddingTimeouts()
+		if theirLow > low {
+			low = theirLow
+		}
+		if theirHigh > high {
+			high = theirHigh
+		}
+		c.padding.start(time.Duration(low)*time.Millisecond, time.Duration(high)*time.Millisecond)
+
+	default:
+		Log(LOG_INFO, "Got a PADDING_NEGOTIATE with unknown command %d - dropping", data[1])
+	}
+
+	return nil
+}
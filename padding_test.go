@@ -0,0 +1,56 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSamplePaddingTimeout(t *testing.T) {
+	low, high := 1500*time.Millisecond, 9500*time.Millisecond
+	var total time.Duration
+	for i := 0; i < 10000; i++ {
+		timeout := samplePaddingTimeout(low, high)
+		if timeout < low || timeout > high {
+			t.Fatalf("timeout %s outside of [%s, %s]", timeout, low, high)
+		}
+		total += timeout
+	}
+
+	// The maximum of two uniform samples averages at two thirds of the range, 6833ms here. The mean of 10000
+	// samples has a standard deviation of about 19ms.
+	mean := total / 10000
+	if mean < 6733*time.Millisecond || mean > 6933*time.Millisecond {
+		t.Errorf("unexpected mean %s", mean)
+	}
+
+	if samplePaddingTimeout(low, low) != low {
+		t.Error("empty range should give the low timeout")
+	}
+}
+
+func TestChannelPadding(t *testing.T) {
+	p := newChannelPadding()
+	if _, ok := p.timeout(); ok {
+		t.Error("padding before it was started")
+	}
+
+	p.start(time.Second, 2*time.Second)
+	if _, ok := p.timeout(); ok {
+		t.Error("padding a link that never had circuits")
+	}
+
+	p.noteCircuit()
+	timeout, ok := p.timeout()
+	if !ok || timeout < time.Second || timeout > 2*time.Second {
+		t.Errorf("unexpected timeout %s", timeout)
+	}
+
+	p.stop()
+	if _, ok := p.timeout(); ok {
+		t.Error("padding after it was stopped")
+	}
+}
@@ -10,25 +10,27 @@ type Command byte
 type RelayCommand byte
 type DestroyReason byte
 type StreamEndReason byte
+type BeginFlags uint32
 
 const (
-	CMD_PADDING        Command = 0
-	CMD_CREATE         Command = 1
-	CMD_CREATED        Command = 2
-	CMD_RELAY          Command = 3
-	CMD_DESTROY        Command = 4
-	CMD_CREATE_FAST    Command = 5
-	CMD_CREATED_FAST   Command = 6
-	CMD_VERSIONS       Command = 7
-	CMD_NETINFO        Command = 8
-	CMD_RELAY_EARLY    Command = 9
-	CMD_CREATE2        Command = 10
-	CMD_CREATED2       Command = 11
-	CMD_VPADDING       Command = 128
-	CMD_CERTS          Command = 129
-	CMD_AUTH_CHALLENGE Command = 130
-	CMD_AUTHENTICATE   Command = 131
-	CMD_AUTHORIZE      Command = 132
+	CMD_PADDING           Command = 0
+	CMD_CREATE            Command = 1
+	CMD_CREATED           Command = 2
+	CMD_RELAY             Command = 3
+	CMD_DESTROY           Command = 4
+	CMD_CREATE_FAST       Command = 5
+	CMD_CREATED_FAST      Command = 6
+	CMD_VERSIONS          Command = 7
+	CMD_NETINFO           Command = 8
+	CMD_RELAY_EARLY       Command = 9
+	CMD_CREATE2           Command = 10
+	CMD_CREATED2          Command = 11
+	CMD_PADDING_NEGOTIATE Command = 12
+	CMD_VPADDING          Command = 128
+	CMD_CERTS             Command = 129
+	CMD_AUTH_CHALLENGE    Command = 130
+	CMD_AUTHENTICATE      Command = 131
+	CMD_AUTHORIZE         Command = 132
 )
 
 const (
@@ -83,6 +85,12 @@ const (
 	STREAM_REASON_NOTDIRECTORY
 )
 
+const (
+	BEGIN_FLAG_IPV6_OK        BeginFlags = 1 << 0
+	BEGIN_FLAG_IPV4_NOT_OK    BeginFlags = 1 << 1
+	BEGIN_FLAG_IPV6_PREFERRED BeginFlags = 1 << 2
+)
+
 func (c Command) String() string {
 	switch c {
 	case CMD_PADDING:
@@ -109,6 +117,8 @@ func (c Command) String() string {
 		return "CMD_CREATE2"
 	case CMD_CREATED2:
 		return "CMD_CREATED2"
+	case CMD_PADDING_NEGOTIATE:
+		return "CMD_PADDING_NEGOTIATE"
 	case CMD_VPADDING:
 		return "CMD_VPADDING"
 	case CMD_CERTS:
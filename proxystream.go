@@ -12,6 +12,7 @@ func (s *Stream) ProxyRun(circID CircuitID, circWindow *Window, queue CircReadQu
 	defer func() {
 		conn.Close()
 
+		s.releaseQueued()
 		s.backwardWindow.Abort()
 		s.forwardWindow.Abort()
 		circWindow.Abort()
@@ -32,6 +33,7 @@ func (s *Stream) ProxyRun(circID CircuitID, circWindow *Window, queue CircReadQu
 				return
 			}
 			_, err := conn.Write(data)
+			s.dataWritten(len(data))
 			if err != nil {
 				return
 			}
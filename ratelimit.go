@@ -0,0 +1,158 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often the token buckets get refilled
+const TOKEN_BUCKET_REFILL_INTERVAL = 100 * time.Millisecond
+
+// TokenBucket hands out bytes at a fixed rate, with bursts of up to its size. Traffic is paid for after the fact:
+// the bucket may go into debt, and whoever pays next waits until it's out of it.
+type TokenBucket struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	rate   int // Bytes per second
+	burst  int
+	tokens int
+}
+
+func NewTokenBucket(rate, burst int) *TokenBucket {
+	if burst < rate {
+		burst = rate
+	}
+	b := &TokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+	}
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+func (b *TokenBucket) Refill(elapsed time.Duration) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	b.tokens += int(int64(b.rate) * int64(elapsed) / int64(time.Second))
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.lock.Unlock()
+	b.cond.Broadcast()
+}
+
+// Take pays for n bytes, and blocks for as long as the bucket is in debt
+func (b *TokenBucket) Take(n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens -= n
+	for b.tokens < 0 {
+		b.cond.Wait()
+	}
+}
+
+// BandwidthLimiter enforces BandwidthRate/Burst on all traffic, and RelayBandwidthRate/Burst on top of that for
+// relayed traffic. Buckets without a configured rate are nil, and don't limit anything.
+type BandwidthLimiter struct {
+	read, write           *TokenBucket
+	relayRead, relayWrite *TokenBucket
+}
+
+func NewBandwidthLimiter(config *Config) *BandwidthLimiter {
+	l := &BandwidthLimiter{}
+	if config.BandwidthAvg > 0 {
+		l.read = NewTokenBucket(config.BandwidthAvg, config.BandwidthBurst)
+		l.write = NewTokenBucket(config.BandwidthAvg, config.BandwidthBurst)
+	}
+	if config.RelayBandwidthAvg > 0 {
+		l.relayRead = NewTokenBucket(config.RelayBandwidthAvg, config.RelayBandwidthBurst)
+		l.relayWrite = NewTokenBucket(config.RelayBandwidthAvg, config.RelayBandwidthBurst)
+	}
+	return l
+}
+
+func (l *BandwidthLimiter) Run() {
+	if l.read == nil && l.relayRead == nil {
+		return
+	}
+
+	ticker := time.NewTicker(TOKEN_BUCKET_REFILL_INTERVAL)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for now := range ticker.C {
+		elapsed := now.Sub(last)
+		last = now
+
+		l.read.Refill(elapsed)
+		l.write.Refill(elapsed)
+		l.relayRead.Refill(elapsed)
+		l.relayWrite.Refill(elapsed)
+	}
+}
+
+func (l *BandwidthLimiter) noteRead(n int, relayed bool) {
+	if l == nil {
+		return
+	}
+	l.read.Take(n)
+	if relayed {
+		l.relayRead.Take(n)
+	}
+}
+
+func (l *BandwidthLimiter) noteWrite(n int, relayed bool) {
+	if l == nil {
+		return
+	}
+	l.write.Take(n)
+	if relayed {
+		l.relayWrite.Take(n)
+	}
+}
+
+// Like C tor, a connection carries relayed traffic unless we use it for circuits of our own
+func (c *OnionConnection) countsAsRelayed() bool {
+	return atomic.LoadInt32(&c.clientUsed) == 0
+}
+
+func (c *OnionConnection) markClientUsed() {
+	atomic.StoreInt32(&c.clientUsed, 1)
+}
+
+type limitedReader struct {
+	io.Reader
+	conn *OnionConnection
+}
+
+func (r *limitedReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.conn.parentOR.bandwidth.noteRead(n, r.conn.countsAsRelayed())
+	return n, err
+}
+
+type limitedConn struct {
+	net.Conn
+	conn *OnionConnection
+}
+
+func (w *limitedConn) Write(b []byte) (int, error) {
+	n, err := w.Conn.Write(b)
+	w.conn.parentOR.bandwidth.noteWrite(n, w.conn.countsAsRelayed())
+	return n, err
+}
@@ -0,0 +1,73 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(1000, 500)
+	if b.burst != 1000 {
+		t.Errorf("burst should be at least the rate, got %d", b.burst)
+	}
+
+	b.Take(600)
+	b.Refill(time.Second)
+	if b.tokens != 1000 {
+		t.Errorf("refill should stop at the burst, got %d tokens", b.tokens)
+	}
+
+	// Going into debt blocks until the refills have paid it off
+	done := make(chan struct{})
+	go func() {
+		b.Take(1200)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Take should have blocked")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	b.Refill(100 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("Take should still be blocked")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	b.Refill(100 * time.Millisecond)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Take should be done")
+	}
+	if b.tokens != 0 {
+		t.Errorf("expected an empty bucket, got %d tokens", b.tokens)
+	}
+
+	var unlimited *TokenBucket
+	unlimited.Take(1000000)
+	unlimited.Refill(time.Second)
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	l := NewBandwidthLimiter(&Config{RelayBandwidthAvg: 100})
+	if l.read != nil || l.write != nil {
+		t.Error("no BandwidthRate means no global limit")
+	}
+
+	l.noteWrite(1000, false) // Not relayed, so not limited
+	if l.relayWrite.tokens != 100 {
+		t.Errorf("unrelayed traffic was counted, %d tokens left", l.relayWrite.tokens)
+	}
+	l.noteWrite(50, true)
+	if l.relayWrite.tokens != 50 {
+		t.Errorf("relayed traffic was not counted, %d tokens left", l.relayWrite.tokens)
+	}
+}
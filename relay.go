@@ -37,13 +37,17 @@ func (c *OnionConnection) handleRelayBackward(circ *RelayCircuit, cell Cell) Act
 func (c *OnionConnection) handleRelayProxy(circ *ProxyCircuit, cell Cell) ActionableError {
 	data := cell.Data()
 
-	for i := 0; i < len(circ.backwardChain); i++ {
-		circ.backwardChain[i].cipher.Crypt(data, data)
+	hop := circ.decryptBackward(data)
+	if hop < 0 {
+		Log(LOG_INFO, "Dropping a relay cell on proxy circuit %d that none of the hops recognized", circ.id)
+		return nil
 	}
 	rcell := RelayCell{data}
 
-	if rcell.Command() == RELAY_EXTENDED2 {
-		pcell := NewCell4(cell.CircID(), CMD_CREATED2, rcell.Data())
+	if rcell.Command() == RELAY_TRUNCATED {
+		return c.handleRelayTruncatedProxy(circ, hop, &rcell)
+	} else if rcell.Command() == RELAY_EXTENDED2 {
+		pcell := NewCell(c.negotiatedVersion, cell.CircID(), CMD_CREATED2, rcell.Data())
 		return c.handleCreated(pcell, true)
 	} else if rcell.Command() == RELAY_CONNECTED {
 		pendingStream, ok := circ.pendingStreams[rcell.StreamID()]
@@ -51,6 +55,11 @@ func (c *OnionConnection) handleRelayProxy(circ *ProxyCircuit, cell Cell) Action
 			fmt.Println("NOT OK")
 			return nil
 		}
+		if addr, ttl, err := decodeConnected(rcell.Data()); err != nil {
+			Log(LOG_INFO, "Stream %d on proxy circuit %d: %s", rcell.StreamID(), circ.id, err)
+		} else if addr != nil {
+			Log(LOG_CIRC, "Stream %d on proxy circuit %d connected to %s (TTL %d)", rcell.StreamID(), circ.id, addr, ttl)
+		}
 		err = FinishSocks(pendingStream.socksConn)
 		if err != nil {
 			fmt.Println(err)
@@ -64,11 +73,18 @@ func (c *OnionConnection) handleRelayProxy(circ *ProxyCircuit, cell Cell) Action
 		if circ.streams == nil {
 			circ.streams = make(map[StreamID]*Stream)
 		}
+		stream.mem = c.circQueues.account(circ.id)
 		circ.streams[stream.id] = stream
 		go stream.ProxyRun(circ.id, circ.backwardWindow, c.circuitReadQueue, pendingStream.socksConn)
 		return nil
 	} else if rcell.Command() == RELAY_DATA {
-		c.handleRelayDataProxy(circ, &rcell)
+		c.handleRelayDataProxy(circ, hop, &rcell)
+		return nil
+	} else if rcell.Command() == RELAY_SENDME {
+		if err := c.handleRelaySendme(&circ.Circuit, &rcell); err != nil {
+			Log(LOG_NOTICE, "Closing proxy circuit %d: %s", circ.id, err)
+			c.destroyProxyCircuit(circ, true, true, err.CircDestroyReason())
+		}
 		return nil
 	} else if rcell.Command() == RELAY_END {
 		fmt.Println("GOT RELAY END, FIGURE THIS OUT")
@@ -79,6 +95,13 @@ func (c *OnionConnection) handleRelayProxy(circ *ProxyCircuit, cell Cell) Action
 }
 
 func (c *OnionConnection) handleRelayForward(circ *Circuit, cell Cell) ActionableError {
+	if cell.Command() == CMD_RELAY_EARLY {
+		circ.relayEarlyCount++
+		if circ.relayEarlyCount > MAX_RELAY_EARLY {
+			return CloseCircuit(errors.New("too many RELAY_EARLY cells"), DESTROY_REASON_PROTOCOL)
+		}
+	}
+
 	cstate := circ.forward
 
 	dec, err := cstate.cipher.Crypt(cell.Data(), GetCellBuf(false))
@@ -125,7 +148,7 @@ func (c *OnionConnection) handleRelayForward(circ *Circuit, cell Cell) Actionabl
 			id:       circ.nextHopID,
 			data:     dec,
 			forRelay: true,
-			rType:    cell.Command(),
+			rType:    cell.Command(), // A RELAY_EARLY got past the budget check above
 		}
 		return nil
 	}
@@ -166,6 +189,8 @@ func (c *OnionConnection) handleRelayDecrypted(circ *Circuit, cell Cell, rcell *
 		err = c.handleRelayExtend2(circ, rcell)
 	case RELAY_RESOLVE:
 		err = c.handleRelayResolve(circ, rcell)
+	case RELAY_TRUNCATE:
+		err = c.handleRelayTruncate(circ, rcell)
 	case RELAY_DROP:
 		// Ignore
 	default:
@@ -211,21 +236,33 @@ func (c *OnionConnection) handleRelayBegin(circ *Circuit, cell *RelayCell) Actio
 		return CloseCircuit(errors.New("We already have a stream with that ID"), DESTROY_REASON_PROTOCOL)
 	}
 
+	if !c.parentOR.dos.allowStream(len(circ.streams)) {
+		return RefuseStream(errors.New("too many streams on this circuit"), STREAM_REASON_RESOURCELIMIT)
+	}
+
 	if isDir && c.parentOR.config.DirPort == 0 {
 		return RefuseStream(errors.New("We're no directory."), STREAM_REASON_NOTDIRECTORY)
 	}
 
 	var addr string
+	var flags BeginFlags
 	if isDir {
 		addr = fmt.Sprintf("127.0.0.1:%d", c.parentOR.config.DirPort)
 	} else {
-		for i := 0; i < cell.Length(); i++ {
-			if cell.Data()[i] == 0 {
-				addr = string(cell.Data()[0:i])
+		data := cell.Data()
+		for i := 0; i < len(data); i++ {
+			if data[i] == 0 {
+				addr = string(data[0:i])
+				if len(data) >= i+5 {
+					flags = BeginFlags(BigEndian.Uint32(data[i+1 : i+5]))
+				}
 				break
 			}
 		}
-		// XXX handle flags
+
+		if len(flags.families()) == 0 {
+			return RefuseStream(fmt.Errorf("Client accepts neither IPv4 nor IPv6 (flags %#x)", uint32(flags)), STREAM_REASON_NOROUTE)
+		}
 	}
 
 	if addr == "" {
@@ -249,8 +286,9 @@ func (c *OnionConnection) handleRelayBegin(circ *Circuit, cell *RelayCell) Actio
 		return RefuseStream(err, STREAM_REASON_INTERNAL)
 	}
 
+	stream.mem = c.circQueues.account(circ.id)
 	circ.streams[streamID] = stream
-	go stream.Run(circ.id, circ.backwardWindow, c.circuitReadQueue, matches[1], uint16(port), isDir, c.parentOR.config.ExitPolicy)
+	go stream.Run(circ.id, circ.backwardWindow, c.circuitReadQueue, c.parentOR.resolver, matches[1], uint16(port), flags, isDir, c.parentOR.config.ExitPolicy)
 
 	return nil
 }
@@ -284,6 +322,9 @@ func (c *OnionConnection) sendRelayCell(circ *Circuit, stream StreamID, directio
 	}
 
 	crypto.digest.Write(buf)
+	if command == RELAY_DATA && direction == BackwardDirection {
+		circ.sendme.notePackaged(crypto.digest)
+	}
 	digest := crypto.digest.Sum(nil)
 	buf[5] = digest[0]
 	buf[6] = digest[1]
@@ -293,7 +334,7 @@ func (c *OnionConnection) sendRelayCell(circ *Circuit, stream StreamID, directio
 	// Now AES it
 	crypto.cipher.Crypt(buf, buf)
 
-	c.writeQueue <- cell.Bytes() // XXX this could deadlock
+	c.circQueues.enqueue(circ.id, circ.backwardWindow, cell.Bytes())
 
 	return nil
 }
@@ -314,7 +355,10 @@ func (c *OnionConnection) handleRelayEnd(circ *Circuit, cell *RelayCell) Actiona
 
 func (c *OnionConnection) handleRelaySendme(circ *Circuit, cell *RelayCell) ActionableError {
 	if cell.StreamID() == 0 {
-		circ.backwardWindow.Refill(100)
+		if err := circ.sendme.verify(cell.Data()); err != nil {
+			return CloseCircuit(err, DESTROY_REASON_PROTOCOL)
+		}
+		circ.backwardWindow.Refill(CIRCWINDOW_INCREMENT)
 	} else {
 		stream, ok := circ.streams[cell.StreamID()]
 		if !ok {
@@ -322,7 +366,7 @@ func (c *OnionConnection) handleRelaySendme(circ *Circuit, cell *RelayCell) Acti
 			return nil // Sure, that's ok
 		}
 
-		stream.backwardWindow.Refill(50)
+		stream.backwardWindow.Refill(STREAMWINDOW_INCREMENT)
 	}
 	return nil
 }
@@ -330,11 +374,11 @@ func (c *OnionConnection) handleRelaySendme(circ *Circuit, cell *RelayCell) Acti
 // this one takes onion stuff and sends it to our exit connection
 func (c *OnionConnection) handleRelayData(circ *Circuit, cell *RelayCell) ActionableError {
 	circ.forwardWindow--
-	if circ.forwardWindow <= 900 {
-		if err := c.sendRelayCell(circ, 0, BackwardDirection, RELAY_SENDME, nil); err != nil {
+	if circ.forwardWindow <= CIRCWINDOW_START-CIRCWINDOW_INCREMENT {
+		if err := c.sendRelayCell(circ, 0, BackwardDirection, RELAY_SENDME, sendmePayload(circ.forward.digest)); err != nil {
 			return err
 		}
-		circ.forwardWindow += 100
+		circ.forwardWindow += CIRCWINDOW_INCREMENT
 	}
 
 	streamID := cell.StreamID()
@@ -354,7 +398,7 @@ func (c *OnionConnection) handleRelayData(circ *Circuit, cell *RelayCell) Action
 	dataCopy := GetCellBuf(false)
 	copy(dataCopy, data)
 
-	stream.writeChan <- dataCopy[0:len(data)]
+	stream.queueData(dataCopy[0:len(data)])
 
 	return nil
 }
@@ -362,7 +406,14 @@ func (c *OnionConnection) handleRelayData(circ *Circuit, cell *RelayCell) Action
 //mega copypaste
 //figure out window stuff...
 //this one takes onion stuff and shoves it onto our local socks connection
-func (c *OnionConnection) handleRelayDataProxy(pc *ProxyCircuit, cell *RelayCell) ActionableError {
+func (c *OnionConnection) handleRelayDataProxy(pc *ProxyCircuit, hop int, cell *RelayCell) ActionableError {
+	pc.forwardWindow--
+	if pc.forwardWindow <= CIRCWINDOW_START-CIRCWINDOW_INCREMENT {
+		// Data only comes from the last hop, which is also where sendProxyCell delivers the SENDME
+		c.sendProxyCell(pc, 0, RELAY_SENDME, sendmePayload(pc.backwardChain[hop].digest))
+		pc.forwardWindow += CIRCWINDOW_INCREMENT
+	}
+
 	streamID := cell.StreamID()
 	stream, ok := pc.streams[streamID]
 	if !ok {
@@ -375,7 +426,7 @@ func (c *OnionConnection) handleRelayDataProxy(pc *ProxyCircuit, cell *RelayCell
 	dataCopy := GetCellBuf(false)
 	copy(dataCopy, data)
 
-	stream.writeChan <- dataCopy[0:len(data)]
+	stream.queueData(dataCopy[0:len(data)])
 
 	return nil
 }
@@ -399,7 +450,7 @@ func (c *OnionConnection) handleRelayResolve(circ *Circuit, cell *RelayCell) Act
 	}
 
 	dnsName := string(data[:firstZero])
-	ResolveDNSAsync(dnsName, circ.id, stream, c.circuitReadQueue)
+	c.parentOR.resolver.ResolveAsync(dnsName, circ.id, stream, c.circuitReadQueue)
 
 	return nil
 }
@@ -0,0 +1,158 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestRelayEarlyBudget(t *testing.T) {
+	c := &OnionConnection{negotiatedVersion: 4}
+	circ := testHopCircuit(50)
+	circ.nextHop = make(CircReadQueue, MAX_RELAY_EARLY+1)
+	circ.nextHopID = 9
+
+	for i := 0; i < MAX_RELAY_EARLY; i++ {
+		cell := NewCell(4, circ.id, CMD_RELAY_EARLY, nil)
+		cell.Data()[1] = 1 // Not recognized, so it gets forwarded
+		if err := c.handleRelayForward(circ, cell); err != nil {
+			t.Fatalf("RELAY_EARLY %d refused: %s", i+1, err)
+		}
+		if rdata := (<-circ.nextHop).(*RelayData); rdata.rType != CMD_RELAY_EARLY {
+			t.Errorf("RELAY_EARLY %d forwarded as %s", i+1, rdata.rType)
+		}
+	}
+
+	err := c.handleRelayForward(circ, NewCell(4, circ.id, CMD_RELAY_EARLY, nil))
+	if err == nil || err.Handle() != ERROR_CLOSE_CIRCUIT || err.CircDestroyReason() != DESTROY_REASON_PROTOCOL {
+		t.Errorf("expected the circuit to close after too many RELAY_EARLY cells, got %v", err)
+	}
+}
+
+func TestSendProxyCellRelayEarly(t *testing.T) {
+	c := &OnionConnection{
+		negotiatedVersion: 4,
+		circQueues:        newCircuitScheduler(nil),
+	}
+
+	// Nothing to hide from the first hop
+	hop := testHopCircuit(60)
+	pc := &ProxyCircuit{
+		Circuit:       Circuit{id: 0x80000002},
+		forwardChain:  []DirectionalCircuitState{hop.forward},
+		backwardChain: []DirectionalCircuitState{hop.backward},
+	}
+	for i := 0; i < MAX_RELAY_EARLY; i++ {
+		c.sendProxyCell(pc, 1, RELAY_DATA, []byte("data"))
+		if cmd := Command(c.circQueues.next()[4]); cmd != CMD_RELAY {
+			t.Errorf("cell %d for the first hop sent as %s", i, cmd)
+		}
+	}
+	if pc.relayEarlyCount != 0 {
+		t.Errorf("cells for the first hop used up %d RELAY_EARLY cells", pc.relayEarlyCount)
+	}
+
+	// Further along, the EXTENDs get company but keep enough to extend again
+	pc = &ProxyCircuit{
+		Circuit: Circuit{id: 0x80000003, relayEarlyCount: 2}, // Two EXTENDs went out already
+	}
+	for seed := byte(61); seed < 64; seed++ {
+		hop := testHopCircuit(seed)
+		pc.forwardChain = append(pc.forwardChain, hop.forward)
+		pc.backwardChain = append(pc.backwardChain, hop.backward)
+	}
+	for i := 0; i < MAX_RELAY_EARLY; i++ {
+		c.sendProxyCell(pc, 1, RELAY_DATA, []byte("data"))
+		expected := CMD_RELAY_EARLY
+		if i >= MAX_RELAY_EARLY-RELAY_EARLY_EXTEND_RESERVE-2 {
+			expected = CMD_RELAY
+		}
+		if cmd := Command(c.circQueues.next()[4]); cmd != expected {
+			t.Errorf("cell %d sent as %s instead of %s", i, cmd, expected)
+		}
+	}
+	if pc.relayEarlyCount != MAX_RELAY_EARLY-RELAY_EARLY_EXTEND_RESERVE {
+		t.Errorf("expected %d RELAY_EARLY cells left for EXTENDs, got %d", RELAY_EARLY_EXTEND_RESERVE, MAX_RELAY_EARLY-pc.relayEarlyCount)
+	}
+}
+
+func TestExtendGoesThroughCircQueues(t *testing.T) {
+	c := &OnionConnection{
+		negotiatedVersion: 4,
+		isOutbound:        true,
+		writeQueue:        make(chan []byte, 1),
+		circQueues:        newCircuitScheduler(nil),
+		circuits:          make(map[CircuitID]*Circuit),
+		proxyCircuits:     make(map[CircuitID]*ProxyCircuit),
+		relayCircuits:     make(map[CircuitID]*RelayCircuit),
+	}
+	hop := testHopCircuit(65)
+	pc := &ProxyCircuit{
+		Circuit:       Circuit{id: 0x80000004, backwardWindow: NewWindow(1000)},
+		forwardChain:  []DirectionalCircuitState{hop.forward},
+		backwardChain: []DirectionalCircuitState{hop.backward},
+	}
+	c.proxyCircuits[pc.id] = pc
+
+	req := &CircuitRequest{
+		handshakeType:  uint16(HANDSHAKE_NTOR),
+		handshakeData:  make([]byte, 84),
+		newHandshake:   true,
+		handshakeState: &CircuitHandshakeState{},
+		weAreInitiator: true,
+		extendCircId:   pc.id,
+	}
+	req.connHint.address = [][]byte{{127, 0, 0, 1, 0x23, 0x29}}
+	if err := req.Handle(c, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.writeQueue) != 0 {
+		t.Error("EXTEND2 jumped ahead of the circuit's relay cells on the link-level queue")
+	}
+	if c.circQueues.queued(pc.id) != 1 {
+		t.Fatal("EXTEND2 not queued on its circuit")
+	}
+	if cmd := Command(c.circQueues.next()[4]); cmd != CMD_RELAY_EARLY {
+		t.Errorf("EXTEND2 sent as %s", cmd)
+	}
+}
+
+func TestBeginFlags(t *testing.T) {
+	c := &OnionConnection{parentOR: &ORCtx{config: &Config{}}}
+	circ := testHopCircuit(70)
+
+	data := append([]byte("example.com:80\x00"), 0, 0, 0, byte(BEGIN_FLAG_IPV4_NOT_OK))
+	buf := make([]byte, 509)
+	buf[0] = byte(RELAY_BEGIN)
+	BigEndian.PutUint16(buf[3:5], 1)
+	BigEndian.PutUint16(buf[9:11], uint16(len(data)))
+	copy(buf[11:], data)
+
+	err := c.handleRelayBegin(circ, &RelayCell{buf})
+	if err == nil || err.Handle() != ERROR_REFUSE_STREAM || err.StreamEndReason() != STREAM_REASON_NOROUTE {
+		t.Errorf("expected a stream accepting no family to be refused with NOROUTE, got %v", err)
+	}
+
+	for _, test := range []struct {
+		host   string
+		flags  BeginFlags
+		reason StreamEndReason
+	}{
+		{"192.0.2.1", 0, 0},
+		{"192.0.2.1", BEGIN_FLAG_IPV4_NOT_OK | BEGIN_FLAG_IPV6_OK, STREAM_REASON_NOROUTE},
+		{"[2001:db8::1]", 0, STREAM_REASON_NOROUTE},
+		{"[2001:db8::1]", BEGIN_FLAG_IPV6_PREFERRED, STREAM_REASON_NOROUTE},
+		{"[2001:db8::1]", BEGIN_FLAG_IPV6_OK, 0},
+	} {
+		if _, reason := resolveStreamTarget(nil, test.host, test.flags); reason != test.reason {
+			t.Errorf("%s with flags %#x: expected reason %d, got %d", test.host, uint32(test.flags), test.reason, reason)
+		}
+	}
+
+	if f := (BEGIN_FLAG_IPV6_OK | BEGIN_FLAG_IPV6_PREFERRED).families(); len(f) != 2 || f[0] != 6 {
+		t.Errorf("IPv6 not tried first when preferred: %v", f)
+	}
+}
@@ -31,12 +31,12 @@ func (rdata *RelayData) Handle(c *OnionConnection, circ *Circuit) ActionableErro
 		return CloseCircuit(err, DESTROY_REASON_INTERNAL)
 	}
 
-	c.writeQueue <- cell.Bytes()
+	c.circQueues.enqueue(circ.id, nil, cell.Bytes())
 	return nil
 }
 
 func (data *RelayData) HandleRelay(c *OnionConnection, circ *RelayCircuit) ActionableError {
-	c.writeQueue <- NewCell(c.negotiatedVersion, circ.id, data.rType, data.data).Bytes()
+	c.circQueues.enqueue(circ.id, nil, NewCell(c.negotiatedVersion, circ.id, data.rType, data.data).Bytes())
 
 	return nil
 }
@@ -0,0 +1,41 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+)
+
+// All of tor's RSA keys are 1024 bits, with an exponent of 65537
+const RSA_KEY_BITS = 1024
+
+func generateRSAKey() (*rsa.PrivateKey, error) {
+	return rsa.GenerateKey(crand.Reader, RSA_KEY_BITS)
+}
+
+// Same format as C tor's secret_id_key and secret_onion_key
+func marshalRSAPrivateKeyPEM(key *rsa.PrivateKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+}
+
+func loadRSAPrivateKeyPEM(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, errors.New("no RSA private key found")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// Tor's RSA signatures are PKCS#1 v1.5 padding over the data itself, without a DigestInfo
+func rsaSignRaw(key *rsa.PrivateKey, data []byte) ([]byte, error) {
+	return rsa.SignPKCS1v15(nil, key, 0, data)
+}
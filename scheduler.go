@@ -0,0 +1,178 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Once a circuit has this many cells waiting, its streams stop reading until the queue drained to the low mark
+const CIRCUIT_QUEUE_HIGHWATER = 256
+const CIRCUIT_QUEUE_LOWWATER = 64
+
+// How quickly a circuit's past activity stops counting against it
+const CIRCUIT_PRIORITY_HALFLIFE = 30 * time.Second
+
+type circuitQueue struct {
+	cells   [][]byte
+	window  *Window // The circuit's package window, which the streams take from. Nil if nothing reads into it
+	blocked bool
+	mem     *queueAccount // Also charged for what the circuit's streams have queued
+
+	ewma    float64 // Cells written recently, decayed with CIRCUIT_PRIORITY_HALFLIFE
+	updated time.Time
+}
+
+func (q *circuitQueue) activity(now time.Time) float64 {
+	elapsed := now.Sub(q.updated)
+	if elapsed <= 0 {
+		return q.ewma
+	}
+	return q.ewma * math.Exp2(-float64(elapsed)/float64(CIRCUIT_PRIORITY_HALFLIFE))
+}
+
+// Outgoing relay cells, queued per circuit. The writer always picks the quietest circuit that has something to
+// send, so a single busy circuit can't starve the others on the connection.
+type circuitScheduler struct {
+	conn   *OnionConnection // Gets asked to kill circuits when we run out of memory
+	lock   sync.Mutex
+	queues map[CircuitID]*circuitQueue
+	ready  chan struct{} // Signalled when cells got queued
+}
+
+func newCircuitScheduler(conn *OnionConnection) *circuitScheduler {
+	return &circuitScheduler{
+		conn:   conn,
+		queues: make(map[CircuitID]*circuitQueue),
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// Must be called with s.lock held
+func (s *circuitScheduler) queue(id CircuitID, now time.Time) *circuitQueue {
+	q, ok := s.queues[id]
+	if !ok {
+		q = &circuitQueue{
+			mem:     queueMem.open(s.conn, id),
+			updated: now,
+		}
+		s.queues[id] = q
+	}
+	return q
+}
+
+// What the circuit's queued data gets charged to
+func (s *circuitScheduler) account(id CircuitID) *queueAccount {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.queue(id, time.Now()).mem
+}
+
+// Never blocks. If the circuit has too much queued up already, its window gets blocked instead
+func (s *circuitScheduler) enqueue(id CircuitID, window *Window, cell []byte) {
+	now := time.Now()
+	s.lock.Lock()
+	q := s.queue(id, now)
+	if window != nil {
+		q.window = window
+	}
+	q.cells = append(q.cells, cell)
+	if !q.blocked && q.window != nil && len(q.cells) >= CIRCUIT_QUEUE_HIGHWATER {
+		Log(LOG_CIRC, "Circuit %d has %d cells queued, blocking its streams", id, len(q.cells))
+		q.blocked = true
+		q.window.Block()
+	}
+	overLimit := q.mem.add(len(cell), now)
+	s.lock.Unlock()
+
+	if overLimit {
+		queueMem.reclaim(now)
+	}
+	s.wake()
+}
+
+// Gets the writer to look at the queues again
+func (s *circuitScheduler) wake() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// The next cell to write, or nil if nothing is queued
+func (s *circuitScheduler) next() []byte {
+	return s.nextAt(time.Now())
+}
+
+func (s *circuitScheduler) nextAt(now time.Time) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var best *circuitQueue
+	var bestActivity float64
+	for _, q := range s.queues {
+		if len(q.cells) == 0 {
+			continue
+		}
+		activity := q.activity(now)
+		if best == nil || activity < bestActivity {
+			best, bestActivity = q, activity
+		}
+	}
+	if best == nil {
+		return nil
+	}
+
+	cell := best.cells[0]
+	best.cells[0] = nil
+	best.cells = best.cells[1:]
+	if len(best.cells) == 0 {
+		best.cells = nil
+	}
+
+	best.mem.sub(len(cell))
+	best.ewma = bestActivity + 1
+	best.updated = now
+
+	if best.blocked && len(best.cells) <= CIRCUIT_QUEUE_LOWWATER {
+		best.blocked = false
+		best.window.Unblock()
+	}
+
+	return cell
+}
+
+// Drops whatever is still queued for a circuit that went away
+func (s *circuitScheduler) remove(id CircuitID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	q, ok := s.queues[id]
+	if !ok {
+		return
+	}
+	delete(s.queues, id)
+
+	for _, cell := range q.cells {
+		ReturnCellBuf(cell)
+	}
+	q.mem.close()
+	if q.blocked {
+		q.window.Unblock()
+	}
+}
+
+func (s *circuitScheduler) queued(id CircuitID) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	q, ok := s.queues[id]
+	if !ok {
+		return 0
+	}
+	return len(q.cells)
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedulerPrefersQuietCircuits(t *testing.T) {
+	s := newCircuitScheduler(nil)
+	now := time.Now()
+
+	for i := 0; i < 50; i++ {
+		s.enqueue(1, nil, []byte{1})
+	}
+	for i := 0; i < 10; i++ {
+		if cell := s.nextAt(now); cell[0] != 1 {
+			t.Fatal("expected a cell from the only busy circuit")
+		}
+	}
+
+	// A circuit that just showed up goes ahead of the one that has been sending all along
+	s.enqueue(2, nil, []byte{2})
+	if cell := s.nextAt(now); cell[0] != 2 {
+		t.Error("quiet circuit had to wait for the busy one")
+	}
+	if cell := s.nextAt(now); cell[0] != 1 {
+		t.Error("expected the busy circuit to continue")
+	}
+
+	// Once the busy circuit's history decayed, it competes on equal terms again
+	later := now.Add(20 * CIRCUIT_PRIORITY_HALFLIFE)
+	s.enqueue(2, nil, []byte{2})
+	s.enqueue(2, nil, []byte{2})
+	s.nextAt(later)
+	s.nextAt(later)
+	if s.queued(1) != 38 || s.queued(2) != 1 {
+		t.Errorf("expected each circuit to get a turn, have %d and %d cells left", s.queued(1), s.queued(2))
+	}
+
+	s.remove(1)
+	s.remove(2)
+	if s.next() != nil {
+		t.Error("removed circuits still have cells queued")
+	}
+}
+
+func TestSchedulerBackpressure(t *testing.T) {
+	s := newCircuitScheduler(nil)
+	window := NewWindow(CIRCWINDOW_START)
+
+	for i := 0; i < CIRCUIT_QUEUE_HIGHWATER; i++ {
+		s.enqueue(1, window, GetCellBuf(false))
+	}
+	if !window.blocked {
+		t.Fatal("window not blocked with a full queue")
+	}
+
+	taken := make(chan bool, 1)
+	go func() {
+		taken <- window.Take()
+	}()
+	select {
+	case <-taken:
+		t.Fatal("took from a blocked window")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	for s.queued(1) > CIRCUIT_QUEUE_LOWWATER {
+		if !window.blocked {
+			t.Fatal("window unblocked before the queue drained")
+		}
+		ReturnCellBuf(s.next())
+	}
+	if window.blocked {
+		t.Error("window still blocked after the queue drained")
+	}
+	if !<-taken {
+		t.Error("reader didn't get to continue")
+	}
+
+	// Circuits going away don't leave their streams stuck either
+	for i := 0; i < CIRCUIT_QUEUE_HIGHWATER; i++ {
+		s.enqueue(1, window, GetCellBuf(false))
+	}
+	s.remove(1)
+	if window.blocked {
+		t.Error("window still blocked after the circuit went away")
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/tvdw/gotor/sha1"
+)
+
+// Authenticated SENDMEs (prop289): a circuit-level SENDME echoes the running digest of the cell that made the
+// other side send it, so a peer can't acknowledge data it never received.
+const (
+	SENDME_VERSION         = 1
+	CIRCWINDOW_START       = 1000
+	CIRCWINDOW_INCREMENT   = 100
+	STREAMWINDOW_INCREMENT = 50
+)
+
+type sendmeState struct {
+	packaged int      // RELAY_DATA cells we sent on this circuit
+	digests  [][]byte // Digests we expect to see acknowledged, oldest first
+}
+
+// Called for every RELAY_DATA cell we package, after its digest was computed
+func (s *sendmeState) notePackaged(digest *sha1.Digest) {
+	s.packaged++
+	if s.packaged%CIRCWINDOW_INCREMENT == 0 {
+		s.digests = append(s.digests, digest.Sum(nil))
+	}
+}
+
+// Checks the payload of a circuit-level SENDME against the oldest digest we're waiting for
+func (s *sendmeState) verify(payload []byte) error {
+	if len(payload) < 3 {
+		return errors.New("unauthenticated SENDME")
+	}
+	version := payload[0]
+	dataLen := int(BigEndian.Uint16(payload[1:3]))
+	if version != SENDME_VERSION {
+		return fmt.Errorf("SENDME version %d not accepted", version)
+	}
+	if dataLen != sha1.Size || len(payload) < 3+dataLen {
+		return errors.New("malformed SENDME")
+	}
+	if len(s.digests) == 0 {
+		return errors.New("SENDME for data we never sent")
+	}
+
+	expected := s.digests[0]
+	s.digests = s.digests[1:]
+	if !bytes.Equal(expected, payload[3:3+dataLen]) {
+		return errors.New("SENDME digest mismatch")
+	}
+	return nil
+}
+
+// The payload of a version 1 SENDME acknowledging the last cell that went into digest
+func sendmePayload(digest *sha1.Digest) []byte {
+	payload := make([]byte, 3, 3+sha1.Size)
+	payload[0] = SENDME_VERSION
+	BigEndian.PutUint16(payload[1:3], sha1.Size)
+	return digest.Sum(payload)
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+// Passes a cell written by one end of a circuit to the other
+func testPassCell(from *OnionConnection, id CircuitID) Cell {
+	cell := from.circQueues.next()
+	return NewCell(4, id, Command(cell[4]), cell[5:])
+}
+
+func TestAuthenticatedSendme(t *testing.T) {
+	relayConn := &OnionConnection{negotiatedVersion: 4, circQueues: newCircuitScheduler(nil)}
+	proxyConn := &OnionConnection{negotiatedVersion: 4, circQueues: newCircuitScheduler(nil)}
+
+	relay := testHopCircuit(70)
+	ours := testHopCircuit(70)
+	pc := &ProxyCircuit{
+		Circuit: Circuit{
+			id:              relay.id,
+			backwardWindow:  NewWindow(CIRCWINDOW_START),
+			forwardWindow:   CIRCWINDOW_START,
+			relayEarlyCount: MAX_RELAY_EARLY,
+		},
+		forwardChain:  []DirectionalCircuitState{ours.forward},
+		backwardChain: []DirectionalCircuitState{ours.backward},
+	}
+
+	// The relay sends data to us, and we acknowledge it
+	for i := 0; i < CIRCWINDOW_INCREMENT; i++ {
+		relayConn.sendRelayCell(relay, 1, BackwardDirection, RELAY_DATA, []byte("down"))
+		if err := proxyConn.handleRelayProxy(pc, testPassCell(relayConn, pc.id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if queued := proxyConn.circQueues.queued(pc.id); queued != 1 {
+		t.Fatalf("expected one SENDME, got %d cells", queued)
+	}
+	if err := relayConn.handleRelayForward(relay, testPassCell(proxyConn, relay.id)); err != nil {
+		t.Fatalf("relay refused our SENDME: %s", err)
+	}
+	if level := relay.backwardWindow.GetLevel(); level != CIRCWINDOW_START+CIRCWINDOW_INCREMENT {
+		t.Errorf("relay window at %d after SENDME", level)
+	}
+
+	// And the other way around
+	for i := 0; i < CIRCWINDOW_INCREMENT; i++ {
+		proxyConn.sendProxyCell(pc, 1, RELAY_DATA, []byte("up"))
+		if err := relayConn.handleRelayForward(relay, testPassCell(proxyConn, relay.id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := proxyConn.handleRelayProxy(pc, testPassCell(relayConn, pc.id)); err != nil {
+		t.Fatal(err)
+	}
+	if level := pc.backwardWindow.GetLevel(); level != CIRCWINDOW_START+CIRCWINDOW_INCREMENT {
+		t.Errorf("proxy window at %d after SENDME", level)
+	}
+
+	// Nothing left to acknowledge, so another SENDME is a lie
+	proxyConn.sendProxyCell(pc, 0, RELAY_SENDME, sendmePayload(ours.backward.digest))
+	err := relayConn.handleRelayForward(relay, testPassCell(proxyConn, relay.id))
+	if err == nil || err.Handle() != ERROR_CLOSE_CIRCUIT || err.CircDestroyReason() != DESTROY_REASON_PROTOCOL {
+		t.Errorf("expected an unexpected SENDME to close the circuit, got %v", err)
+	}
+}
+
+func TestSendmeVerify(t *testing.T) {
+	circ := testHopCircuit(80)
+	var s sendmeState
+	for i := 0; i < 2*CIRCWINDOW_INCREMENT; i++ {
+		circ.backward.digest.Write([]byte{byte(i)})
+		s.notePackaged(circ.backward.digest)
+		if i == CIRCWINDOW_INCREMENT-1 {
+			circ.forward.digest = circ.backward.digest.Clone()
+		}
+	}
+	if len(s.digests) != 2 {
+		t.Fatalf("expected 2 digests to be recorded, got %d", len(s.digests))
+	}
+
+	if err := s.verify([]byte{}); err == nil {
+		t.Error("accepted an empty SENDME")
+	}
+	if err := s.verify([]byte{0, 0, 0}); err == nil {
+		t.Error("accepted a version 0 SENDME")
+	}
+	if err := s.verify(sendmePayload(circ.forward.digest)); err != nil {
+		t.Errorf("rejected a valid SENDME: %s", err)
+	}
+	if err := s.verify(sendmePayload(circ.forward.digest)); err == nil {
+		t.Error("accepted a replayed SENDME")
+	}
+}
@@ -34,6 +34,12 @@ func FinishSocks(locCon io.ReadWriteCloser) error {
 	return nil
 }
 
+// call this when the stream or its circuit goes away before RELAY_CONNECTED
+func FailSocks(locCon io.ReadWriteCloser) error {
+	defer locCon.Close()
+	return sendConnectFailure(locCon)
+}
+
 type command int
 
 const (
@@ -96,6 +102,12 @@ func sendConnectResp(c io.ReadWriteCloser) error {
 	return nil
 }
 
+func sendConnectFailure(c io.ReadWriteCloser) error {
+	resp := [8]byte{0, '\x5b', 0, 0, 0, 0, 0, 0}
+	_, err := c.Write(resp[:])
+	return err
+}
+
 func socksMain(or *ORCtx) {
 	// Listen on TCP port 2000 on loopback interface
 	l, err := net.Listen("tcp", "127.0.0.1:2000")
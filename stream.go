@@ -5,9 +5,12 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"github.com/miekg/dns"
 	"io"
 	"net"
+	"strings"
 	"sync/atomic"
 	"time"
 )
@@ -25,6 +28,9 @@ type Stream struct {
 	writeChan                     chan []byte
 	forwardWindow, backwardWindow *Window
 	finished                      int32
+
+	queued int64         // Atomic. Bytes waiting in writeChan
+	mem    *queueAccount // The circuit's, which our queued data counts against
 }
 
 /* Stream cleanups
@@ -56,16 +62,63 @@ var dialer = net.Dialer{
 	Timeout:   5 * time.Second,
 }
 
-func (s *Stream) Run(circID CircuitID, circWindow *Window, queue CircReadQueue, address string, port uint16, isDir bool, ep ExitPolicy) {
-	addr := ResolveDNS(address)[0]
+// The address families the client accepts, in the order it wants them tried
+func (f BeginFlags) families() []byte {
+	var families []byte
+	if f&BEGIN_FLAG_IPV4_NOT_OK == 0 {
+		families = append(families, 4)
+	}
+	if f&BEGIN_FLAG_IPV6_OK != 0 {
+		if f&BEGIN_FLAG_IPV6_PREFERRED != 0 {
+			families = append([]byte{6}, families...)
+		} else {
+			families = append(families, 6)
+		}
+	}
+	return families
+}
+
+// Picks the address to connect to out of the families the client accepts. If the host only has addresses the
+// client doesn't accept, there's no route to it
+func resolveStreamTarget(resolver *DNSResolver, host string, flags BeginFlags) (DNSAddress, StreamEndReason) {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	families := flags.families()
+
+	if addr, ok := literalAddress(host); ok {
+		if bytes.IndexByte(families, addr.Type) < 0 {
+			return addr, STREAM_REASON_NOROUTE
+		}
+		return addr, 0
+	}
+
+	results := resolver.Resolve(host, dns.TypeA, dns.TypeAAAA)
+	for _, family := range families {
+		for _, addr := range results {
+			if addr.Type == family {
+				return addr, 0
+			}
+		}
+	}
+	for _, addr := range results {
+		if addr.Type == 4 || addr.Type == 6 {
+			return DNSAddress{}, STREAM_REASON_NOROUTE
+		}
+	}
+	return DNSAddress{}, STREAM_REASON_RESOLVEFAILED
+}
 
-	if !(addr.Type == 4 || addr.Type == 6) {
+func (s *Stream) Run(circID CircuitID, circWindow *Window, queue CircReadQueue, resolver *DNSResolver, address string, port uint16, flags BeginFlags, isDir bool, ep ExitPolicy) {
+	addr, reason := resolveStreamTarget(resolver, address, flags)
+	if reason != 0 {
 		queue <- &StreamControl{
 			circuitID: circID,
 			streamID:  s.id,
 			data:      STREAM_DISCONNECTED,
-			reason:    STREAM_REASON_RESOLVEFAILED,
+			reason:    reason,
 		}
+		return
 	}
 
 	if !isDir && !ep.AllowsConnect(addr.Value, port) {
@@ -75,6 +128,7 @@ func (s *Stream) Run(circID CircuitID, circWindow *Window, queue CircReadQueue,
 			data:       STREAM_DISCONNECTED,
 			reason:     STREAM_REASON_EXITPOLICY,
 			remoteAddr: addr.Value,
+			ttl:        addr.TTL,
 		}
 		return
 	}
@@ -95,12 +149,14 @@ func (s *Stream) Run(circID CircuitID, circWindow *Window, queue CircReadQueue,
 		streamID:   s.id,
 		data:       STREAM_CONNECTED,
 		remoteAddr: addr.Value,
+		ttl:        addr.TTL,
 	}
 
 	defer func() {
 		conn.Close()
 
 		atomic.StoreInt32(&s.finished, 1)
+		s.releaseQueued()
 		s.backwardWindow.Abort()
 		s.forwardWindow.Abort()
 		circWindow.Abort()
@@ -126,6 +182,7 @@ func (s *Stream) Run(circID CircuitID, circWindow *Window, queue CircReadQueue,
 				return
 			}
 			_, err := conn.Write(data)
+			s.dataWritten(len(data))
 			if err != nil {
 				return
 			}
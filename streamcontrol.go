@@ -12,6 +12,7 @@ type StreamControl struct {
 	data       StreamMessageType
 	reason     StreamEndReason
 	remoteAddr []byte
+	ttl        int // Of the DNS answer remoteAddr came from
 }
 
 func (sd *StreamControl) CircID() CircuitID {
@@ -21,22 +22,7 @@ func (sd *StreamControl) CircID() CircuitID {
 func (sc *StreamControl) Handle(c *OnionConnection, circ *Circuit) ActionableError {
 	switch sc.data {
 	case STREAM_CONNECTED:
-		var data []byte
-		if sc.remoteAddr != nil {
-			if len(sc.remoteAddr) == 4 {
-				data = make([]byte, 8) //XXX
-				copy(data, sc.remoteAddr)
-				data[6] = 1
-				data[7] = 44
-			} else if len(sc.remoteAddr) == 16 {
-				data = make([]byte, 25) //XXX
-				data[4] = 6
-				copy(data[5:], sc.remoteAddr)
-				data[23] = 1
-				data[24] = 44
-			}
-		}
-
+		data := encodeConnected(sc.remoteAddr, sc.ttl)
 		return c.sendRelayCell(circ, sc.streamID, BackwardDirection, RELAY_CONNECTED, data)
 
 	case STREAM_DISCONNECTED:
@@ -48,25 +34,7 @@ func (sc *StreamControl) Handle(c *OnionConnection, circ *Circuit) ActionableErr
 		stream.Destroy()
 
 		// We need to inform the OP that the connection died
-		var data []byte
-		if sc.remoteAddr != nil {
-			if len(sc.remoteAddr) == 4 {
-				data = make([]byte, 9) //XXX
-				data[0] = byte(sc.reason)
-				copy(data[1:], sc.remoteAddr)
-				data[7] = 1
-				data[8] = 44
-			} else if len(sc.remoteAddr) == 16 {
-				data = make([]byte, 26) //XXX
-				data[0] = byte(sc.reason)
-				data[5] = 6
-				copy(data[6:], sc.remoteAddr)
-				data[24] = 1
-				data[25] = 44
-			} else {
-				data = []byte{byte(sc.reason)}
-			}
-		}
+		data := encodeEnd(sc.reason, sc.remoteAddr, sc.ttl)
 		return c.sendRelayCell(circ, sc.streamID, BackwardDirection, RELAY_END, data)
 
 	case STREAM_SENDME:
@@ -0,0 +1,93 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// Clients only ever get told one of these two TTLs, like C tor does. Anything finer would let them tell how
+// long an answer has been in our cache, and so what else was resolved through us recently
+const (
+	DNS_MIN_TTL = 5 * 60
+	DNS_MAX_TTL = 60 * 60
+)
+
+func clipDNSTTL(ttl int) uint32 {
+	if ttl < DNS_MIN_TTL {
+		return DNS_MIN_TTL
+	}
+	return DNS_MAX_TTL
+}
+
+// RELAY_CONNECTED bodies are empty, an IPv4 address and a TTL, or 0.0.0.0, an address type of 6, an IPv6 address
+// and a TTL
+func encodeConnected(addr []byte, ttl int) []byte {
+	switch len(addr) {
+	case 4:
+		data := make([]byte, 8)
+		copy(data, addr)
+		BigEndian.PutUint32(data[4:], clipDNSTTL(ttl))
+		return data
+	case 16:
+		data := make([]byte, 25)
+		data[4] = 6
+		copy(data[5:], addr)
+		BigEndian.PutUint32(data[21:], clipDNSTTL(ttl))
+		return data
+	default:
+		return nil
+	}
+}
+
+// Returns a nil address if the exit didn't tell us where it connected to
+func decodeConnected(data []byte) (net.IP, int, error) {
+	switch {
+	case len(data) == 0:
+		return nil, 0, nil
+	case len(data) >= 8 && !net.IP(data[0:4]).Equal(net.IPv4zero):
+		return append(net.IP(nil), data[0:4]...), int(BigEndian.Uint32(data[4:8])), nil
+	case len(data) >= 25 && data[4] == 6:
+		return append(net.IP(nil), data[5:21]...), int(BigEndian.Uint32(data[21:25])), nil
+	default:
+		return nil, 0, errors.New("malformed RELAY_CONNECTED body")
+	}
+}
+
+// RELAY_END bodies are the reason, followed by the refused address and its TTL if the reason is
+// STREAM_REASON_EXITPOLICY
+func encodeEnd(reason StreamEndReason, addr []byte, ttl int) []byte {
+	if reason != STREAM_REASON_EXITPOLICY || (len(addr) != 4 && len(addr) != 16) {
+		return []byte{byte(reason)}
+	}
+
+	data := make([]byte, 1+len(addr)+4)
+	data[0] = byte(reason)
+	copy(data[1:], addr)
+	BigEndian.PutUint32(data[1+len(addr):], clipDNSTTL(ttl))
+	return data
+}
+
+func decodeEnd(data []byte) (StreamEndReason, net.IP, int, error) {
+	if len(data) == 0 {
+		return STREAM_REASON_MISC, nil, 0, errors.New("RELAY_END without a reason")
+	}
+
+	reason := StreamEndReason(data[0])
+	if reason != STREAM_REASON_EXITPOLICY {
+		return reason, nil, 0, nil
+	}
+
+	switch len(data) {
+	case 1:
+		return reason, nil, 0, nil
+	case 1 + 4 + 4, 1 + 16 + 4:
+		addrLen := len(data) - 5
+		return reason, append(net.IP(nil), data[1:1+addrLen]...), int(BigEndian.Uint32(data[1+addrLen:])), nil
+	default:
+		return reason, nil, 0, errors.New("malformed RELAY_END body")
+	}
+}
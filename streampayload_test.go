@@ -0,0 +1,91 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnectedPayload(t *testing.T) {
+	v4 := net.ParseIP("192.0.2.1").To4()
+	data := encodeConnected(v4, 1234)
+	if !bytes.Equal(data, []byte{192, 0, 2, 1, 0, 0, 0x0e, 0x10}) {
+		t.Errorf("unexpected IPv4 RELAY_CONNECTED body %x", data)
+	}
+	if addr, ttl, err := decodeConnected(data); err != nil || !addr.Equal(v4) || ttl != DNS_MAX_TTL {
+		t.Errorf("decoded IPv4 RELAY_CONNECTED as %s, %d, %v", addr, ttl, err)
+	}
+
+	v6 := net.ParseIP("2001:db8::1")
+	data = encodeConnected(v6, 30)
+	if len(data) != 25 || !bytes.Equal(data[0:5], []byte{0, 0, 0, 0, 6}) {
+		t.Errorf("unexpected IPv6 RELAY_CONNECTED body %x", data)
+	}
+	if addr, ttl, err := decodeConnected(data); err != nil || !addr.Equal(v6) || ttl != DNS_MIN_TTL {
+		t.Errorf("decoded IPv6 RELAY_CONNECTED as %s, %d, %v", addr, ttl, err)
+	}
+
+	if data := encodeConnected(nil, 0); data != nil {
+		t.Error("RELAY_CONNECTED without an address should be empty")
+	}
+	if _, _, err := decodeConnected([]byte{0, 0, 0, 0, 4, 1, 2}); err == nil {
+		t.Error("accepted a truncated RELAY_CONNECTED body")
+	}
+}
+
+func TestEndPayload(t *testing.T) {
+	v4 := net.ParseIP("192.0.2.1").To4()
+	if data := encodeEnd(STREAM_REASON_DONE, v4, 600); !bytes.Equal(data, []byte{byte(STREAM_REASON_DONE)}) {
+		t.Errorf("only STREAM_REASON_EXITPOLICY carries an address, got %x", data)
+	}
+
+	data := encodeEnd(STREAM_REASON_EXITPOLICY, v4, 86400)
+	if len(data) != 9 {
+		t.Errorf("unexpected IPv4 RELAY_END body %x", data)
+	}
+	if reason, addr, ttl, err := decodeEnd(data); err != nil || reason != STREAM_REASON_EXITPOLICY || !addr.Equal(v4) || ttl != DNS_MAX_TTL {
+		t.Errorf("decoded IPv4 RELAY_END as %d, %s, %d, %v", reason, addr, ttl, err)
+	}
+
+	v6 := net.ParseIP("2001:db8::1")
+	data = encodeEnd(STREAM_REASON_EXITPOLICY, v6, 900)
+	if len(data) != 21 || !bytes.Equal(data[1:17], v6) {
+		t.Errorf("unexpected IPv6 RELAY_END body %x", data)
+	}
+	if reason, addr, ttl, err := decodeEnd(data); err != nil || reason != STREAM_REASON_EXITPOLICY || !addr.Equal(v6) || ttl != DNS_MAX_TTL {
+		t.Errorf("decoded IPv6 RELAY_END as %d, %s, %d, %v", reason, addr, ttl, err)
+	}
+
+	if _, _, _, err := decodeEnd(nil); err == nil {
+		t.Error("accepted a RELAY_END without a reason")
+	}
+}
+
+func TestCachedTTLsAreClipped(t *testing.T) {
+	r := NewDNSResolver(nil, 0)
+	now := time.Now()
+	short := dnsCacheKey{"short.example.com.", dns.TypeA}
+	long := dnsCacheKey{"long.example.com.", dns.TypeA}
+	r.store(short, []DNSAddress{DNSAddress{Type: 4, TTL: 280, Value: []byte{192, 0, 2, 1}}}, 280, now)
+	r.store(long, []DNSAddress{DNSAddress{Type: 4, TTL: 1000, Value: []byte{192, 0, 2, 2}}}, 1000, now)
+
+	// Part of the TTL has gone by, but the client can't tell
+	later := now.Add(123 * time.Second)
+	if results, ok := r.cached(short, later); !ok || clipDNSTTL(results[0].TTL) != DNS_MIN_TTL {
+		t.Errorf("short cached TTL reported as %v", results)
+	}
+	if results, ok := r.cached(long, later); !ok || clipDNSTTL(results[0].TTL) != DNS_MAX_TTL {
+		t.Errorf("long cached TTL reported as %v", results)
+	}
+	for ttl := 0; ttl < 100000; ttl += 7 {
+		if clipped := clipDNSTTL(ttl); clipped != DNS_MIN_TTL && clipped != DNS_MAX_TTL {
+			t.Fatalf("TTL %d clipped to %d", ttl, clipped)
+		}
+	}
+}
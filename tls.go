@@ -5,40 +5,88 @@
 package main
 
 import (
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base32"
-	"github.com/tvdw/openssl"
+	"fmt"
 	"log"
+	"math/big"
 	"math/rand"
 	"net"
 	"strings"
 	"time"
 )
 
-const SSLRecordSize = openssl.SSLRecordSize
+// Largest amount of data a TLS record can hold
+const SSLRecordSize = 16 * 1024
+
+// TLSConn is what the link handshake needs from a TLS connection, whichever library provides it
+type TLSConn interface {
+	net.Conn
+
+	PeerCertificateDER() ([]byte, error)
+
+	// The TLS 1.2 master secret, as used for AUTH0001
+	TLSSecret() ([]byte, error)
+
+	// The client random followed by the server random
+	ClientServerRandom() ([]byte, error)
+}
+
+// Optionally implemented by a TLSConn that can export RFC 5705 keying material, which AUTH0003 binds to
+type KeyingMaterialExporter interface {
+	ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error)
+}
+
+// TLSBackend wraps connections in TLS using one set of certificates
+type TLSBackend interface {
+	Client(conn net.Conn) (TLSConn, error)
+	Server(conn net.Conn) (TLSConn, error)
+}
+
+// Values for the TLSBackend configuration option
+const (
+	TLS_BACKEND_OPENSSL = "openssl"
+	TLS_BACKEND_GO      = "go"
+)
 
 type TorTLS struct {
-	ctx *openssl.Ctx
+	backend TLSBackend
 
-	LinkKey, IdKey, AuthKey             openssl.PrivateKey
-	LinkCert, IdCert, AuthCert          *openssl.Certificate
+	LinkKey, IdKey, AuthKey             *rsa.PrivateKey
 	LinkCertDER, IdCertDER, AuthCertDER []byte
 	Fingerprint                         Fingerprint
 	Fingerprint256                      []byte
+
+	// Ed25519 signing key certified by our master identity, which in turn certifies the link and auth keys
+	EdSigningKey, EdAuthKey               ed25519.PrivateKey
+	EdSigningCert, EdLinkCert, EdAuthCert []byte
+	EdCrossCert                           []byte
+}
+
+// Makes a certificate for key, signed by signer under issuerName. Like C tor's, they carry made up hostnames and
+// nothing else of interest
+func newTorCertificate(commonName, issuerName string, issued, expires time.Duration, key *rsa.PublicKey, signer *rsa.PrivateKey) ([]byte, error) {
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(rand.Int63()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(issued),
+		NotAfter:     now.Add(expires),
+	}
+	issuer := &x509.Certificate{Subject: pkix.Name{CommonName: issuerName}}
+	return x509.CreateCertificate(crand.Reader, template, issuer, key, signer)
 }
 
 func NewTLSCtx(isClient bool, or *ORCtx) (*TorTLS, error) {
 	log.Printf("Creating TLS context with isClient=%v\n", isClient)
 
-	sslCtx, err := openssl.NewCtxWithVersion(openssl.AnyVersion)
-	if err != nil {
-		return nil, err
-	}
-
-	tls := &TorTLS{
-		ctx: sslCtx,
-	}
+	tls := &TorTLS{}
 
 	// Considering how important this piece of code is for resisting fingerprints, we just follow whatever Tor itself does
 
@@ -49,89 +97,38 @@ func NewTLSCtx(isClient bool, or *ORCtx) (*TorTLS, error) {
 		issued, _ := time.ParseDuration("-24h") // XXX check what tor does (some time ago, then a long-time cert)
 		expires, _ := time.ParseDuration("24h") // XXX also, don't re-use for all certs
 
-		tmpPk, err := openssl.GenerateRSAKeyWithExponent(1024, 65537)
+		tmpPk, err := generateRSAKey()
 		if err != nil {
 			return nil, err
 		}
 
-		authPk, err := openssl.GenerateRSAKeyWithExponent(1024, 65537)
-		if err != nil {
-			return nil, err
-		}
-
-		cert, err := openssl.NewCertificate(&openssl.CertificateInfo{
-			CommonName: nickname1,
-			Serial:     rand.Int63(),
-			Issued:     issued,
-			Expires:    expires,
-		}, tmpPk)
+		authPk, err := generateRSAKey()
 		if err != nil {
 			return nil, err
 		}
 
 		identityPk := or.identityKey
 
-		idcert, err := openssl.NewCertificate(&openssl.CertificateInfo{
-			CommonName: nickname2,
-			Serial:     rand.Int63(),
-			Issued:     issued,
-			Expires:    expires,
-		}, identityPk)
+		// The identity certificate is self-signed, and signs the other two
+		tls.IdCertDER, err = newTorCertificate(nickname2, nickname2, issued, expires, &identityPk.PublicKey, identityPk)
 		if err != nil {
 			return nil, err
 		}
+		tls.IdKey = identityPk
 
-		authcert, err := openssl.NewCertificate(&openssl.CertificateInfo{
-			CommonName: nickname1,
-			Serial:     rand.Int63(),
-			Issued:     issued,
-			Expires:    expires,
-		}, authPk)
+		tls.LinkCertDER, err = newTorCertificate(nickname1, nickname2, issued, expires, &tmpPk.PublicKey, identityPk)
 		if err != nil {
 			return nil, err
 		}
-
-		if err := cert.SetIssuer(idcert); err != nil {
-			return nil, err
-		}
-		if err := cert.Sign(identityPk, openssl.EVP_SHA1); err != nil {
-			return nil, err
-		}
-
-		if err := idcert.SetIssuer(idcert); err != nil {
-			return nil, err
-		}
-		if err := idcert.Sign(identityPk, openssl.EVP_SHA1); err != nil {
-			return nil, err
-		}
-
-		if err := authcert.SetIssuer(idcert); err != nil {
-			return nil, err
-		}
-		if err := authcert.Sign(identityPk, openssl.EVP_SHA1); err != nil {
-			return nil, err
-		}
-
-		sslCtx.UseCertificate(cert)
-		sslCtx.UsePrivateKey(tmpPk)
-
-		sslCtx.SetEllipticCurve(openssl.Prime256v1)
-
-		tls.LinkCert = cert
 		tls.LinkKey = tmpPk
-		tls.LinkCertDER, err = cert.MarshalDER()
-		if err != nil {
-			return nil, err
-		}
 
-		tls.IdCert = idcert
-		tls.IdKey = identityPk
-		tls.IdCertDER, err = idcert.MarshalDER()
+		tls.AuthCertDER, err = newTorCertificate(nickname1, nickname2, issued, expires, &authPk.PublicKey, identityPk)
 		if err != nil {
 			return nil, err
 		}
+		tls.AuthKey = authPk
 
-		keyDer, _ := identityPk.MarshalPKCS1PublicKeyDER()
+		keyDer := x509.MarshalPKCS1PublicKey(&identityPk.PublicKey)
 		fingerprint := sha1.Sum(keyDer)
 		log.Printf("Our fingerprint is %X\n", fingerprint)
 		copy(tls.Fingerprint[:], fingerprint[:])
@@ -142,48 +139,76 @@ func NewTLSCtx(isClient bool, or *ORCtx) (*TorTLS, error) {
 			tls.Fingerprint256 = sha.Sum(nil)
 		}
 
-		tls.AuthCert = authcert
-		tls.AuthKey = authPk
-		tls.AuthCertDER, err = authcert.MarshalDER()
+		signingKey, signingCert, crossCert, err := or.edSigningKeyFor(time.Now(), expires)
 		if err != nil {
 			return nil, err
 		}
+		_, edAuthKey, err := ed25519.GenerateKey(crand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		linkDigest := sha256.Sum256(tls.LinkCertDER)
+
+		tls.EdSigningKey = signingKey
+		tls.EdSigningCert = signingCert
+		tls.EdLinkCert = NewEd25519Cert(CERTTYPE_ED_SIGNING_LINK, ED_CERT_KEYTYPE_SHA256_X509, linkDigest[:], expires, signingKey, false)
+		tls.EdAuthKey = edAuthKey
+		tls.EdAuthCert = NewEd25519Cert(CERTTYPE_ED_SIGNING_AUTH, ED_CERT_KEYTYPE_ED25519, edAuthKey.Public().(ed25519.PublicKey), expires, signingKey, false)
+		tls.EdCrossCert = crossCert
 	}
 
-	// We don't want SSLv2 or SSLv3
-	sslCtx.SetOptions(openssl.NoSSLv2 | openssl.NoSSLv3)
-
-	// Prefer the server's ordering of ciphers: the client's ordering has
-	// historically been chosen for fingerprinting resistance.
-	sslCtx.SetOptions(openssl.CipherServerPreference)
-
-	//XXX: panic() if we don't have openssl of 1.0.1e or later
-	//XXX: please remember me why...
-
-	// Tickets hurt perfect forward secrecy, but we still have non-server clients announce them, to reduce fingerprinting impact
-	if !isClient {
-		sslCtx.SetOptions(openssl.NoTicket)
+	backend := or.config.TLSBackend
+	if backend == "" {
+		backend = TLS_BACKEND_DEFAULT
 	}
 
-	// This saves us quite some memory
-	//sslCtx.SetMode(openssl.ReleaseBuffers)
-
-	// Avoid reusing DH keys if we don't have to
-	sslCtx.SetOptions(openssl.SingleDHUse | openssl.SingleECDHUse)
+	var err error
+	switch backend {
+	case TLS_BACKEND_OPENSSL:
+		tls.backend, err = newOpenSSLBackend(tls, isClient)
+	case TLS_BACKEND_GO:
+		tls.backend, err = newGoTLSBackend(tls, isClient)
+	default:
+		err = fmt.Errorf("unknown TLS backend %q", backend)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	// Never renegotiate.
-	sslCtx.SetOptions(openssl.NoSessionResumptionOrRenegotiation)
+	return tls, nil
+}
 
-	// All compression does with encrypted data is waste CPU cycles. Disable it
-	sslCtx.SetOptions(openssl.NoCompression)
+// Like C tor, we keep our ed25519 signing key until it's about to expire rather than making one for every TLS
+// context. A new one comes once the current one would expire before a certificate valid for certLifetime. Returns
+// the key with its certificate and our RSA->ed25519 cross-certificate.
+func (or *ORCtx) edSigningKeyFor(now time.Time, certLifetime time.Duration) (ed25519.PrivateKey, []byte, []byte, error) {
+	or.edSigningLock.Lock()
+	defer or.edSigningLock.Unlock()
 
-	// Disable session caching
-	sslCtx.SetSessionCacheMode(openssl.SessionCacheOff)
+	if or.edSigningKey != nil && now.Add(certLifetime).Before(or.edSigningExpires) {
+		return or.edSigningKey, or.edSigningCert, or.edCrossCert, nil
+	}
 
-	// Allow all peer certificates
-	sslCtx.SetVerify(openssl.VerifyNone, nil)
+	Log(LOG_INFO, "Generating a new ed25519 signing key")
+	_, signingKey, err := ed25519.GenerateKey(crand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	signingCert := NewEd25519Cert(CERTTYPE_ED_ID_SIGNING, ED_CERT_KEYTYPE_ED25519, signingKey.Public().(ed25519.PublicKey), ED_SIGNING_KEY_LIFETIME, or.edIdentityKey, true)
+	parsed, err := ParseEd25519Cert(signingCert)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	crossCert, err := NewRSAEdCrossCert(or.edIdentityKey.Public().(ed25519.PublicKey), ED_SIGNING_KEY_LIFETIME, or.identityKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-	return tls, nil
+	or.edSigningKey = signingKey
+	or.edSigningCert = signingCert
+	or.edSigningExpires = parsed.Expires // Whole hours, so possibly a little before ED_SIGNING_KEY_LIFETIME is up
+	or.edCrossCert = crossCert
+	return signingKey, signingCert, crossCert, nil
 }
 
 func (or *ORCtx) GetTLSCtx(isClient bool) *TorTLS {
@@ -225,15 +250,15 @@ func SetupTLS(or *ORCtx) error {
 	return nil
 }
 
-func (or *ORCtx) WrapTLS(conn net.Conn, isClient bool) (*openssl.Conn, *TorTLS, error) {
+func (or *ORCtx) WrapTLS(conn net.Conn, isClient bool) (TLSConn, *TorTLS, error) {
 	tls := or.GetTLSCtx(isClient)
 
-	var tlsConn *openssl.Conn
+	var tlsConn TLSConn
 	var err error
 	if isClient {
-		tlsConn, err = openssl.Client(conn, tls.ctx)
+		tlsConn, err = tls.backend.Client(conn)
 	} else {
-		tlsConn, err = openssl.Server(conn, tls.ctx)
+		tlsConn, err = tls.backend.Server(conn)
 	}
 
 	if err != nil {
@@ -0,0 +1,211 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+// goTLSBackend does TLS with crypto/tls, and doesn't need cgo
+type goTLSBackend struct {
+	config *tls.Config
+}
+
+type goTLSConn struct {
+	*tls.Conn
+	sniffer  *helloSniffer
+	keyLog   *keyLogCapture
+	isClient bool
+}
+
+func newGoTLSBackend(torTLS *TorTLS, isClient bool) (*goTLSBackend, error) {
+	config := &tls.Config{
+		// AUTH0001 is built on the master secret, which TLS 1.3 doesn't have
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS12,
+
+		// Never renegotiate, and no session resumption either
+		Renegotiation:          tls.RenegotiateNever,
+		SessionTicketsDisabled: true,
+
+		// Allow all peer certificates: the CERTS cell is what actually tells us who they are
+		InsecureSkipVerify: true,
+	}
+
+	if !isClient {
+		config.Certificates = []tls.Certificate{{
+			Certificate: [][]byte{torTLS.LinkCertDER},
+			PrivateKey:  torTLS.LinkKey,
+		}}
+	}
+
+	return &goTLSBackend{config: config}, nil
+}
+
+func (b *goTLSBackend) wrap(conn net.Conn, isClient bool) *goTLSConn {
+	sniffer := &helloSniffer{Conn: conn}
+	keyLog := &keyLogCapture{}
+
+	config := b.config.Clone()
+	config.KeyLogWriter = keyLog
+
+	tlsConn := &goTLSConn{
+		sniffer:  sniffer,
+		keyLog:   keyLog,
+		isClient: isClient,
+	}
+	if isClient {
+		tlsConn.Conn = tls.Client(sniffer, config)
+	} else {
+		tlsConn.Conn = tls.Server(sniffer, config)
+	}
+	return tlsConn
+}
+
+func (b *goTLSBackend) Client(conn net.Conn) (TLSConn, error) {
+	return b.wrap(conn, true), nil
+}
+
+func (b *goTLSBackend) Server(conn net.Conn) (TLSConn, error) {
+	return b.wrap(conn, false), nil
+}
+
+func (c *goTLSConn) PeerCertificateDER() ([]byte, error) {
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	certs := c.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("peer did not send a certificate")
+	}
+	return certs[0].Raw, nil
+}
+
+func (c *goTLSConn) TLSSecret() ([]byte, error) {
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	return c.keyLog.masterSecret()
+}
+
+func (c *goTLSConn) ClientServerRandom() ([]byte, error) {
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+
+	ours, theirs := c.sniffer.randoms()
+	if ours == nil || theirs == nil {
+		return nil, errors.New("could not find the TLS hello randoms")
+	}
+	if c.isClient {
+		return append(ours, theirs...), nil
+	}
+	return append(theirs, ours...), nil
+}
+
+// Implements KeyingMaterialExporter
+func (c *goTLSConn) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	state := c.ConnectionState()
+	return state.ExportKeyingMaterial(label, context, length)
+}
+
+// crypto/tls won't give us the master secret, except through the NSS key log format
+type keyLogCapture struct {
+	lock   sync.Mutex
+	secret []byte
+}
+
+func (k *keyLogCapture) Write(line []byte) (int, error) {
+	fields := strings.Fields(string(line))
+	if len(fields) == 3 && fields[0] == "CLIENT_RANDOM" {
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return 0, err
+		}
+		k.lock.Lock()
+		k.secret = secret
+		k.lock.Unlock()
+	}
+	return len(line), nil
+}
+
+func (k *keyLogCapture) masterSecret() ([]byte, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.secret == nil {
+		return nil, errors.New("no TLS master secret available")
+	}
+	return k.secret, nil
+}
+
+// Record header, handshake header and protocol version come before the random in both hello messages
+const helloRandomOffset = 5 + 4 + 2
+const helloPrefixLen = helloRandomOffset + 32
+
+// helloSniffer remembers the start of both directions of a TLS connection, which is where the hello randoms are.
+// crypto/tls has no other way to get to them.
+type helloSniffer struct {
+	net.Conn
+
+	lock      sync.Mutex
+	read      []byte
+	written   []byte
+	readDone  bool
+	wroteDone bool
+}
+
+func keepPrefix(prefix, data []byte) []byte {
+	if need := helloPrefixLen - len(prefix); need > 0 {
+		if need > len(data) {
+			need = len(data)
+		}
+		prefix = append(prefix, data[:need]...)
+	}
+	return prefix
+}
+
+func (s *helloSniffer) Read(b []byte) (int, error) {
+	n, err := s.Conn.Read(b)
+	s.lock.Lock()
+	if !s.readDone {
+		s.read = keepPrefix(s.read, b[:n])
+		s.readDone = len(s.read) == helloPrefixLen
+	}
+	s.lock.Unlock()
+	return n, err
+}
+
+func (s *helloSniffer) Write(b []byte) (int, error) {
+	s.lock.Lock()
+	if !s.wroteDone {
+		s.written = keepPrefix(s.written, b)
+		s.wroteDone = len(s.written) == helloPrefixLen
+	}
+	s.lock.Unlock()
+	return s.Conn.Write(b)
+}
+
+func helloRandom(prefix []byte) []byte {
+	// Handshake record, with a ClientHello or ServerHello in it
+	if len(prefix) != helloPrefixLen || prefix[0] != 22 || (prefix[5] != 1 && prefix[5] != 2) {
+		return nil
+	}
+	return append([]byte(nil), prefix[helloRandomOffset:]...)
+}
+
+// Returns the random from the hello we sent, and the one from the hello we received
+func (s *helloSniffer) randoms() ([]byte, []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return helloRandom(s.written), helloRandom(s.read)
+}
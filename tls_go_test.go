@@ -0,0 +1,168 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGoTLSBackend(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	now := time.Now()
+	cert := makeTestCert(t, key, key, now.Add(-time.Hour), now.Add(time.Hour))
+
+	// Set up the server certificate by hand, rather than making a whole TorTLS
+	server, _ := newGoTLSBackend(&TorTLS{}, true)
+	server.config.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{cert.Raw},
+		PrivateKey:  key,
+	}}
+	client, _ := newGoTLSBackend(&TorTLS{}, true)
+
+	clientSide, serverSide := net.Pipe()
+	clientConn, _ := client.Client(clientSide)
+	serverConn, _ := server.Server(serverSide)
+	defer clientSide.Close()
+	defer serverSide.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := serverConn.Write([]byte("hi"))
+		done <- err
+	}()
+	var buf [2]byte
+	if _, err := clientConn.Read(buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	peerCert, err := clientConn.PeerCertificateDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(peerCert, cert.Raw) {
+		t.Error("client did not see the server certificate")
+	}
+
+	clientSecrets, err := auth0001TLSSecrets(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverSecrets, err := auth0001TLSSecrets(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(clientSecrets, serverSecrets) {
+		t.Error("both sides should agree on TLSSECRETS")
+	}
+
+	clientRandoms, _ := clientConn.ClientServerRandom()
+	serverRandoms, _ := serverConn.ClientServerRandom()
+	if len(clientRandoms) != 64 || !bytes.Equal(clientRandoms, serverRandoms) {
+		t.Error("both sides should agree on the hello randoms")
+	}
+
+	clientExporter, ok := clientConn.(KeyingMaterialExporter)
+	if !ok {
+		t.Fatal("crypto/tls connections should export keying material")
+	}
+	serverExporter, ok := serverConn.(KeyingMaterialExporter)
+	if !ok {
+		t.Fatal("crypto/tls connections should export keying material")
+	}
+	clientExport, err := clientExporter.ExportKeyingMaterial("EXPORTER FOR TOR TLS CLIENT BINDING AUTH0003", []byte("context"), 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverExport, err := serverExporter.ExportKeyingMaterial("EXPORTER FOR TOR TLS CLIENT BINDING AUTH0003", []byte("context"), 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(clientExport, serverExport) {
+		t.Error("both sides should export the same keying material")
+	}
+}
+
+func TestNewTLSCtxCerts(t *testing.T) {
+	identityKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	_, edIdentityKey, _ := ed25519.GenerateKey(rand.Reader)
+	or := &ORCtx{
+		config:        &Config{TLSBackend: TLS_BACKEND_GO},
+		identityKey:   identityKey,
+		edIdentityKey: edIdentityKey,
+	}
+	torTLS, err := NewTLSCtx(false, or)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var certs [4]*x509.Certificate
+	for cType, der := range map[byte][]byte{CERTTYPE_LINK: torTLS.LinkCertDER, CERTTYPE_ID: torTLS.IdCertDER, CERTTYPE_AUTH: torTLS.AuthCertDER} {
+		if certs[cType], err = x509.ParseCertificate(der); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := validateRSACerts(certs, true, torTLS.LinkCertDER, time.Now()); err != nil {
+		t.Error(err)
+	}
+	if err := validateRSACerts(certs, false, nil, time.Now()); err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(certs[CERTTYPE_ID].RawIssuer, certs[CERTTYPE_LINK].RawIssuer) || !bytes.Equal(certs[CERTTYPE_ID].RawIssuer, certs[CERTTYPE_ID].RawSubject) {
+		t.Error("certificates are not issued under the name of the identity certificate")
+	}
+}
+
+func TestEdSigningKeyOutlivesTLSCtx(t *testing.T) {
+	identityKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	_, edIdentityKey, _ := ed25519.GenerateKey(rand.Reader)
+	or := &ORCtx{
+		config:        &Config{TLSBackend: TLS_BACKEND_GO},
+		identityKey:   identityKey,
+		edIdentityKey: edIdentityKey,
+	}
+	first, err := NewTLSCtx(false, or)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewTLSCtx(false, or)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotating TLS only re-signs the link and auth certificates
+	if !first.EdSigningKey.Equal(second.EdSigningKey) || !bytes.Equal(first.EdSigningCert, second.EdSigningCert) {
+		t.Error("new TLS context came with a new ed25519 signing key")
+	}
+	if bytes.Equal(first.EdLinkCert, second.EdLinkCert) || bytes.Equal(first.EdAuthCert, second.EdAuthCert) {
+		t.Error("new TLS context kept the old link and auth certificates")
+	}
+	linkCert, err := ParseEd25519Cert(second.EdLinkCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := linkCert.CheckSignature(second.EdSigningKey.Public().(ed25519.PublicKey)); err != nil {
+		t.Error(err)
+	}
+
+	// Until it would expire before the certificates it signs
+	renewed, signingCert, _, err := or.edSigningKeyFor(time.Now().Add(ED_SIGNING_KEY_LIFETIME-time.Hour), 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Equal(first.EdSigningKey) || bytes.Equal(signingCert, first.EdSigningCert) {
+		t.Error("ed25519 signing key not replaced when it was about to expire")
+	}
+}
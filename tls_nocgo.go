@@ -0,0 +1,19 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"errors"
+)
+
+// Without cgo there's no OpenSSL, which leaves crypto/tls
+const TLS_BACKEND_DEFAULT = TLS_BACKEND_GO
+
+func newOpenSSLBackend(tls *TorTLS, isClient bool) (TLSBackend, error) {
+	return nil, errors.New("built without cgo, so the openssl TLS backend is not available")
+}
@@ -0,0 +1,129 @@
+// Copyright 2015 The GoTor Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/tvdw/openssl"
+	"net"
+)
+
+// OpenSSL stays the default wherever we can link against it
+const TLS_BACKEND_DEFAULT = TLS_BACKEND_OPENSSL
+
+type openSSLBackend struct {
+	ctx *openssl.Ctx
+}
+
+type openSSLConn struct {
+	*openssl.Conn
+}
+
+func newOpenSSLBackend(tls *TorTLS, isClient bool) (*openSSLBackend, error) {
+	sslCtx, err := openssl.NewCtxWithVersion(openssl.AnyVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isClient {
+		// Our keys and certificates are made with crypto/x509, so hand them over as PEM
+		cert, err := openssl.LoadCertificateFromPEM(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tls.LinkCertDER}))
+		if err != nil {
+			return nil, err
+		}
+		key, err := openssl.LoadPrivateKeyFromPEM(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(tls.LinkKey)}))
+		if err != nil {
+			return nil, err
+		}
+		if err := sslCtx.UseCertificate(cert); err != nil {
+			return nil, err
+		}
+		if err := sslCtx.UsePrivateKey(key); err != nil {
+			return nil, err
+		}
+
+		sslCtx.SetEllipticCurve(openssl.Prime256v1)
+	}
+
+	// We don't want SSLv2 or SSLv3
+	sslCtx.SetOptions(openssl.NoSSLv2 | openssl.NoSSLv3)
+
+	// Prefer the server's ordering of ciphers: the client's ordering has
+	// historically been chosen for fingerprinting resistance.
+	sslCtx.SetOptions(openssl.CipherServerPreference)
+
+	//XXX: panic() if we don't have openssl of 1.0.1e or later
+	//XXX: please remember me why...
+
+	// Tickets hurt perfect forward secrecy, but we still have non-server clients announce them, to reduce fingerprinting impact
+	if !isClient {
+		sslCtx.SetOptions(openssl.NoTicket)
+	}
+
+	// This saves us quite some memory
+	//sslCtx.SetMode(openssl.ReleaseBuffers)
+
+	// Avoid reusing DH keys if we don't have to
+	sslCtx.SetOptions(openssl.SingleDHUse | openssl.SingleECDHUse)
+
+	// Never renegotiate.
+	sslCtx.SetOptions(openssl.NoSessionResumptionOrRenegotiation)
+
+	// All compression does with encrypted data is waste CPU cycles. Disable it
+	sslCtx.SetOptions(openssl.NoCompression)
+
+	// Disable session caching
+	sslCtx.SetSessionCacheMode(openssl.SessionCacheOff)
+
+	// Allow all peer certificates
+	sslCtx.SetVerify(openssl.VerifyNone, nil)
+
+	return &openSSLBackend{ctx: sslCtx}, nil
+}
+
+func (b *openSSLBackend) Client(conn net.Conn) (TLSConn, error) {
+	tlsConn, err := openssl.Client(conn, b.ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &openSSLConn{tlsConn}, nil
+}
+
+func (b *openSSLBackend) Server(conn net.Conn) (TLSConn, error) {
+	tlsConn, err := openssl.Server(conn, b.ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &openSSLConn{tlsConn}, nil
+}
+
+func (c *openSSLConn) PeerCertificateDER() ([]byte, error) {
+	cert, err := c.Conn.PeerCertificate()
+	if err != nil {
+		return nil, err
+	}
+	return cert.MarshalDER()
+}
+
+func (c *openSSLConn) TLSSecret() ([]byte, error) {
+	secret := c.Conn.GetTLSSecret()
+	if secret == nil {
+		return nil, errors.New("no TLS master secret available")
+	}
+	return secret, nil
+}
+
+func (c *openSSLConn) ClientServerRandom() ([]byte, error) {
+	random := c.Conn.GetClientServerHelloRandom()
+	if len(random) != 64 {
+		return nil, errors.New("no TLS hello randoms available")
+	}
+	return random, nil
+}
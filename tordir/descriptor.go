@@ -6,12 +6,15 @@ package tordir
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"github.com/tvdw/openssl"
 	"log"
 	"net"
 	"net/http"
@@ -33,7 +36,7 @@ type Descriptor struct {
 	Hibernating                                     bool
 	UptimeStart                                     time.Time
 	NTORKey                                         []byte
-	SigningKey, OnionKey                            openssl.PrivateKey
+	SigningKey, OnionKey                            *rsa.PrivateKey
 	Accept, Reject, IPv6Policy                      string
 	Contact                                         string
 	Family                                          []string
@@ -47,6 +50,14 @@ type Descriptor struct {
 	GeoIPDBDigest                                   string
 	GeoIP6DBDigest                                  string
 	ExitPolicy                                      string
+
+	// Ed25519 identity. Optional, but all of them have to be given when one is
+	Ed25519IdentityCert  []byte // Signing key, certified by the master key
+	Ed25519MasterKey     []byte
+	Ed25519SigningKey    ed25519.PrivateKey
+	OnionKeyCrossCert    []byte
+	NTORKeyCrossCert     []byte
+	NTORKeyCrossCertSign byte
 }
 
 func (d *Descriptor) Validate() error {
@@ -74,9 +85,34 @@ func (d *Descriptor) Validate() error {
 	if d.NTORKey == nil {
 		return errors.New("no NTORKey given")
 	}
+	if d.Ed25519IdentityCert != nil {
+		if d.Ed25519MasterKey == nil || d.Ed25519SigningKey == nil {
+			return errors.New("ed25519 identity given without its keys")
+		}
+		if d.OnionKeyCrossCert == nil || d.NTORKeyCrossCert == nil {
+			return errors.New("ed25519 identity given without onion key cross-certificates")
+		}
+	}
 	return nil
 }
 
+// Appends router-sig-ed25519, which covers everything written so far
+func (d *Descriptor) signEd25519(buf *bytes.Buffer) {
+	buf.WriteString("router-sig-ed25519 ")
+	digest := sha256.New()
+	digest.Write([]byte("Tor router descriptor signature v1"))
+	digest.Write(buf.Bytes())
+	signature := ed25519.Sign(d.Ed25519SigningKey, digest.Sum(nil))
+	buf.WriteString(fmt.Sprintf("%s\n", base64.RawStdEncoding.EncodeToString(signature)))
+}
+
+func publicKeyPEM(key *rsa.PublicKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PUBLIC KEY",
+		Bytes: x509.MarshalPKCS1PublicKey(key),
+	})
+}
+
 func (d *Descriptor) SignedDescriptor() (string, error) {
 	var buf, extra bytes.Buffer
 	if err := d.Validate(); err != nil {
@@ -85,7 +121,7 @@ func (d *Descriptor) SignedDescriptor() (string, error) {
 
 	published := time.Now()
 
-	keyDer, _ := d.SigningKey.MarshalPKCS1PublicKeyDER()
+	keyDer := x509.MarshalPKCS1PublicKey(&d.SigningKey.PublicKey)
 	fingerprint := sha1.Sum(keyDer)
 	fp := fmt.Sprintf("%X %X %X %X %X %X %X %X %X %X",
 		fingerprint[0:2], fingerprint[2:4], fingerprint[4:6], fingerprint[6:8], fingerprint[8:10],
@@ -94,6 +130,13 @@ func (d *Descriptor) SignedDescriptor() (string, error) {
 
 	buf.WriteString(fmt.Sprintf("router %s %s %d 0 %d\n", d.Nickname, d.Address, d.ORPort, d.DirPort))
 	extra.WriteString(fmt.Sprintf("extra-info %s %X\n", d.Nickname, fingerprint))
+	if d.Ed25519IdentityCert != nil {
+		identity := pem.EncodeToMemory(&pem.Block{Type: "ED25519 CERT", Bytes: d.Ed25519IdentityCert})
+		buf.WriteString("identity-ed25519\n")
+		buf.Write(identity)
+		extra.WriteString("identity-ed25519\n")
+		extra.Write(identity)
+	}
 	extra.WriteString(fmt.Sprintf("published %s\n", published.Format("2006-01-02 15:04:05")))
 
 	for _, addr := range d.ORAddress {
@@ -105,22 +148,48 @@ func (d *Descriptor) SignedDescriptor() (string, error) {
 	buf.WriteString(fmt.Sprintf("fingerprint %s\n", fp))
 	buf.WriteString(fmt.Sprintf("uptime %d\n", published.Unix()-d.UptimeStart.Unix()+1))
 	buf.WriteString(fmt.Sprintf("bandwidth %d %d %d\n", d.BandwidthAvg, d.BandwidthBurst, d.BandwidthObserved))
+
+	// The extra-info document is complete, so it gets signed before the descriptor refers to it by digest. The
+	// SHA1 covers the signed part, the SHA256 the whole document, like C tor computes them.
+	if d.Ed25519IdentityCert != nil {
+		d.signEd25519(&extra)
+	}
+	extra.WriteString("router-signature\n")
 	extraDigest := sha1.Sum(extra.Bytes())
-	buf.WriteString(fmt.Sprintf("extra-info-digest %X\n", extraDigest[:]))
-	buf.WriteString(fmt.Sprintf("onion-key\n"))
-	onion, err := d.OnionKey.MarshalPKCS1PublicKeyPEM()
+	signature, err := rsa.SignPKCS1v15(nil, d.SigningKey, 0, extraDigest[:])
 	if err != nil {
 		return "", err
 	}
-	buf.Write(onion)
+	pem.Encode(&extra, &pem.Block{
+		Type:  "SIGNATURE",
+		Bytes: signature,
+	})
+	if d.Ed25519IdentityCert != nil {
+		extraDigest256 := sha256.Sum256(extra.Bytes())
+		buf.WriteString(fmt.Sprintf("extra-info-digest %X %s\n", extraDigest[:], base64.RawStdEncoding.EncodeToString(extraDigest256[:])))
+	} else {
+		buf.WriteString(fmt.Sprintf("extra-info-digest %X\n", extraDigest[:]))
+	}
 
-	buf.WriteString(fmt.Sprintf("signing-key\n"))
+	buf.WriteString(fmt.Sprintf("onion-key\n"))
+	buf.Write(publicKeyPEM(&d.OnionKey.PublicKey))
 
-	pub, err := d.SigningKey.MarshalPKCS1PublicKeyPEM()
-	if err != nil {
-		return "", err
+	buf.WriteString(fmt.Sprintf("signing-key\n"))
+	buf.Write(publicKeyPEM(&d.SigningKey.PublicKey))
+
+	if d.Ed25519IdentityCert != nil {
+		buf.WriteString(fmt.Sprintf("master-key-ed25519 %s\n", base64.RawStdEncoding.EncodeToString(d.Ed25519MasterKey)))
+		buf.WriteString("onion-key-crosscert\n")
+		pem.Encode(&buf, &pem.Block{
+			Type:  "CROSSCERT",
+			Bytes: d.OnionKeyCrossCert,
+		})
+		buf.WriteString(fmt.Sprintf("ntor-onion-key-crosscert %d\n", d.NTORKeyCrossCertSign))
+		pem.Encode(&buf, &pem.Block{
+			Type:  "ED25519 CERT",
+			Bytes: d.NTORKeyCrossCert,
+		})
 	}
-	buf.Write(pub)
 
 	if len(d.Family) != 0 {
 		buf.WriteString(fmt.Sprintf("family %s\n", strings.Join(d.Family, " ")))
@@ -139,12 +208,15 @@ func (d *Descriptor) SignedDescriptor() (string, error) {
 	}
 	buf.WriteString(fmt.Sprintf("ntor-onion-key %s\n", base64.StdEncoding.EncodeToString(d.NTORKey)))
 	buf.WriteString(d.ExitPolicy)
+	if d.Ed25519IdentityCert != nil {
+		d.signEd25519(&buf)
+	}
 	buf.WriteString(fmt.Sprintf("router-signature\n"))
 
 	digest := sha1.Sum(buf.Bytes())
 
 	// Sign descriptor
-	signature, err := d.SigningKey.PrivateEncrypt(digest[:])
+	signature, err = rsa.SignPKCS1v15(nil, d.SigningKey, 0, digest[:])
 	if err != nil {
 		return "", err
 	}
@@ -153,16 +225,6 @@ func (d *Descriptor) SignedDescriptor() (string, error) {
 		Bytes: signature,
 	})
 
-	// Sign extrainfo
-	signature, err = d.SigningKey.PrivateEncrypt(digest[:])
-	if err != nil {
-		return "", err
-	}
-	pem.Encode(&extra, &pem.Block{
-		Type:  "SIGNATURE",
-		Bytes: signature,
-	})
-
 	return buf.String() + extra.String(), nil
 }
 
@@ -5,11 +5,18 @@
 package tordir
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
-	"github.com/tvdw/openssl"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
 	"golang.org/x/crypto/curve25519"
 	"log"
 	"net"
+	"strings"
 	"testing"
 	"time"
 )
@@ -30,11 +37,11 @@ func TestBasic(t *testing.T) {
 	d.BandwidthAvg = 1000000
 	d.BandwidthBurst = 1200000
 	d.BandwidthObserved = 30107
-	k, err := openssl.GenerateRSAKeyWithExponent(1024, 65537)
+	k, err := rsa.GenerateKey(rand.Reader, 1024)
 	if err != nil {
 		t.Error(err)
 	}
-	d.OnionKey, err = openssl.GenerateRSAKeyWithExponent(1024, 65537)
+	d.OnionKey, err = rsa.GenerateKey(rand.Reader, 1024)
 	d.SigningKey = k
 	desc, err := d.SignedDescriptor()
 	if err != nil {
@@ -43,3 +50,77 @@ func TestBasic(t *testing.T) {
 
 	log.Println(desc)
 }
+
+func testDescriptor(t *testing.T) *Descriptor {
+	var priv, pub [32]byte
+	rand.Read(priv[:])
+	curve25519.ScalarBaseMult(&pub, &priv)
+
+	d := &Descriptor{
+		Nickname:    "mylittletorry18",
+		Platform:    "Tor 0.2.6.2-alpha on MS-DOS",
+		Address:     net.ParseIP("80.57.124.58"),
+		ORPort:      1234,
+		UptimeStart: time.Now(),
+		NTORKey:     pub[:],
+	}
+	var err error
+	if d.SigningKey, err = rsa.GenerateKey(rand.Reader, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if d.OnionKey, err = rsa.GenerateKey(rand.Reader, 1024); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// The extra-info-digest in the descriptor has to match the extra-info document that gets uploaded with it
+func checkExtraInfoDigest(t *testing.T, d *Descriptor, withSHA256 bool) {
+	desc, err := d.SignedDescriptor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	split := strings.Index(desc, "extra-info ")
+	if split < 0 {
+		t.Fatal("no extra-info document")
+	}
+	router, extra := desc[:split], desc[split:]
+
+	var digestLine string
+	for _, line := range strings.Split(router, "\n") {
+		if strings.HasPrefix(line, "extra-info-digest ") {
+			digestLine = line
+		}
+	}
+	fields := strings.Fields(digestLine)
+
+	signedLen := strings.Index(extra, "router-signature\n") + len("router-signature\n")
+	sha1Digest := sha1.Sum([]byte(extra[:signedLen]))
+	if len(fields) < 2 || fields[1] != fmt.Sprintf("%X", sha1Digest[:]) {
+		t.Errorf("extra-info-digest %q does not match the extra-info document", digestLine)
+	}
+	sha256Digest := sha256.Sum256([]byte(extra))
+	if withSHA256 && (len(fields) != 3 || fields[2] != base64.RawStdEncoding.EncodeToString(sha256Digest[:])) {
+		t.Errorf("extra-info-digest %q lacks the right SHA256 digest", digestLine)
+	}
+	if !withSHA256 && len(fields) != 2 {
+		t.Errorf("unexpected extra-info-digest %q", digestLine)
+	}
+
+	block, _ := pem.Decode([]byte(extra[signedLen:]))
+	if block == nil || rsa.VerifyPKCS1v15(&d.SigningKey.PublicKey, 0, sha1Digest[:], block.Bytes) != nil {
+		t.Error("extra-info document is not signed over its own digest")
+	}
+}
+
+func TestExtraInfoDigest(t *testing.T) {
+	checkExtraInfoDigest(t, testDescriptor(t), false)
+
+	d := testDescriptor(t)
+	_, d.Ed25519SigningKey, _ = ed25519.GenerateKey(rand.Reader)
+	d.Ed25519MasterKey = make([]byte, 32)
+	d.Ed25519IdentityCert = []byte("identity cert")
+	d.OnionKeyCrossCert = []byte("onion key crosscert")
+	d.NTORKeyCrossCert = []byte("ntor key crosscert")
+	checkExtraInfoDigest(t, d, true)
+}
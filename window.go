@@ -9,8 +9,9 @@ import (
 )
 
 type Window struct {
-	cond   *sync.Cond
-	window int
+	cond    *sync.Cond
+	window  int
+	blocked bool // Take doesn't hand out anything while set, no matter what's left
 }
 
 func NewWindow(window int) *Window {
@@ -31,13 +32,27 @@ func (w *Window) Refill(count int) {
 	w.cond.L.Unlock()
 }
 
+// Pauses Take until Unblock is called, to hold off readers while cells pile up elsewhere
+func (w *Window) Block() {
+	w.cond.L.Lock()
+	w.blocked = true
+	w.cond.L.Unlock()
+}
+
+func (w *Window) Unblock() {
+	w.cond.L.Lock()
+	w.blocked = false
+	w.cond.Broadcast()
+	w.cond.L.Unlock()
+}
+
 func (w *Window) Take() bool {
 	w.cond.L.Lock()
-	if w.window <= 0 {
+	if w.window <= 0 || w.blocked {
 		w.cond.Wait()
 	}
 	st := false
-	if w.window > 0 {
+	if w.window > 0 && !w.blocked {
 		st = true
 		w.window--
 	}